@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// auditHash hashes a record's JSON without its hash and signature. The
+// fields are re-encoded with sorted keys, so the hash doesn't depend on field
+// order and still covers fields this version doesn't know about.
+func auditHash(record []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(record, &fields); err != nil {
+		return "", err
+	}
+	delete(fields, "hash")
+	delete(fields, "signature")
+
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditAnchorName is the file in the audit directory that records where the
+// chain on disk starts.
+const auditAnchorName = "anchor.json"
+
+// AuditAnchor tells verification where the chain must start: at the first
+// record ever written, or right after the last record retention removed.
+// It is signed with the device key like the records, so deleting the oldest
+// records, or putting forged ones before them, breaks verification.
+type AuditAnchor struct {
+	// ChainedSince is the month the first hashed record was written in.
+	// Records without a hash, from before chaining, are only accepted in
+	// that month's file or older ones.
+	ChainedSince string `json:"chainedSince"`
+	// Unchained is how many records without a hash there were when the
+	// anchor was made; no more are accepted.
+	Unchained int `json:"unchained"`
+	// Seq and Hash are the last record removed by retention, zero until
+	// then.
+	Seq       int64  `json:"seq"`
+	Hash      string `json:"hash"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// message is what the anchor's signature covers.
+func (a AuditAnchor) message() []byte {
+	return []byte(fmt.Sprintf("tatbeeb-link-audit-anchor\n%s\n%d\n%d\n%s\n", a.ChainedSince, a.Unchained, a.Seq, a.Hash))
+}
+
+// readAuditAnchor reads an anchor file. It reports false if there is none.
+func readAuditAnchor(path string) (AuditAnchor, bool, error) {
+	var anchor AuditAnchor
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return anchor, false, nil
+	}
+	if err != nil {
+		return anchor, false, err
+	}
+	if err := json.Unmarshal(data, &anchor); err != nil {
+		return anchor, false, fmt.Errorf("unreadable audit anchor %s: %w", path, err)
+	}
+	return anchor, true, nil
+}
+
+// writeAuditAnchor signs anchor with key, if there is one, and replaces the
+// file atomically.
+func writeAuditAnchor(path string, anchor AuditAnchor, key ed25519.PrivateKey) error {
+	anchor.Signature = ""
+	if key != nil {
+		anchor.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, anchor.message()))
+	}
+	data, err := json.MarshalIndent(anchor, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	chownData(tmp)
+	return os.Rename(tmp, path)
+}
+
+// auditFileMonth returns the month of an audit file named like
+// audit-2025-03.jsonl, or "" for other names.
+func auditFileMonth(path string) string {
+	month := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "audit-"), ".jsonl")
+	if _, err := time.Parse(auditMonthLayout, month); err != nil {
+		return ""
+	}
+	return month
+}
+
+// auditVerifier walks audit records in order and checks every link.
+type auditVerifier struct {
+	// publicKey checks signatures; without it they are not checked.
+	publicKey ed25519.PublicKey
+	// requireSigned fails on records without a signature.
+	requireSigned bool
+	// anchor is where the chain must start. Without one it must start at
+	// the first record ever written, with no records from before chaining.
+	anchor *AuditAnchor
+
+	// month is the month of the file being checked
+	month     string
+	started   bool
+	head      AuditChainHead
+	unchained int
+	verified  int
+	signed    int
+}
+
+// checkAnchor verifies the anchor's signature before it is relied on.
+func (v *auditVerifier) checkAnchor() error {
+	if v.anchor == nil {
+		return nil
+	}
+	switch {
+	case v.anchor.Signature == "":
+		if v.requireSigned {
+			return errors.New("the audit anchor is not signed")
+		}
+	case v.publicKey != nil:
+		sig, err := base64.StdEncoding.DecodeString(v.anchor.Signature)
+		if err != nil || !ed25519.Verify(v.publicKey, v.anchor.message(), sig) {
+			return errors.New("the audit anchor's signature doesn't match the device key")
+		}
+	}
+	return nil
+}
+
+// check verifies the next record. The error describes the broken link.
+func (v *auditVerifier) check(line []byte) error {
+	var rec AuditRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return fmt.Errorf("unreadable record: %v", err)
+	}
+
+	// Records written before hash chaining was added have no hash
+	if rec.Hash == "" {
+		switch {
+		case v.started:
+			return errors.New("record has no hash")
+		case v.anchor == nil:
+			return errors.New("record has no hash, and there is no anchor saying records from before chaining are expected")
+		case v.month == "" || v.month > v.anchor.ChainedSince:
+			return errors.New("record has no hash, in a file written after chaining was enabled")
+		case v.unchained >= v.anchor.Unchained:
+			return fmt.Errorf("record has no hash, and only %d records from before chaining were kept", v.anchor.Unchained)
+		}
+		v.unchained++
+		return nil
+	}
+
+	hash, err := auditHash(line)
+	if err != nil {
+		return fmt.Errorf("unreadable record: %v", err)
+	}
+	if hash != rec.Hash {
+		return errors.New("record was changed: its hash doesn't match its contents")
+	}
+
+	// The first record continues from the anchor, or from nothing
+	prev := v.head
+	if !v.started && v.anchor != nil {
+		prev = AuditChainHead{Seq: v.anchor.Seq, Hash: v.anchor.Hash}
+	}
+	if rec.PrevHash != prev.Hash {
+		if !v.started {
+			return fmt.Errorf("the chain starts at record %d, not where the anchor says it does: older records were removed or forged", rec.Seq)
+		}
+		return fmt.Errorf("previous hash doesn't match record %d: a record was removed, reordered or changed", v.head.Seq)
+	}
+	if rec.Seq != prev.Seq+1 {
+		return fmt.Errorf("sequence jumps from %d to %d", prev.Seq, rec.Seq)
+	}
+
+	switch {
+	case rec.Signature == "":
+		if v.requireSigned {
+			return errors.New("record is not signed")
+		}
+	case v.publicKey != nil:
+		sig, err := base64.StdEncoding.DecodeString(rec.Signature)
+		if err != nil || !ed25519.Verify(v.publicKey, []byte(rec.Hash), sig) {
+			return errors.New("signature doesn't match the device key")
+		}
+		v.signed++
+	}
+
+	v.started = true
+	v.head = AuditChainHead{Seq: rec.Seq, Hash: rec.Hash}
+	v.verified++
+	return nil
+}
+
+// verifyFile checks every record of one file, returning the line number of
+// the first broken link.
+func (v *auditVerifier) verifyFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	v.month = auditFileMonth(path)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := v.check(scanner.Bytes()); err != nil {
+			return lineNum, err
+		}
+	}
+	return 0, scanner.Err()
+}
+
+const auditUsageText = `Usage: tatbeeb-link audit verify [flags] [file...]
+
+Checks that the connection audit log wasn't edited: every record's hash must
+match its contents and the hash stored in the next record, and signatures
+must match the device key. The chain must start where the device's signed
+anchor says, so records removed from the start are noticed too. Without
+files, all of this device's audit files are checked in order.
+`
+
+func runAuditCommand(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprint(os.Stderr, auditUsageText)
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	configPath := fs.String("config", "", "settings file whose audit log to check (default: the user config directory)")
+	publicKey := fs.String("key", "", "base64 ed25519 public key to check signatures with (default: this device's key)")
+	requireSigned := fs.Bool("require-signed", false, "fail on records without a signature")
+	anchorPath := fs.String("anchor", "", "anchor the chain must start from (default: this device's)")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, auditUsageText+"\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	path, err := settingsPath(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitConfig
+	}
+	dataDir := filepath.Dir(path)
+
+	v := &auditVerifier{requireSigned: *requireSigned}
+	if *publicKey != "" {
+		if v.publicKey, err = decodePublicKey(*publicKey); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return exitUsage
+		}
+	} else if key, err := readDeviceKey(dataDir); err == nil {
+		v.publicKey = key.Public().(ed25519.PublicKey)
+	}
+
+	explicitAnchor := *anchorPath != ""
+	if !explicitAnchor {
+		*anchorPath = filepath.Join(dataDir, auditDirName, auditAnchorName)
+	}
+	anchor, ok, err := readAuditAnchor(*anchorPath)
+	if err == nil && !ok && explicitAnchor {
+		err = fmt.Errorf("%s doesn't exist", *anchorPath)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitError
+	}
+	if ok {
+		v.anchor = &anchor
+	}
+	if err := v.checkAnchor(); err != nil {
+		fmt.Printf("❌ %s: %v\n", *anchorPath, err)
+		return exitError
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		l := &auditLog{dir: filepath.Join(dataDir, auditDirName)}
+		months, err := l.months()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return exitError
+		}
+		for _, month := range months {
+			files = append(files, l.monthPath(month))
+		}
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "❌ No audit records found")
+		return exitError
+	}
+
+	for _, file := range files {
+		line, err := v.verifyFile(file)
+		if err != nil {
+			if line > 0 {
+				fmt.Printf("❌ %s line %d: %v\n", file, line, err)
+			} else {
+				fmt.Printf("❌ %s: %v\n", file, err)
+			}
+			fmt.Printf("   Records verified before it: %d\n", v.verified)
+			return exitError
+		}
+	}
+
+	fmt.Printf("✅ Chain intact: %d records in %d files\n", v.verified, len(files))
+	fmt.Printf("   Chain head: seq %d hash %s\n", v.head.Seq, v.head.Hash)
+	if v.publicKey != nil {
+		fmt.Printf("   Signatures: %d of %d records signed by key %s\n", v.signed, v.verified, keyFingerprint(v.publicKey))
+	} else {
+		fmt.Println("   Signatures: not checked, no public key")
+	}
+	if v.anchor != nil && v.anchor.Hash != "" {
+		fmt.Printf("   Starts after record %d, removed by retention (hash %s)\n", v.anchor.Seq, v.anchor.Hash)
+	}
+	if v.unchained > 0 {
+		fmt.Printf("   %d older records predate hash chaining and can't be verified\n", v.unchained)
+	}
+	return exitOK
+}
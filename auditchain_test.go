@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestAuditLog opens the audit log of dataDir with retentionDays.
+func openTestAuditLog(t *testing.T, dataDir string, retentionDays int) *auditLog {
+	t.Helper()
+	s := defaultSettings()
+	s.Audit.RetentionDays = retentionDays
+	l, err := openAuditLog(dataDir, &SettingsStore{settings: s})
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	return l
+}
+
+// recordAudit appends n records.
+func recordAudit(t *testing.T, l *auditLog, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := l.append(AuditRecord{TunnelID: "db", Stream: int64(i + 1)}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+}
+
+// verifyAudit checks the audit files of dataDir the way audit verify does,
+// requiring signatures by the device key.
+func verifyAudit(t *testing.T, dataDir string) (*auditVerifier, error) {
+	t.Helper()
+	key, err := readDeviceKey(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &auditVerifier{publicKey: key.Public().(ed25519.PublicKey), requireSigned: true}
+	l := &auditLog{dir: filepath.Join(dataDir, auditDirName)}
+	anchor, ok, err := readAuditAnchor(filepath.Join(l.dir, auditAnchorName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		v.anchor = &anchor
+	}
+	if err := v.checkAnchor(); err != nil {
+		return v, err
+	}
+	months, err := l.months()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, month := range months {
+		if line, err := v.verifyFile(l.monthPath(month)); err != nil {
+			return v, fmt.Errorf("%s line %d: %w", month, line, err)
+		}
+	}
+	return v, nil
+}
+
+// editAuditFile replaces the current month's audit file with edit's result.
+func editAuditFile(t *testing.T, l *auditLog, edit func(lines []string) []string) {
+	t.Helper()
+	path := l.monthPath(time.Now().Format(auditMonthLayout))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+	if err := os.WriteFile(path, []byte(strings.Join(edit(lines), "")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditChainVerifies(t *testing.T) {
+	dataDir := t.TempDir()
+	l := openTestAuditLog(t, dataDir, 365)
+	recordAudit(t, l, 3)
+
+	v, err := verifyAudit(t, dataDir)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if v.verified != 3 || v.signed != 3 || v.head != l.Head() {
+		t.Errorf("verified %d, signed %d, head %+v, want 3 records up to %+v", v.verified, v.signed, v.head, l.Head())
+	}
+}
+
+func TestAuditChainDetectsRemovedStart(t *testing.T) {
+	dataDir := t.TempDir()
+	l := openTestAuditLog(t, dataDir, 365)
+	recordAudit(t, l, 3)
+
+	editAuditFile(t, l, func(lines []string) []string { return lines[1:] })
+	if _, err := verifyAudit(t, dataDir); err == nil || !strings.Contains(err.Error(), "chain starts at record 2") {
+		t.Errorf("verify = %v, want the missing first record noticed", err)
+	}
+}
+
+func TestAuditChainRejectsUnhashedRecords(t *testing.T) {
+	dataDir := t.TempDir()
+	l := openTestAuditLog(t, dataDir, 365)
+	recordAudit(t, l, 2)
+
+	forged := `{"tunnelId":"db","stream":7}` + "\n"
+	editAuditFile(t, l, func(lines []string) []string { return append([]string{forged}, lines...) })
+	if _, err := verifyAudit(t, dataDir); err == nil || !strings.Contains(err.Error(), "no hash") {
+		t.Errorf("verify = %v, want the record without a hash rejected", err)
+	}
+}
+
+func TestAuditPruneAdvancesAnchor(t *testing.T) {
+	dataDir := t.TempDir()
+	l := openTestAuditLog(t, dataDir, 30)
+	recordAudit(t, l, 3)
+	removed := l.Head()
+
+	// Move the records to a month long past retention
+	l.file.Close()
+	l.file = nil
+	if err := os.Rename(l.monthPath(time.Now().Format(auditMonthLayout)), l.monthPath("2020-01")); err != nil {
+		t.Fatal(err)
+	}
+	l.locked(func() error {
+		l.pruneLocked(time.Now())
+		return nil
+	})
+	if _, err := os.Stat(l.monthPath("2020-01")); !os.IsNotExist(err) {
+		t.Fatalf("the expired audit file wasn't removed: %v", err)
+	}
+	recordAudit(t, l, 2)
+
+	v, err := verifyAudit(t, dataDir)
+	if err != nil {
+		t.Fatalf("verify after retention: %v", err)
+	}
+	if v.anchor.Seq != removed.Seq || v.anchor.Hash != removed.Hash || v.verified != 2 {
+		t.Errorf("anchor %+v, verified %d, want 2 records after %+v", v.anchor, v.verified, removed)
+	}
+}
+
+func TestAuditLogSharedBetweenProcesses(t *testing.T) {
+	dataDir := t.TempDir()
+	// The service and the tray app each open the log
+	logs := []*auditLog{openTestAuditLog(t, dataDir, 365), openTestAuditLog(t, dataDir, 365)}
+
+	var wg sync.WaitGroup
+	for _, l := range logs {
+		wg.Add(1)
+		go func(l *auditLog) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := l.append(AuditRecord{TunnelID: "db", Stream: int64(i + 1)}); err != nil {
+					t.Errorf("append: %v", err)
+				}
+			}
+		}(l)
+	}
+	wg.Wait()
+
+	v, err := verifyAudit(t, dataDir)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if v.verified != 40 || v.head.Seq != 40 {
+		t.Errorf("verified %d records up to seq %d, want one chain of 40", v.verified, v.head.Seq)
+	}
+}
+
+func TestAuditExportCSVIsPlainCSV(t *testing.T) {
+	dataDir := t.TempDir()
+	l := openTestAuditLog(t, dataDir, 365)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := l.append(AuditRecord{TunnelID: "db", Stream: int64(i + 1), Opened: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	head, err := l.Export(&buf, now.AddDate(0, 0, -1), now.AddDate(0, 0, 1), "csv")
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("the export doesn't parse as CSV: %v", err)
+	}
+	if len(rows) != 3 || !slices.Equal(rows[0], auditCSVHeader) {
+		t.Errorf("export rows = %q, want the header and 2 records", rows)
+	}
+	if head != l.Head() {
+		t.Errorf("export head = %+v, want %+v", head, l.Head())
+	}
+}
+
+func TestAuditHeadReloadedOnlyAfterOtherWriters(t *testing.T) {
+	dataDir := t.TempDir()
+	service, app := openTestAuditLog(t, dataDir, 365), openTestAuditLog(t, dataDir, 365)
+	month := time.Now().Format(auditMonthLayout)
+
+	recordAudit(t, service, 2)
+	if !service.headCurrent(month) {
+		t.Error("the head is reread after this process's own record")
+	}
+	recordAudit(t, app, 1)
+	if service.headCurrent(month) {
+		t.Error("the head isn't reread after another process appended")
+	}
+	recordAudit(t, service, 1)
+	if head := service.Head(); head.Seq != 4 {
+		t.Errorf("head seq %d, want 4", head.Seq)
+	}
+}
@@ -61,7 +61,8 @@ $env:CGO_ENABLED = "1"
 $env:GOOS = "windows"
 $env:GOARCH = "amd64"
 
-go build -ldflags="-s -w -H windowsgui" -o ..\bin\TatbeebLink.exe .
+. "$PSScriptRoot\build-info.ps1"
+go build -ldflags="-s -w -H windowsgui $buildFlags" -o ..\bin\TatbeebLink.exe .
 
 if ($LASTEXITCODE -eq 0) {
     Write-Host ""
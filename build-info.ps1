@@ -0,0 +1,23 @@
+# Stamps builds with their version, commit and date. The build scripts
+# dot-source this and pass $buildFlags to go build's -ldflags.
+#
+# The version is $env:TATBEEB_VERSION, else the latest git tag. Set
+# $env:TATBEEB_UPDATE_KEY to the release public key for builds that install
+# updates.
+
+$buildVersion = $env:TATBEEB_VERSION
+if (-not $buildVersion) {
+    $buildVersion = (git describe --tags --abbrev=0 2>$null)
+}
+if (-not $buildVersion) {
+    $buildVersion = "dev"
+}
+$buildVersion = $buildVersion -replace '^v', ''
+$buildCommit = (git rev-parse --short=12 HEAD 2>$null)
+$buildDate = (Get-Date).ToUniversalTime().ToString("yyyy-MM-ddTHH:mm:ssZ")
+
+$buildFlags = "-X main.Version=$buildVersion -X main.Commit=$buildCommit -X main.BuildDate=$buildDate"
+if ($env:TATBEEB_UPDATE_KEY) {
+    $buildFlags += " -X main.updatePublicKey=$($env:TATBEEB_UPDATE_KEY)"
+}
+Write-Host "Version: $buildVersion ($buildCommit)" -ForegroundColor Gray
@@ -17,7 +17,8 @@ go mod tidy
 # Build with Windows subsystem (no console window)
 Write-Host "Building executable..." -ForegroundColor Yellow
 $env:CGO_ENABLED = "0"
-go build -ldflags="-H=windowsgui -s -w" -o TatbeebLink.exe
+. "$PSScriptRoot\build-info.ps1"
+go build -ldflags="-H=windowsgui -s -w $buildFlags" -o TatbeebLink.exe
 
 if ($LASTEXITCODE -eq 0) {
     Write-Host "Build successful!" -ForegroundColor Green
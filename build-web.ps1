@@ -16,7 +16,8 @@ go mod download
 # Build the executable
 Write-Host "🏗️  Compiling..." -ForegroundColor Yellow
 $env:CGO_ENABLED = "0"
-go build -ldflags "-s -w -H windowsgui" -o "$binDir\TatbeebLink-Web.exe" .
+. "$PSScriptRoot\build-info.ps1"
+go build -ldflags "-s -w -H windowsgui $buildFlags" -o "$binDir\TatbeebLink-Web.exe" .
 
 if ($LASTEXITCODE -eq 0) {
     Write-Host "Build successful!" -ForegroundColor Green
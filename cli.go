@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes, so scripts and service managers can tell failures apart.
+const (
+	exitOK     = 0
+	exitError  = 1
+	exitUsage  = 2
+	exitTunnel = 3 // a tunnel could not connect, or gave up reconnecting
+	exitConfig = 4 // settings could not be loaded or were rejected
+	// exitUpdated asks the service manager for a restart, into a newly
+	// installed version or the one an update was rolled back to
+	exitUpdated = 5
+)
+
+const usageText = `Usage: tatbeeb-link [command] [flags]
+
+Commands:
+  (none)    Start with the system tray icon and dashboard
+  run       Run tunnels headless, without the tray or a browser
+  service   Install, uninstall or check the system service
+  audit     Verify the connection audit log
+  update    Check the update feed, or create and sign releases
+  diagnose  Check the connection to the relay and the databases
+  relay     Run a self-hosted relay for agents to connect to
+  version   Print the version
+  help      Show this help
+
+Run "tatbeeb-link <command> -h" for the flags of a command.
+`
+
+func runCLI(args []string) int {
+	cmd := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "":
+		return runDefault(args)
+	case "run":
+		return runHeadless(args)
+	case "service":
+		return runServiceCommand(args)
+	case "audit":
+		return runAuditCommand(args)
+	case "update":
+		return runUpdateCommand(args)
+	case "diagnose":
+		return runDiagnoseCommand(args)
+	case "relay":
+		return runRelayCommand(args)
+	case "version":
+		// Updates read the first line to check a download
+		fmt.Printf("Tatbeeb Link %s\n", build.Version)
+		if build.Commit != "" {
+			fmt.Printf("Commit:  %s\n", build.Commit)
+		}
+		if build.BuildDate != "" {
+			fmt.Printf("Built:   %s\n", build.BuildDate)
+		}
+		fmt.Printf("Go:      %s %s\n", build.GoVersion, build.Platform)
+		return exitOK
+	case "help":
+		fmt.Print(usageText)
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", cmd, usageText)
+		return exitUsage
+	}
+}
+
+// parseFlags parses args into fs, mapping -h to a clean exit.
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return exitUsage, false
+	}
+	return 0, true
+}
+
+// runDefault starts the desktop app: tray icon, dashboard and auto-connect.
+// Without a tray it keeps running headless until interrupted.
+func runDefault(args []string) int {
+	fs := flag.NewFlagSet("tatbeeb-link", flag.ContinueOnError)
+	noTray := fs.Bool("no-tray", false, "run without the system tray icon")
+	noBrowser := fs.Bool("no-browser", false, "don't open the dashboard in a browser at startup")
+	configPath := fs.String("config", "", "settings file (default: the user config directory)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	path, err := settingsPath(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitConfig
+	}
+	if err := setupLogging(os.Stderr, filepath.Dir(path), logFileName); err != nil {
+		slog.Warn("can't write the log file, logging to the dashboard only", "err", err)
+	}
+
+	// A second launch brings up the first one's dashboard instead of
+	// adding another tray icon
+	inst, err := acquireInstance(filepath.Dir(path))
+	if errors.Is(err, errAlreadyRunning) {
+		if err := signalRunningInstance(filepath.Dir(path)); err != nil {
+			slog.Error("Tatbeeb Link is already running but didn't respond", "err", err)
+			return exitError
+		}
+		slog.Info("Tatbeeb Link is already running, opened its dashboard")
+		return exitOK
+	}
+	if err != nil {
+		slog.Warn("can't check for another running copy", "err", err)
+	}
+	defer inst.Close()
+
+	app, err := newApp(path)
+	if err != nil {
+		slog.Error("can't start", "err", err)
+		return exitConfig
+	}
+	app.noBrowser = *noBrowser
+	inst.OnOpen(func() {
+		openBrowser(app.dashboardURL())
+	})
+
+	// With the system service running, the tray only shows its state, and
+	// the service updates itself
+	app.viewerURL = findRunningService(filepath.Dir(path))
+	if app.viewerURL == "" {
+		app.notifications = newNotifications(newNotifier())
+		if app.resumeUpdate() {
+			inst.Close()
+			return app.restartAfterUpdate(false)
+		}
+		go app.watchForUpdates()
+	}
+
+	if code := runDesktop(app, *noTray); code != exitUpdated {
+		return code
+	}
+	// The new copy takes over the lock
+	inst.Close()
+	return app.restartAfterUpdate(false)
+}
+
+// runDesktop shows the tray, or runs headless without one, until the app is
+// exited or restarts for an update.
+func runDesktop(app *App, noTray bool) int {
+	if !noTray {
+		err := runTray(app)
+		if err == nil {
+			if app.updates.restarting() {
+				return exitUpdated
+			}
+			return exitOK
+		}
+		slog.Warn("running without the tray", "err", err)
+	}
+
+	setLogConsole(os.Stdout)
+	if app.viewerURL != "" {
+		slog.Error("the Tatbeeb Link service is already running", "url", app.viewerURL)
+		return exitError
+	}
+	app.startBackground()
+	return app.waitForStop(nil, nil)
+}
+
+// runHeadless runs tunnels without any GUI. Logs go to stdout.
+func runHeadless(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	target := fs.String("target", "", `tunnel target: a port, host:port or host\INSTANCE (default: saved tunnels)`)
+	relay := fs.String("relay", "", "relay host:port, comma-separated to add fallbacks (default: saved relays)")
+	relayToken := fs.String("relay-token", "", "token of a self-hosted relay (default: the saved token)")
+	tunnelIDs := fs.String("tunnel", "", "comma-separated ids of saved tunnels to start (default: auto-connect tunnels)")
+	web := fs.Bool("web", false, "also serve the dashboard")
+	metricsListen := fs.String("metrics-listen", "", "also serve /metrics, /healthz and /readyz on this host:port (default: the saved address)")
+	retry := fs.Bool("retry", false, "keep retrying when the relay can't be reached instead of exiting")
+	service := fs.Bool("service", false, "run as the installed system service (set by \"service install\")")
+	configPath := fs.String("config", "", "settings file (default: the user config directory)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *target != "" && *tunnelIDs != "" {
+		fmt.Fprintln(os.Stderr, "--target and --tunnel can't be combined")
+		return exitUsage
+	}
+
+	path, err := settingsPath(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitConfig
+	}
+	// Run by root on a user's settings, as the service is, leave the files
+	// in the user's hands
+	if err := adoptDataOwner(filepath.Dir(path)); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitConfig
+	}
+	logName := runLogFileName
+	if *service {
+		logName = serviceLogFileName
+	}
+	if err := setupLogging(os.Stdout, filepath.Dir(path), logName); err != nil {
+		slog.Warn("can't write the log file", "err", err)
+	}
+
+	app, err := newApp(path)
+	if err != nil {
+		slog.Error("can't start", "err", err)
+		return exitConfig
+	}
+	app.noBrowser = true
+
+	// Flags override the saved settings for this run only
+	if *target != "" || *relay != "" || *relayToken != "" || *metricsListen != "" {
+		settings := app.settings.Get()
+		if *target != "" {
+			settings.Tunnels = []TunnelSettings{{ID: "cli", Name: "Command line", Target: *target}}
+		}
+		if *relay != "" {
+			settings.Relay.Endpoints = splitList(*relay)
+		}
+		if *relayToken != "" {
+			settings.Relay.Token = *relayToken
+		}
+		if *metricsListen != "" {
+			settings.Metrics.Listen = *metricsListen
+		}
+		store, err := newMemorySettings(settings)
+		if err != nil {
+			slog.Error("invalid flags", "err", err)
+			return exitUsage
+		}
+		audit, dataDir := app.audit, app.dataDir
+		app = newAppWithSettings(store)
+		app.noBrowser = true
+		app.audit, app.dataDir = audit, dataDir
+	}
+	app.service = *service
+	if app.resumeUpdate() {
+		return app.restartAfterUpdate(*service)
+	}
+	go app.watchForUpdates()
+
+	ids := app.headlessTunnelIDs(splitList(*tunnelIDs))
+	if len(ids) == 0 {
+		slog.Error("unknown tunnel", "tunnel", *tunnelIDs)
+		return exitUsage
+	}
+
+	run := func(stop <-chan struct{}) int {
+		go app.startMetricsServer()
+		if *web {
+			autoConnected := make(chan bool, 1)
+			autoConnected <- false
+			go app.startWebServer(autoConnected)
+		}
+
+		for _, id := range ids {
+			t := app.tunnel(id)
+			link, err := t.Start()
+			if err != nil {
+				if !*retry {
+					t.logger().Error("tunnel failed", "err", err)
+					app.stopAllTunnels()
+					return exitTunnel
+				}
+				t.logger().Warn("tunnel failed, will keep trying", "err", err)
+				t.keepTrying()
+				continue
+			}
+			t.logger().Info("tunnel link", "link", link)
+		}
+
+		return app.waitForStop(stop, ids)
+	}
+
+	// The Windows service manager starts us with its own stop protocol
+	code, ok := runAsService(run)
+	if !ok {
+		code = run(nil)
+	}
+	if code == exitUpdated {
+		return app.restartAfterUpdate(*service)
+	}
+	return code
+}
+
+// headlessTunnelIDs picks the tunnels to start: the requested ones, else the
+// auto-connect ones, else the first saved tunnel.
+func (a *App) headlessTunnelIDs(requested []string) []string {
+	settings := a.settings.Get()
+
+	if len(requested) > 0 {
+		for _, id := range requested {
+			if _, ok := settings.tunnel(id); !ok {
+				return nil
+			}
+		}
+		return requested
+	}
+
+	var ids []string
+	for _, cfg := range settings.Tunnels {
+		if cfg.AutoConnect {
+			ids = append(ids, cfg.ID)
+		}
+	}
+	if len(ids) == 0 {
+		ids = append(ids, settings.Tunnels[0].ID)
+	}
+	return ids
+}
+
+// waitForStop blocks until SIGINT, SIGTERM or stop is closed, then stops
+// every tunnel. If watch is non-empty it also returns once all of those
+// tunnels gave up. After an update is installed it returns exitUpdated.
+func (a *App) waitForStop(stop <-chan struct{}, watch []string) int {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case s := <-sig:
+			slog.Info("shutting down", "signal", s.String())
+			a.stopAllTunnels()
+			return exitOK
+		case <-stop:
+			slog.Info("stop requested, shutting down")
+			a.stopAllTunnels()
+			return exitOK
+		case <-a.updates.installed:
+			slog.Info("restarting into the installed update")
+			a.stopAllTunnels()
+			return exitUpdated
+		case <-ticker.C:
+			if len(watch) > 0 && a.allGaveUp(watch) {
+				slog.Error("all tunnels gave up reconnecting, exiting")
+				return exitTunnel
+			}
+		}
+	}
+}
+
+// allGaveUp reports whether every listed tunnel is down with an error and no
+// longer retrying. A tunnel stopped from the dashboard has no error.
+func (a *App) allGaveUp(ids []string) bool {
+	for _, id := range ids {
+		t := a.tunnel(id)
+		if t == nil {
+			continue
+		}
+		status := t.Status()
+		if status.State != StateDisconnected || status.Error == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
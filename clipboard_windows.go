@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	user32   = windows.NewLazySystemDLL("user32.dll")
+	kernel32 = windows.NewLazySystemDLL("kernel32.dll")
+
+	procOpenClipboard    = user32.NewProc("OpenClipboard")
+	procCloseClipboard   = user32.NewProc("CloseClipboard")
+	procEmptyClipboard   = user32.NewProc("EmptyClipboard")
+	procSetClipboardData = user32.NewProc("SetClipboardData")
+	procGlobalAlloc      = kernel32.NewProc("GlobalAlloc")
+	procGlobalFree       = kernel32.NewProc("GlobalFree")
+	procGlobalLock       = kernel32.NewProc("GlobalLock")
+	procGlobalUnlock     = kernel32.NewProc("GlobalUnlock")
+	procLstrcpyW         = kernel32.NewProc("lstrcpyW")
+)
+
+const (
+	cfUnicodeText = 13
+	gmemMoveable  = 0x0002
+)
+
+// copyToClipboard puts text on the Windows clipboard.
+func copyToClipboard(text string) error {
+	utf16, err := windows.UTF16FromString(text)
+	if err != nil {
+		return err
+	}
+
+	// The clipboard belongs to the thread that opened it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// Another program may be holding the clipboard for a moment
+	opened := false
+	for attempt := 0; attempt < 10 && !opened; attempt++ {
+		if r, _, _ := procOpenClipboard.Call(0); r != 0 {
+			opened = true
+		} else {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if !opened {
+		return errors.New("the clipboard is in use by another program")
+	}
+	defer procCloseClipboard.Call()
+
+	if r, _, err := procEmptyClipboard.Call(); r == 0 {
+		return err
+	}
+	mem, _, err := procGlobalAlloc.Call(gmemMoveable, uintptr(len(utf16)*2))
+	if mem == 0 {
+		return err
+	}
+	p, _, err := procGlobalLock.Call(mem)
+	if p == 0 {
+		procGlobalFree.Call(mem)
+		return err
+	}
+	procLstrcpyW.Call(p, uintptr(unsafe.Pointer(&utf16[0])))
+	procGlobalUnlock.Call(mem)
+
+	// On success the clipboard owns the memory
+	if r, _, err := procSetClipboardData.Call(cfUnicodeText, mem); r == 0 {
+		procGlobalFree.Call(mem)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	deviceIDFileName  = "device-id"
+	deviceKeyFileName = "device-key.pem"
+)
+
+// loadDeviceID returns this installation's identity, creating it on first
+// use. It is kept apart from the settings so that editing or resetting them
+// doesn't change it.
+func loadDeviceID(dataDir string) (string, error) {
+	path := filepath.Join(dataDir, deviceIDFileName)
+	data, err := os.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	id := newID() + newID()
+	if err := os.WriteFile(path, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+	chownData(path)
+	return id, nil
+}
+
+// loadDeviceKey returns the device's ed25519 signing key, creating it on
+// first use.
+func loadDeviceKey(dataDir string) (ed25519.PrivateKey, error) {
+	key, err := readDeviceKey(dataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return createDeviceKey(filepath.Join(dataDir, deviceKeyFileName))
+	}
+	return key, err
+}
+
+// readDeviceKey reads the device key without creating one.
+func readDeviceKey(dataDir string) (ed25519.PrivateKey, error) {
+	return readPrivateKey(filepath.Join(dataDir, deviceKeyFileName))
+}
+
+// readPrivateKey reads an ed25519 key from a PKCS #8 PEM file.
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return key, nil
+}
+
+// createDeviceKey writes a new ed25519 key to path as PKCS #8 PEM.
+func createDeviceKey(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	chownData(path)
+	return key, nil
+}
+
+// encodePublicKey is how public keys are shown to users and accepted back.
+func encodePublicKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+func decodePublicKey(s string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("public key must be a base64-encoded ed25519 key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// keyFingerprint is a short identifier for comparing keys by eye.
+func keyFingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
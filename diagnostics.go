@@ -0,0 +1,572 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel"
+)
+
+// Diagnostic check results.
+const (
+	diagPass = "pass"
+	diagWarn = "warn"
+	diagFail = "fail"
+	diagSkip = "skip"
+)
+
+const (
+	diagTimeout = 10 * time.Second
+	diagPings   = 3
+	// diagCertExpiry warns about a relay certificate that expires soon.
+	diagCertExpiry = 14 * 24 * time.Hour
+	// diagLogBytes is how much of the newest log file goes into a bundle.
+	diagLogBytes = 1 << 20
+)
+
+// DiagnosticCheck is one step of the connectivity diagnostics. Title and Hint
+// are filled in the reader's language; Details and Error stay in English
+// for support.
+type DiagnosticCheck struct {
+	Name       string   `json:"name"`
+	Title      string   `json:"title"`
+	Subject    string   `json:"subject"`
+	Status     string   `json:"status"`
+	DurationMs int64    `json:"durationMs"`
+	Details    []string `json:"details,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	Hint       string   `json:"hint,omitempty"`
+
+	hint string
+}
+
+// DiagnosticsReport is the outcome of one diagnostics run.
+type DiagnosticsReport struct {
+	Time   time.Time         `json:"time"`
+	Build  BuildInfo         `json:"build"`
+	Passed bool              `json:"passed"`
+	Checks []DiagnosticCheck `json:"checks"`
+}
+
+// localized returns a copy with titles and remediation hints in lang.
+func (r DiagnosticsReport) localized(lang string) DiagnosticsReport {
+	r.Checks = append([]DiagnosticCheck(nil), r.Checks...)
+	for i := range r.Checks {
+		c := &r.Checks[i]
+		c.Title = translate(lang, "diag.check."+c.Name)
+		if c.hint != "" {
+			c.Hint = translate(lang, c.hint)
+		}
+	}
+	return r
+}
+
+// writeText prints the report the way the diagnose command shows it.
+func (r DiagnosticsReport) writeText(w io.Writer) {
+	icons := map[string]string{diagPass: "✅", diagWarn: "⚠️ ", diagFail: "❌", diagSkip: "➖"}
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "%s %s: %s", icons[c.Status], c.Subject, c.Title)
+		if c.Status != diagSkip {
+			fmt.Fprintf(w, " (%d ms)", c.DurationMs)
+		}
+		fmt.Fprintln(w)
+		for _, d := range c.Details {
+			fmt.Fprintf(w, "   %s\n", d)
+		}
+		if c.Error != "" {
+			fmt.Fprintf(w, "   Error: %s\n", c.Error)
+		}
+		if c.Hint != "" {
+			fmt.Fprintf(w, "   → %s\n", c.Hint)
+		}
+	}
+	if r.Passed {
+		fmt.Fprintln(w, "\n✅ All checks passed")
+	} else {
+		fmt.Fprintln(w, "\n❌ Some checks failed")
+	}
+}
+
+// diagnostics collects the checks of one run.
+type diagnostics struct {
+	logger *slog.Logger
+	checks []DiagnosticCheck
+}
+
+// check runs fn as the named step and records how it went. fn fills in the
+// details and, for a step that didn't pass, the locale key of a hint; an
+// error fails the step unless fn lowered it to a warning.
+func (d *diagnostics) check(name, subject string, fn func(c *DiagnosticCheck) error) bool {
+	c := DiagnosticCheck{Name: name, Subject: subject, Status: diagPass}
+	start := time.Now()
+	err := fn(&c)
+	c.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		c.Error = err.Error()
+		if c.Status == diagPass {
+			c.Status = diagFail
+		}
+	}
+	d.logger.Debug("diagnostic check", "check", name, "subject", subject, "status", c.Status, "err", c.Error)
+	d.checks = append(d.checks, c)
+	return c.Status != diagFail
+}
+
+// skip records the steps that can't run after an earlier one failed.
+func (d *diagnostics) skip(subject string, names ...string) {
+	for _, name := range names {
+		d.checks = append(d.checks, DiagnosticCheck{Name: name, Subject: subject, Status: diagSkip})
+	}
+}
+
+// runDiagnostics checks every relay endpoint step by step (DNS, TCP, TLS,
+// a dry-run REGISTER and a yamux ping) and then every tunnel target. It
+// never opens a public port.
+func runDiagnostics(s Settings) DiagnosticsReport {
+	d := &diagnostics{logger: slog.With("component", "diagnostics")}
+	d.logger.Debug("running diagnostics")
+
+	for _, endpoint := range s.Relay.Endpoints {
+		d.checkRelay(endpoint, s.Relay.Token)
+	}
+	for _, t := range s.Tunnels {
+		d.checkTarget(s.Policies, t)
+	}
+
+	report := DiagnosticsReport{Time: time.Now(), Build: build, Passed: true, Checks: d.checks}
+	for _, c := range d.checks {
+		if c.Status == diagFail {
+			report.Passed = false
+		}
+	}
+	d.logger.Debug("diagnostics finished", "passed", report.Passed)
+	return report
+}
+
+func (d *diagnostics) checkRelay(endpoint, token string) {
+	later := []string{"tcp", "tls", "register", "ping"}
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		d.check("dns", endpoint, func(c *DiagnosticCheck) error {
+			c.hint = "diag.hintEndpoint"
+			return fmt.Errorf("invalid relay endpoint: %w", err)
+		})
+		d.skip(endpoint, later...)
+		return
+	}
+
+	var addrs []string
+	ok := d.check("dns", endpoint, func(c *DiagnosticCheck) error {
+		if net.ParseIP(host) != nil {
+			addrs = []string{host}
+			c.Details = []string{"IP address, no lookup needed"}
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), diagTimeout)
+		defer cancel()
+		var err error
+		addrs, err = net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			c.hint = "diag.hintDNS"
+			return err
+		}
+		c.Details = []string{"Resolved to " + strings.Join(addrs, ", ")}
+		return nil
+	})
+	if !ok {
+		d.skip(endpoint, later...)
+		return
+	}
+
+	var raw net.Conn
+	later = later[1:]
+	ok = d.check("tcp", endpoint, func(c *DiagnosticCheck) error {
+		for _, name := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"} {
+			if os.Getenv(name) != "" {
+				c.Details = append(c.Details, name+" is set; Tatbeeb Link connects directly and doesn't use it")
+				break
+			}
+		}
+		var errs []error
+		for _, addr := range addrs {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, port), diagTimeout)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			raw = conn
+			c.Details = append(c.Details, "Connected to "+conn.RemoteAddr().String()+" from "+conn.LocalAddr().String())
+			return nil
+		}
+		c.hint = "diag.hintTCP"
+		return errors.Join(errs...)
+	})
+	if !ok {
+		d.skip(endpoint, later...)
+		return
+	}
+
+	conn := tls.Client(raw, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	defer conn.Close()
+	later = later[1:]
+	ok = d.check("tls", endpoint, func(c *DiagnosticCheck) error {
+		conn.SetDeadline(time.Now().Add(diagTimeout))
+		defer conn.SetDeadline(time.Time{})
+		if err := conn.Handshake(); err != nil {
+			c.hint = "diag.hintTLSHandshake"
+			return err
+		}
+		return verifyRelayCertificate(c, conn.ConnectionState(), host)
+	})
+	if !ok {
+		// Nothing is sent to a relay whose certificate doesn't check out
+		d.skip(endpoint, later...)
+		return
+	}
+
+	later = later[1:]
+	ok = d.check("register", endpoint, func(c *DiagnosticCheck) error {
+		ctx, cancel := context.WithTimeout(context.Background(), diagTimeout)
+		defer cancel()
+		assigned, err := tunnel.Register(ctx, conn, tunnel.Registration{Version: build.Version, Platform: build.Platform, Token: token, DryRun: true})
+		var updateErr *tunnel.UpdateRequiredError
+		switch {
+		case errors.As(err, &updateErr):
+			c.hint = "diag.hintUpdate"
+			return err
+		case errors.Is(err, tunnel.ErrUnauthorized):
+			c.hint = "diag.hintToken"
+			return err
+		case errors.Is(err, tunnel.ErrRefused):
+			c.hint = "diag.hintRefused"
+			return err
+		case err != nil:
+			c.hint = "diag.hintProtocol"
+			return err
+		}
+		c.Details = []string{"The relay accepted the registration and would assign port " + assigned}
+		return nil
+	})
+	if !ok {
+		d.skip(endpoint, later...)
+		return
+	}
+
+	d.check("ping", endpoint, func(c *DiagnosticCheck) error {
+		session, err := tunnel.NewSession(conn, d.logger)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+
+		var total, best time.Duration
+		for i := 0; i < diagPings; i++ {
+			rtt, err := session.Ping()
+			if err != nil {
+				c.Status = diagWarn
+				c.hint = "diag.hintPing"
+				return err
+			}
+			total += rtt
+			if best == 0 || rtt < best {
+				best = rtt
+			}
+		}
+		avg := total / diagPings
+		c.Details = []string{fmt.Sprintf("Round trip %s average, %s best of %d", avg.Round(time.Microsecond), best.Round(time.Microsecond), diagPings)}
+		if avg > time.Second {
+			c.Status = diagWarn
+			c.hint = "diag.hintSlow"
+		}
+		return nil
+	})
+}
+
+// verifyRelayCertificate checks the chain the relay sent the way tls.Dial
+// would, and records it so a TLS-inspecting firewall or antivirus shows up
+// as the issuer.
+func verifyRelayCertificate(c *DiagnosticCheck, state tls.ConnectionState, host string) error {
+	c.Details = append(c.Details, fmt.Sprintf("%s, %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)))
+	for i, cert := range state.PeerCertificates {
+		line := fmt.Sprintf("[%d] %s, issued by %s, valid %s to %s", i, cert.Subject, cert.Issuer,
+			cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02"))
+		if len(cert.DNSNames) > 0 {
+			line += ", names " + strings.Join(cert.DNSNames, " ")
+		}
+		c.Details = append(c.Details, line)
+	}
+	if len(state.PeerCertificates) == 0 {
+		c.hint = "diag.hintTLSHandshake"
+		return fmt.Errorf("the relay sent no certificate")
+	}
+
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	if err != nil {
+		var unknown x509.UnknownAuthorityError
+		var invalid x509.CertificateInvalidError
+		switch {
+		case errors.As(err, &unknown):
+			c.hint = "diag.hintTLSIntercepted"
+		case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+			c.hint = "diag.hintTLSClock"
+		default:
+			c.hint = "diag.hintTLSVerify"
+		}
+		return err
+	}
+	if time.Until(leaf.NotAfter) < diagCertExpiry {
+		c.Status = diagWarn
+		c.hint = "diag.hintCertExpiring"
+	}
+	return nil
+}
+
+// checkTarget probes a tunnel's target the way a stream would reach it.
+func (d *diagnostics) checkTarget(policies PolicySettings, t TunnelSettings) {
+	subject := fmt.Sprintf("%s (%s)", t.Name, t.Target)
+	d.check("target", subject, func(c *DiagnosticCheck) error {
+		if err := policies.checkTarget(t.Target); err != nil {
+			c.hint = "diag.hintPolicy"
+			return err
+		}
+		addr, err := resolveTarget(t.Target)
+		if err != nil {
+			c.hint = "diag.hintInstance"
+			return err
+		}
+		if addr != t.Target {
+			c.Details = append(c.Details, "Resolved to "+addr)
+		}
+		conn, err := net.DialTimeout("tcp", addr, diagTimeout)
+		if err != nil {
+			c.hint = "diag.hintTarget"
+			return err
+		}
+		conn.Close()
+		c.Details = append(c.Details, "Accepted a connection")
+		return nil
+	})
+}
+
+// redactedSettings hides the PIN and token hashes before settings go into a
+// support bundle.
+func redactedSettings(s Settings) Settings {
+	s = s.clone()
+	if s.Security.PINHash != "" {
+		s.Security.PINHash = "[redacted]"
+	}
+	if s.Relay.Token != "" {
+		s.Relay.Token = "[redacted]"
+	}
+	for i := range s.API.Tokens {
+		s.API.Tokens[i].Hash = "[redacted]"
+	}
+	return s
+}
+
+// writeDiagnosticsBundle writes a zip for support with the report, the
+// redacted settings and the newest part of the log file from logDir, or
+// the in-memory log when there is no file.
+func writeDiagnosticsBundle(w io.Writer, report DiagnosticsReport, s Settings, logDir string) error {
+	report = report.localized(defaultLanguage)
+	z := zip.NewWriter(w)
+
+	add := func(name string, write func(io.Writer) error) error {
+		f, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: report.Time})
+		if err != nil {
+			return err
+		}
+		return write(f)
+	}
+	addJSON := func(name string, v interface{}) error {
+		return add(name, func(f io.Writer) error {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			return enc.Encode(v)
+		})
+	}
+
+	if err := addJSON("report.json", report); err != nil {
+		return err
+	}
+	if err := add("report.txt", func(f io.Writer) error {
+		fmt.Fprintf(f, "Tatbeeb Link %s\n%s\n\n", build, report.Time.Format(time.RFC3339))
+		report.writeText(f)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := addJSON("settings.json", redactedSettings(s)); err != nil {
+		return err
+	}
+
+	// The desktop app, the service and headless runs each keep a file
+	found := false
+	for _, name := range logFileNames {
+		data, err := readLogTail(filepath.Join(logDir, name), diagLogBytes)
+		if err != nil {
+			continue
+		}
+		found = true
+		if err := add("logs/"+name, func(f io.Writer) error {
+			_, err := f.Write(data)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	if !found {
+		entries, _ := logRing.query(LogFilter{})
+		if err := add("logs/recent.jsonl", func(f io.Writer) error {
+			enc := json.NewEncoder(f)
+			for _, e := range entries {
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// readLogTail returns up to max bytes from the end of a log file, starting
+// at a whole line.
+func readLogTail(path string, max int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - max
+	if offset < 0 {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if offset > 0 {
+		if i := strings.IndexByte(string(data), '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	return data, nil
+}
+
+// handleDiagnostics runs the diagnostics and keeps the report for the
+// support bundle.
+func (a *App) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+	report := runDiagnostics(a.settings.Get())
+	a.diagnostics.Store(report)
+	slog.Info("diagnostics run", "passed", report.Passed)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"report":  report.localized(a.language(r)),
+	})
+}
+
+// handleDiagnosticsBundle downloads the support bundle for the last
+// diagnostics run, running them first if there was none.
+func (a *App) handleDiagnosticsBundle(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+
+	settings := a.settings.Get()
+	report, ok := a.diagnostics.Load().(DiagnosticsReport)
+	if !ok {
+		report = runDiagnostics(settings)
+		a.diagnostics.Store(report)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="tatbeeb-link-diagnostics-%s.zip"`, report.Time.Format("20060102-150405")))
+	if err := writeDiagnosticsBundle(w, report, settings, filepath.Join(a.dataDir, logDirName)); err != nil {
+		slog.Warn("support bundle failed", "err", err)
+	}
+}
+
+const diagnoseUsageText = `Usage: tatbeeb-link diagnose [flags]
+
+Checks the way to each relay step by step (DNS, TCP, TLS, a dry-run
+registration and a ping) and that each tunnel's database answers, and
+suggests a fix for anything that fails. No public port is opened.
+`
+
+func runDiagnoseCommand(args []string) int {
+	fs := flag.NewFlagSet("diagnose", flag.ContinueOnError)
+	configPath := fs.String("config", "", "settings file (default: the user config directory)")
+	bundle := fs.String("bundle", "", "also write a support bundle (zip) to this file")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, diagnoseUsageText+"\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	path, err := settingsPath(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitConfig
+	}
+	store, err := loadSettings(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitConfig
+	}
+	settings := store.Get()
+
+	report := runDiagnostics(settings)
+	report.localized(defaultLanguage).writeText(os.Stdout)
+
+	if *bundle != "" {
+		f, err := os.Create(*bundle)
+		if err == nil {
+			err = writeDiagnosticsBundle(f, report, settings, filepath.Join(filepath.Dir(path), logDirName))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Support bundle: %v\n", err)
+			return exitError
+		}
+		fmt.Printf("   Support bundle written to %s\n", *bundle)
+	}
+
+	if !report.Passed {
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDiagnosticsBundleIncludesEveryLog(t *testing.T) {
+	logDir := t.TempDir()
+	for _, name := range []string{logFileName, serviceLogFileName} {
+		if err := os.WriteFile(filepath.Join(logDir, name), []byte(`{"msg":"`+name+`"}`+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeDiagnosticsBundle(&buf, DiagnosticsReport{}, defaultSettings(), logDir); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range z.File {
+		names = append(names, f.Name)
+	}
+	for _, want := range []string{"logs/" + logFileName, "logs/" + serviceLogFileName} {
+		if !slices.Contains(names, want) {
+			t.Errorf("bundle has %v, want %s", names, want)
+		}
+	}
+	if slices.Contains(names, "logs/recent.jsonl") {
+		t.Error("the bundle fell back to recent entries although log files exist")
+	}
+}
+
+func TestRedactedSettings(t *testing.T) {
+	s := defaultSettings()
+	s.Relay.Token = "relay-secret"
+	s.Security.PINHash = "pin-hash"
+	s.API.Tokens = []APIToken{{ID: "a", Name: "monitoring", Hash: "token-hash", Scopes: []string{ScopeStatus}}}
+
+	redacted := redactedSettings(s)
+	if redacted.Relay.Token != "[redacted]" || redacted.Security.PINHash != "[redacted]" || redacted.API.Tokens[0].Hash != "[redacted]" {
+		t.Errorf("redacted settings = %+v, want every secret replaced", redacted)
+	}
+	if s.Relay.Token != "relay-secret" || s.API.Tokens[0].Hash != "token-hash" {
+		t.Error("redacting changed the settings it was given")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// localeFiles hold one catalog per language, named by its code, e.g.
+// locales/ar.json. Every string the dashboard, tray or API shows comes from
+// them. Files in the locales directory next to settings.json add languages
+// or override strings without a rebuild.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+const (
+	localeDirName   = "locales"
+	defaultLanguage = "en"
+)
+
+// Locale is one language's catalog. Strings missing from it fall back to
+// English.
+type Locale struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	// Dir is the text direction, ltr or rtl.
+	Dir      string            `json:"dir"`
+	Messages map[string]string `json:"messages,omitempty"`
+}
+
+// catalog maps language codes to their locale. It is filled from the
+// embedded files at startup and extended by loadLocaleDir.
+var catalog = loadEmbeddedLocales()
+
+func loadEmbeddedLocales() map[string]*Locale {
+	locales := make(map[string]*Locale)
+	files, _ := fs.Glob(localeFiles, "locales/*.json")
+	for _, name := range files {
+		data, err := localeFiles.ReadFile(name)
+		if err == nil {
+			err = addLocale(locales, strings.TrimSuffix(path.Base(name), ".json"), data)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("built-in locale %s: %v", name, err))
+		}
+	}
+	return locales
+}
+
+// loadLocaleDir adds the *.json locales in dir. A missing directory is fine.
+func loadLocaleDir(dir string) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, name := range files {
+		code := strings.TrimSuffix(filepath.Base(name), ".json")
+		data, err := os.ReadFile(name)
+		if err == nil {
+			err = addLocale(catalog, code, data)
+		}
+		if err != nil {
+			slog.Warn("skipping locale file", "path", name, "err", err)
+			continue
+		}
+		slog.Info("loaded locale file", "language", code, "path", name)
+	}
+}
+
+// addLocale merges a locale file into locales; its strings replace those
+// already there.
+func addLocale(locales map[string]*Locale, code string, data []byte) error {
+	code = strings.ToLower(code)
+	if !validLanguageCode(code) {
+		return fmt.Errorf("invalid language code %q, name the file e.g. fr.json or pt-br.json", code)
+	}
+	var next Locale
+	if err := json.Unmarshal(data, &next); err != nil {
+		return err
+	}
+	if next.Dir != "" && next.Dir != "ltr" && next.Dir != "rtl" {
+		return errors.New(`dir must be "ltr" or "rtl"`)
+	}
+
+	l, ok := locales[code]
+	if !ok {
+		l = &Locale{Code: code, Name: code, Dir: "ltr", Messages: make(map[string]string)}
+		locales[code] = l
+	}
+	if next.Name != "" {
+		l.Name = next.Name
+	}
+	if next.Dir != "" {
+		l.Dir = next.Dir
+	}
+	for key, text := range next.Messages {
+		l.Messages[key] = text
+	}
+	return nil
+}
+
+func validLanguageCode(code string) bool {
+	if code == "" || code[0] == '-' {
+		return false
+	}
+	for _, c := range code {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// languages lists the available locales without their strings, English
+// first.
+func languages() []Locale {
+	list := make([]Locale, 0, len(catalog))
+	for _, l := range catalog {
+		list = append(list, Locale{Code: l.Code, Name: l.Name, Dir: l.Dir})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if (list[i].Code == defaultLanguage) != (list[j].Code == defaultLanguage) {
+			return list[i].Code == defaultLanguage
+		}
+		return list[i].Code < list[j].Code
+	})
+	return list
+}
+
+func isLanguage(code string) bool {
+	_, ok := catalog[code]
+	return ok
+}
+
+// translate returns the text of key in lang, formatted with args. It falls
+// back to English, then to the key itself.
+func translate(lang, key string, args ...interface{}) string {
+	text, ok := "", false
+	if l := catalog[lang]; l != nil {
+		text, ok = l.Messages[key]
+	}
+	if !ok {
+		if l := catalog[defaultLanguage]; l != nil {
+			text, ok = l.Messages[key]
+		}
+	}
+	if !ok {
+		text = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// matchLanguage returns the first available language among tags such as
+// "ar-SA", "fr_FR.UTF-8" or "en", or "" if none is available.
+func matchLanguage(tags ...string) string {
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if i := strings.IndexAny(tag, ".@"); i >= 0 {
+			tag = tag[:i]
+		}
+		tag = strings.ReplaceAll(tag, "_", "-")
+		if isLanguage(tag) {
+			return tag
+		}
+		if base, _, ok := strings.Cut(tag, "-"); ok && isLanguage(base) {
+			return base
+		}
+	}
+	return ""
+}
+
+// detectLanguage picks the language for new settings from the OS locale.
+func detectLanguage() string {
+	if lang := matchLanguage(osLanguages()...); lang != "" {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// parseAcceptLanguage returns the languages of an Accept-Language header,
+// most preferred first.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
+
+// language returns the language to answer r in: the Accept-Language header
+// if it names an available one, or else the dashboard's language.
+func (a *App) language(r *http.Request) string {
+	if lang := matchLanguage(parseAcceptLanguage(r.Header.Get("Accept-Language"))...); lang != "" {
+		return lang
+	}
+	return a.settings.Get().Language
+}
+
+// tr translates key for the client that sent r.
+func (a *App) tr(r *http.Request, key string, args ...interface{}) string {
+	return translate(a.language(r), key, args...)
+}
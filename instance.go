@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// instanceLockName is held locked by the running desktop app. The lock
+	// goes away with the process, so a crash never leaves it stale.
+	instanceLockName = "instance.lock"
+	// instanceInfoName tells a second launch how to reach the first. It is
+	// separate from the lock file, which Windows won't let others read.
+	instanceInfoName = "instance.json"
+	// serviceInfoName tells the desktop app which port the system
+	// service's dashboard ended up on.
+	serviceInfoName = "service.json"
+
+	instanceDialTimeout = 2 * time.Second
+)
+
+var errAlreadyRunning = errors.New("Tatbeeb Link is already running")
+
+// instanceInfo is the content of instanceInfoName.
+type instanceInfo struct {
+	PID int `json:"pid"`
+	// Control is the loopback address the running app accepts requests on.
+	Control string `json:"control"`
+	// Key must accompany requests, so only users who can read the data
+	// directory can send them.
+	Key string `json:"key,omitempty"`
+	// Web is the port the dashboard is served on.
+	Web string `json:"web,omitempty"`
+}
+
+// instance is the lock that keeps the desktop app to one copy per data
+// directory, and the control socket later launches talk to it through.
+type instance struct {
+	dir      string
+	lock     *os.File
+	listener net.Listener
+	key      string
+
+	mu     sync.Mutex
+	onOpen func()
+	closed bool
+}
+
+// acquireInstance takes the single-instance lock for dataDir. It returns
+// errAlreadyRunning when another copy holds it.
+func acquireInstance(dataDir string) (*instance, error) {
+	f, err := os.OpenFile(filepath.Join(dataDir, instanceLockName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, err
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	i := &instance{dir: dataDir, lock: f, listener: ln, key: hex.EncodeToString(b)}
+
+	data, _ := json.Marshal(instanceInfo{PID: os.Getpid(), Control: ln.Addr().String(), Key: i.key})
+	if err := os.WriteFile(filepath.Join(dataDir, instanceInfoName), data, 0600); err != nil {
+		i.Close()
+		return nil, err
+	}
+
+	go i.serve()
+	return i, nil
+}
+
+// OnOpen sets what happens when another launch asks for the dashboard.
+func (i *instance) OnOpen(fn func()) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onOpen = fn
+}
+
+// Close releases the lock. A nil or closed instance does nothing, so the
+// lock can be handed over before a restart.
+func (i *instance) Close() {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return
+	}
+	i.closed = true
+	i.listener.Close()
+	os.Remove(filepath.Join(i.dir, instanceInfoName))
+	unlockFile(i.lock)
+	i.lock.Close()
+}
+
+func (i *instance) serve() {
+	for {
+		conn, err := i.listener.Accept()
+		if err != nil {
+			return
+		}
+		go i.handle(conn)
+	}
+}
+
+// handle answers one "OPEN <key>" request.
+func (i *instance) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(instanceDialTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	cmd, key, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if cmd != "OPEN" || subtle.ConstantTimeCompare([]byte(key), []byte(i.key)) != 1 {
+		fmt.Fprintln(conn, "ERR")
+		return
+	}
+
+	slog.Info("Tatbeeb Link was launched again, opening the dashboard")
+	i.mu.Lock()
+	fn := i.onOpen
+	i.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+	fmt.Fprintln(conn, "OK")
+}
+
+// signalRunningInstance asks the copy holding dataDir's lock to open its
+// dashboard.
+func signalRunningInstance(dataDir string) error {
+	// The running copy may have just taken the lock and not yet written
+	// its address
+	var info instanceInfo
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		var data []byte
+		if data, err = os.ReadFile(filepath.Join(dataDir, instanceInfoName)); err == nil {
+			if err = json.Unmarshal(data, &info); err == nil {
+				break
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", info.Control, instanceDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(instanceDialTimeout))
+
+	fmt.Fprintf(conn, "OPEN %s\n", info.Key)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "OK" {
+		return fmt.Errorf("the running copy (pid %d) refused the request", info.PID)
+	}
+	return nil
+}
+
+// writeServiceInfo records the system service's dashboard port in dataDir.
+func writeServiceInfo(dataDir, port string) error {
+	path := filepath.Join(dataDir, serviceInfoName)
+	data, _ := json.Marshal(instanceInfo{PID: os.Getpid(), Web: port})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	chownData(path)
+	return nil
+}
+
+// readServiceInfo returns what the system service last recorded, if the
+// file is there.
+func readServiceInfo(dataDir string) (instanceInfo, bool) {
+	var info instanceInfo
+	data, err := os.ReadFile(filepath.Join(dataDir, serviceInfoName))
+	if err != nil || json.Unmarshal(data, &info) != nil || info.Web == "" {
+		return info, false
+	}
+	return info, true
+}
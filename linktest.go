@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel"
+)
+
+// LinkTestResult is a tunnel.LinkTestResult with a hint for the stage that
+// failed, in the dashboard's language.
+type LinkTestResult struct {
+	tunnel.LinkTestResult
+	Hint string `json:"hint,omitempty"`
+}
+
+// handleTestLink runs a link test on a connected tunnel. It holds up other
+// connections briefly and sends a megabyte through the relay, so it is
+// locked like connecting.
+func (a *App) handleTestLink(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+	var req struct {
+		TunnelID string `json:"tunnelId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
+		return
+	}
+	if req.TunnelID == "" {
+		req.TunnelID = a.defaultTunnelID()
+	}
+	t := a.tunnel(req.TunnelID)
+	if t == nil {
+		writeError(w, http.StatusNotFound, a.tr(r, "api.unknownTunnel", req.TunnelID))
+		return
+	}
+
+	test, err := t.client.TestLink(r.Context())
+	if errors.Is(err, tunnel.ErrLinkTestRunning) {
+		writeError(w, http.StatusConflict, a.tr(r, "api.linkTestRunning"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, a.tr(r, "api.linkTestFailed", err))
+		return
+	}
+	result := LinkTestResult{LinkTestResult: test}
+	if result.Stage != "" {
+		result.Hint = a.tr(r, "linkTest.hint."+result.Stage)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"result":  result,
+	})
+}
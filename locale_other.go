@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// osLanguages returns the locale from the environment, e.g. "ar_SA.UTF-8",
+// in the order the C library consults it. LANGUAGE may list several,
+// separated by colons.
+func osLanguages() []string {
+	var langs []string
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(name); value != "" && value != "C" && value != "POSIX" {
+			langs = append(langs, value)
+			break
+		}
+	}
+	return append(langs, strings.Split(os.Getenv("LANGUAGE"), ":")...)
+}
@@ -0,0 +1,12 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// osLanguages returns the user's display languages, e.g. "ar-SA".
+func osLanguages() []string {
+	langs, err := windows.GetUserPreferredUILanguages(windows.MUI_LANGUAGE_NAME)
+	if err != nil {
+		return nil
+	}
+	return langs
+}
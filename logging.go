@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logDirName  = "logs"
+	logFileName = "tatbeeb-link.log"
+	// serviceLogFileName and runLogFileName keep the system service and
+	// headless runs out of the desktop app's file, since processes rotating
+	// the same file would rename it from under each other.
+	serviceLogFileName = "tatbeeb-link-service.log"
+	runLogFileName     = "tatbeeb-link-run.log"
+	logMaxFileSize     = 5 << 20
+	// logKeepFiles is how many rotated files are kept next to the current one.
+	logKeepFiles = 5
+	// logRingSize is how many recent entries the dashboard can page through.
+	logRingSize = 2000
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// logFileNames are the current log files of every kind of process.
+var logFileNames = []string{logFileName, serviceLogFileName, runLogFileName}
+
+var (
+	// logLevel is shared by every log destination and changed at runtime
+	// from the settings.
+	logLevel = new(slog.LevelVar)
+	logFile  *rotatingFile
+	logRing  = newLogBuffer(logRingSize)
+)
+
+// setupLogging opens the rotating log file name in dir. Logging works
+// without it, to the console and the dashboard only, if the file can't be
+// opened.
+func setupLogging(console io.Writer, dir, name string) error {
+	var err error
+	if dir != "" {
+		logFile, err = openRotatingFile(filepath.Join(dir, logDirName, name), logMaxFileSize, logKeepFiles)
+	}
+	setLogConsole(console)
+	return err
+}
+
+// setLogConsole sends console output to w, e.g. stdout once the app knows it
+// runs headless.
+func setLogConsole(w io.Writer) {
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	handlers := []slog.Handler{
+		slog.NewTextHandler(w, opts),
+		&ringHandler{buf: logRing},
+	}
+	if logFile != nil {
+		handlers = append(handlers, slog.NewJSONHandler(logFile, opts))
+	}
+
+	// This also routes the standard logger, used by libraries, through slog
+	slog.SetDefault(slog.New(teeHandler(handlers)))
+}
+
+// parseLogLevel accepts the names in logLevels.
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+func setLogLevel(name string) {
+	level, err := parseLogLevel(name)
+	if err != nil {
+		return
+	}
+	if logLevel.Level() != level {
+		logLevel.Set(level)
+		slog.Info("log level changed", "level", strings.ToLower(level.String()))
+	}
+}
+
+// teeHandler passes every record to all of its handlers.
+type teeHandler []slog.Handler
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, handler := range h {
+		if !handler.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := make(teeHandler, len(h))
+	for i, handler := range h {
+		next[i] = handler.WithAttrs(attrs)
+	}
+	return next
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	next := make(teeHandler, len(h))
+	for i, handler := range h {
+		next[i] = handler.WithGroup(name)
+	}
+	return next
+}
+
+// LogEntry is one log record as the dashboard sees it.
+type LogEntry struct {
+	Seq     int64                  `json:"seq"`
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"msg"`
+	Attrs   map[string]interface{} `json:"attrs,omitempty"`
+}
+
+// logBuffer keeps the most recent entries in memory for /api/logs.
+type logBuffer struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+	seq     int64
+}
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{entries: make([]LogEntry, 0, size)}
+}
+
+func (b *logBuffer) add(e LogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+	if len(b.entries) < cap(b.entries) {
+		b.entries = append(b.entries, e)
+		return
+	}
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % len(b.entries)
+}
+
+// LogFilter selects entries from the buffer. Zero values match everything.
+type LogFilter struct {
+	// Since skips entries up to and including this sequence number, so a
+	// poller only gets what's new.
+	Since    int64
+	MinLevel slog.Level
+	Tunnel   string
+	// Text matches the message or any field value, ignoring case.
+	Text  string
+	Limit int
+}
+
+func (f LogFilter) match(e LogEntry) bool {
+	if e.Seq <= f.Since {
+		return false
+	}
+	if level, err := parseLogLevel(e.Level); err == nil && level < f.MinLevel {
+		return false
+	}
+	if f.Tunnel != "" && fmt.Sprint(e.Attrs["tunnel"]) != f.Tunnel {
+		return false
+	}
+	if f.Text == "" {
+		return true
+	}
+	text := strings.ToLower(f.Text)
+	if strings.Contains(strings.ToLower(e.Message), text) {
+		return true
+	}
+	for _, v := range e.Attrs {
+		if strings.Contains(strings.ToLower(fmt.Sprint(v)), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// query returns the matching entries, oldest first, and the latest sequence
+// number to poll from next. With a limit the newest entries are kept.
+func (b *logBuffer) query(f LogFilter) ([]LogEntry, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := []LogEntry{}
+	for i := range b.entries {
+		e := b.entries[(b.next+i)%len(b.entries)]
+		if f.match(e) {
+			result = append(result, e)
+		}
+	}
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[len(result)-f.Limit:]
+	}
+	return result, b.seq
+}
+
+// ringHandler records entries into a logBuffer. Groups are flattened into
+// dotted field names.
+type ringHandler struct {
+	buf    *logBuffer
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *ringHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *ringHandler) Handle(_ context.Context, r slog.Record) error {
+	e := LogEntry{
+		Time:    r.Time,
+		Level:   strings.ToLower(r.Level.String()),
+		Message: r.Message,
+		Attrs:   make(map[string]interface{}),
+	}
+	for _, a := range h.attrs {
+		addLogAttr(e.Attrs, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addLogAttr(e.Attrs, h.prefix, a)
+		return true
+	})
+	h.buf.add(e)
+	return nil
+}
+
+func (h *ringHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		next.attrs = append(next.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &next
+}
+
+func (h *ringHandler) WithGroup(name string) slog.Handler {
+	next := *h
+	next.prefix = h.prefix + name + "."
+	return &next
+}
+
+func addLogAttr(attrs map[string]interface{}, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		// A group without a key is inlined
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			addLogAttr(attrs, prefix, ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	if v.Kind() == slog.KindDuration {
+		attrs[prefix+a.Key] = v.Duration().String()
+		return
+	}
+	if err, ok := v.Any().(error); ok {
+		attrs[prefix+a.Key] = err.Error()
+		return
+	}
+	attrs[prefix+a.Key] = v.Any()
+}
+
+// rotatingFile is an append-only log file that is renamed to .1, .2, ...
+// once it reaches maxSize, keeping the newest keep files.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	chownData(filepath.Dir(path))
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	chownData(r.path)
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.open()
+}
+
+// Dir is where the current and rotated log files live.
+func (r *rotatingFile) Dir() string {
+	return filepath.Dir(r.path)
+}
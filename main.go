@@ -1,905 +1,590 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/getlantern/systray"
-	"github.com/hashicorp/yamux"
 )
 
 //go:embed Tatbeeblink-logo.png
 var iconData []byte
 
 const (
-	Version     = "1.0.0"
 	RelayServer = "link.tatbeeb.sa:8443"
 	WebPort     = "8765"
 )
 
 type App struct {
-	connected     bool
-	localPort     string
-	shareablePort string
-	shareableLink string
-	relayConn     net.Conn
-	yamuxSession  *yamux.Session
+	settings      *SettingsStore
+	tunnels       map[string]*Tunnel
 	statusChannel chan StatusUpdate
-	tunnelActive  bool
 	tunnelMutex   sync.RWMutex
-
-	// Tray menu items
-	mStatus *systray.MenuItem
-	mOpen   *systray.MenuItem
-	mQuit   *systray.MenuItem
+	// paused lists the tunnels "Pause" in the tray stopped
+	paused []string
+
+	// noBrowser keeps the dashboard from opening at startup (--no-browser)
+	noBrowser bool
+	// service is set when running as the installed system service
+	service bool
+	// viewerURL is the dashboard of a running service this tray app attached
+	// to instead of starting its own tunnels
+	viewerURL string
+	// dataDir holds the settings file and everything kept next to it
+	dataDir string
+	// audit records every stream; nil when the data directory isn't usable
+	audit *auditLog
+	// notifications shows tunnel events on the desktop; nil when running
+	// as a service or headless
+	notifications *notifications
+	// csrfToken is embedded in the dashboard and required on every POST
+	csrfToken string
+	// lock holds the sessions unlocked with the admin PIN
+	lock pinLock
+	// tokenUse remembers when API tokens were last used
+	tokenUse tokenUsage
+	// updates tracks the update feed and signals the restart after an
+	// install
+	updates *updater
+	// webPort is the port the dashboard ended up on, which differs from
+	// WebPort when that was taken
+	webPort atomic.Value
+	// webListener is the dashboard's listener, closed before a restart
+	webListener atomic.Value
+	// metricsListener is the metrics address's listener, if one is set
+	metricsListener atomic.Value
+	// diagnostics holds the last DiagnosticsReport for the support bundle
+	diagnostics atomic.Value
+	// relayTLS is the base TLS configuration for relay connections; nil
+	// trusts the system roots
+	relayTLS *tls.Config
 }
 
 type StatusUpdate struct {
-	Connected     bool   `json:"connected"`
-	Status        string `json:"status"`
-	ShareableLink string `json:"shareableLink"`
-	LocalPort     string `json:"localPort"`
-	Error         string `json:"error"`
+	TunnelID      string         `json:"tunnelId"`
+	State         string         `json:"state"`
+	Connected     bool           `json:"connected"`
+	Status        string         `json:"status"`
+	ShareableLink string         `json:"shareableLink"`
+	Target        string         `json:"target"`
+	Error         string         `json:"error"`
+	Tunnels       []TunnelStatus `json:"tunnels"`
+	Service       bool           `json:"service"`
 }
 
 type ConnectRequest struct {
+	TunnelID  string `json:"tunnelId"`
 	LocalPort string `json:"localPort"`
+	Target    string `json:"target"`
 }
 
-func main() {
-	systray.Run(onReady, onExit)
+type DisconnectRequest struct {
+	TunnelID string `json:"tunnelId"`
 }
 
-func onReady() {
-	systray.SetIcon(getIcon())
-	systray.SetTitle("Tatbeeb Link")
-	systray.SetTooltip("Tatbeeb Link - Secure Port Tunneling")
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
 
-	app := &App{
-		statusChannel: make(chan StatusUpdate, 10),
-		localPort:     "9999", // Default port
+// newApp loads the settings from configPath, or from the user's config
+// directory when it is empty.
+func newApp(configPath string) (*App, error) {
+	configPath, err := settingsPath(configPath)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := loadSettings(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load settings: %w", err)
 	}
 
-	// Create menu items
-	app.mStatus = systray.AddMenuItem("Status: Disconnected", "Connection status")
-	app.mStatus.Disable()
-
-	systray.AddSeparator()
-
-	app.mOpen = systray.AddMenuItem("Open Dashboard", "Open web interface")
+	app := newAppWithSettings(settings)
+	app.dataDir = filepath.Dir(configPath)
+	app.audit, err = openAuditLog(filepath.Dir(configPath), settings)
+	if err != nil {
+		slog.Error("audit log unavailable, connections will not be recorded", "err", err)
+	}
+	return app, nil
+}
 
-	systray.AddSeparator()
+func newAppWithSettings(settings *SettingsStore) *App {
+	setLogLevel(settings.Get().Logging.Level)
+	return &App{
+		settings:      settings,
+		tunnels:       make(map[string]*Tunnel),
+		statusChannel: make(chan StatusUpdate, 10),
+		csrfToken:     newCSRFToken(),
+		updates:       newUpdater(),
+	}
+}
 
-	app.mQuit = systray.AddMenuItem("Exit", "Quit Tatbeeb Link")
+// startBackground auto-connects saved tunnels and starts the dashboard.
+func (a *App) startBackground() {
+	// Bring up saved tunnels right away so a rebooted PC relinks without
+	// anyone opening the dashboard
+	autoConnected := make(chan bool, 1)
+	go func() {
+		autoConnected <- a.autoConnect()
+	}()
 
 	// Start HTTP server in background
-	go app.startWebServer()
+	go a.startWebServer(autoConnected)
+	go a.startMetricsServer()
+}
 
-	// Handle menu clicks
-	go func() {
-		for {
-			select {
-			case <-app.mOpen.ClickedCh:
-				openBrowser("http://localhost:" + WebPort)
-			case <-app.mQuit.ClickedCh:
-				systray.Quit()
+// startWebServer serves the dashboard. autoConnected delivers the outcome of
+// auto-connect, which decides whether the browser is opened.
+func (a *App) startWebServer(autoConnected <-chan bool) {
+	get, post := http.MethodGet, http.MethodPost
+	a.route("/", a.handleIndex, access{get: ""})
+	a.route("/static/", a.handleStatic, access{get: ""})
+	a.route("/favicon.ico", a.handleStatic, access{get: ""})
+	a.route("/api/status", a.handleStatus, access{get: ScopeStatus})
+	a.route("/api/connect", a.handleConnect, access{post: ScopeTunnels})
+	a.route("/api/disconnect", a.handleDisconnect, access{post: ScopeTunnels})
+	a.route("/api/test-link", a.handleTestLink, access{post: ScopeTunnels})
+	a.route("/api/instances", a.handleInstances, access{post: ScopeTunnels})
+	a.route("/api/settings", a.handleSettings, access{get: ScopeSettings, post: ScopeSettings})
+	a.route("/api/logs", a.handleLogs, access{get: ScopeStatus, post: ScopeSettings})
+	a.route("/api/audit", a.handleAudit, access{get: ScopeSettings})
+	a.route("/api/version", a.handleVersion, access{get: ScopeStatus})
+	a.route("/api/update", a.handleUpdate, access{get: ScopeStatus, post: ScopeSettings})
+	a.route("/api/diagnostics", a.handleDiagnostics, access{post: ScopeTunnels})
+	a.route("/api/diagnostics/bundle", a.handleDiagnosticsBundle, access{get: ScopeSettings})
+	a.route("/api/unlock", a.handleUnlock, access{post: ""})
+	a.route("/api/lock", a.handleLock, access{post: ""})
+	a.route("/api/pin", a.handlePIN, access{post: ""})
+	a.route("/api/tokens", a.handleTokens, access{get: "", post: ""})
+	a.route("/api/tokens/revoke", a.handleRevokeToken, access{post: ""})
+	a.route("/metrics", a.handleMetrics, access{get: ScopeStatus})
+	a.route("/healthz", a.handleHealthz, access{get: ScopeStatus})
+	a.route("/readyz", a.handleReadyz, access{get: ScopeStatus})
+
+	slog.Info("Tatbeeb Link starting", "version", build.Version, "commit", build.Commit, "built", build.BuildDate, "go", build.GoVersion)
+	ln, err := a.listenWeb()
+	if err != nil {
+		// Without a dashboard the tunnels and the tray still work
+		slog.Error("failed to start web server, the dashboard is unavailable", "err", err)
+		return
+	}
+	url := a.dashboardURL()
+	slog.Info("web interface available", "url", url)
+
+	if startup := a.settings.Get().Startup; startup.OpenBrowser && !a.noBrowser {
+		go func() {
+			time.Sleep(1 * time.Second)
+			if <-autoConnected && startup.SkipBrowserOnAutoConnect {
+				slog.Info("auto-connect succeeded, not opening the dashboard")
 				return
 			}
-		}
-	}()
-
-	// Update status periodically
-	go app.updateTrayStatus()
-}
+			openBrowser(url)
+		}()
+	}
 
-func onExit() {
-	log.Println("Tatbeeb Link shutting down...")
+	a.webListener.Store(ln)
+	if err := http.Serve(ln, nil); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Error("web server stopped", "err", err)
+	}
 }
 
-func (a *App) startWebServer() {
-	http.HandleFunc("/", a.handleIndex)
-	http.HandleFunc("/api/status", a.handleStatus)
-	http.HandleFunc("/api/connect", a.handleConnect)
-	http.HandleFunc("/api/disconnect", a.handleDisconnect)
-
-	addr := "localhost:" + WebPort
-	url := "http://" + addr
-
-	log.Printf("🚀 Tatbeeb Link v%s starting...", Version)
-	log.Printf("🌐 Web interface available at %s", url)
-	log.Printf("📊 System tray icon active")
-
-	go func() {
-		time.Sleep(1 * time.Second)
-		openBrowser(url)
-	}()
-
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+// stopWebServer releases the dashboard and metrics ports.
+func (a *App) stopWebServer() {
+	if ln, ok := a.webListener.Load().(net.Listener); ok {
+		ln.Close()
+	}
+	if ln, ok := a.metricsListener.Load().(net.Listener); ok {
+		ln.Close()
+	}
+	if a.service && a.dataDir != "" {
+		os.Remove(filepath.Join(a.dataDir, serviceInfoName))
 	}
 }
 
-func (a *App) updateTrayStatus() {
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+// listenWeb listens on WebPort, or on a free port when another program
+// already uses it.
+func (a *App) listenWeb() (net.Listener, error) {
+	ln, err := net.Listen("tcp", "localhost:"+WebPort)
+	if err != nil {
+		slog.Warn("web port unavailable, using a free port instead", "port", WebPort, "err", err)
+		if ln, err = net.Listen("tcp", "localhost:0"); err != nil {
+			return nil, err
+		}
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	a.webPort.Store(port)
 
-	for range ticker.C {
-		if a.connected && a.shareableLink != "" {
-			a.mStatus.SetTitle(fmt.Sprintf("Connected: %s", a.shareableLink))
-		} else {
-			a.mStatus.SetTitle("Status: Disconnected")
+	// The desktop app looks for the service's dashboard here
+	if a.service && a.dataDir != "" {
+		if err := writeServiceInfo(a.dataDir, port); err != nil {
+			slog.Warn("can't record the dashboard port for the desktop app", "err", err)
 		}
 	}
+	return ln, nil
 }
 
-func (a *App) handleIndex(w http.ResponseWriter, r *http.Request) {
-	html := `<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Tatbeeb Link</title>
-    <style>
-        * { margin: 0; padding: 0; box-sizing: border-box; }
-        body {
-            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
-            background: linear-gradient(135deg, #2563eb 0%, #1e40af 100%);
-            min-height: 100vh;
-            display: flex;
-            align-items: center;
-            justify-content: center;
-            padding: 20px;
-        }
-        .container {
-            background: white;
-            border-radius: 20px;
-            box-shadow: 0 20px 60px rgba(0,0,0,0.3);
-            max-width: 500px;
-            width: 100%;
-            padding: 40px;
-        }
-        h1 {
-            color: #000000;
-            font-size: 38px;
-            margin-bottom: 10px;
-            text-align: center;
-        }
-        .subtitle {
-            color: #666;
-            text-align: center;
-            margin-bottom: 30px;
-        }
-        .status {
-            display: flex;
-            align-items: center;
-            justify-content: center;
-            gap: 10px;
-            padding: 20px;
-            background: #f7fafc;
-            border-radius: 10px;
-            margin-bottom: 30px;
-        }
-        .status-dot {
-            width: 16px;
-            height: 16px;
-            border-radius: 50%;
-            background: #ef4444;
-            animation: pulse 2s infinite;
-        }
-        .status-dot.connected {
-            background: #22c55e;
-        }
-        @keyframes pulse {
-            0%, 100% { opacity: 1; }
-            50% { opacity: 0.5; }
-        }
-        .status-text {
-            font-weight: 600;
-            color: #1f2937;
-        }
-        .form-group {
-            margin-bottom: 20px;
-        }
-        label {
-            display: block;
-            margin-bottom: 8px;
-            color: #374151;
-            font-weight: 500;
-            font-size: 14px;
-        }
-        input {
-            width: 100%;
-            padding: 12px;
-            border: 2px solid #e5e7eb;
-            border-radius: 8px;
-            font-size: 14px;
-            transition: all 0.3s;
-        }
-        input:focus {
-            outline: none;
-            border-color: #2563eb;
-            box-shadow: 0 0 0 3px rgba(37, 99, 235, 0.1);
-        }
-        .button {
-            width: 100%;
-            padding: 14px;
-            border: none;
-            border-radius: 8px;
-            font-size: 16px;
-            font-weight: 600;
-            cursor: pointer;
-            transition: all 0.3s;
-            margin-bottom: 10px;
-        }
-        .button-primary {
-            background: #2563eb;
-            color: white;
-        }
-        .button-primary:hover {
-            background: #1d4ed8;
-            transform: translateY(-2px);
-            box-shadow: 0 4px 12px rgba(37, 99, 235, 0.4);
-        }
-        .button-danger {
-            background: #ef4444;
-            color: white;
-        }
-        .button-danger:hover {
-            background: #dc2626;
-        }
-        .button:disabled {
-            opacity: 0.5;
-            cursor: not-allowed;
-        }
-        .shareable-box {
-            background: #ecfdf5;
-            border: 2px solid #10b981;
-            border-radius: 10px;
-            padding: 20px;
-            margin: 20px 0;
-            display: none;
-        }
-        .shareable-box.show {
-            display: flex;
-            align-items: center;
-            gap: 10px;
-        }
-        .shareable-label {
-            font-size: 12px;
-            color: #047857;
-            font-weight: 600;
-            margin-bottom: 8px;
-        }
-        .shareable-link {
-            flex: 1;
-            font-size: 18px;
-            font-weight: 700;
-            color: #065f46;
-            word-break: break-all;
-        }
-        .copy-icon-btn {
-            background: #10b981;
-            border: none;
-            border-radius: 8px;
-            width: 40px;
-            height: 40px;
-            display: flex;
-            align-items: center;
-            justify-content: center;
-            cursor: pointer;
-            transition: all 0.3s;
-            flex-shrink: 0;
-        }
-        .copy-icon-btn:hover {
-            background: #059669;
-            transform: scale(1.05);
-        }
-        .copy-icon-btn svg {
-            width: 20px;
-            height: 20px;
-            color: white;
-        }
-        .info-box {
-            background: #eff6ff;
-            border-left: 4px solid #2563eb;
-            padding: 16px;
-            margin: 20px 0;
-            border-radius: 8px;
-        }
-        .info-box ul {
-            list-style: none;
-            padding-left: 0;
-        }
-        .info-box li {
-            padding: 4px 0;
-            color: #1e40af;
-            font-size: 14px;
-        }
-        .info-box li:before {
-            content: "✓ ";
-            color: #2563eb;
-            font-weight: bold;
-            margin-right: 8px;
-        }
-        .error {
-            background: #fee2e2;
-            border-left: 4px solid #ef4444;
-            padding: 12px;
-            margin: 10px 0;
-            border-radius: 8px;
-            color: #991b1b;
-            font-size: 14px;
-            display: none;
-        }
-        .error.show {
-            display: block;
-        }
-        .setup-form {
-            display: block;
-        }
-        .setup-form.hidden {
-            display: none;
-        }
-        .footer {
-            text-align: center;
-            margin-top: 30px;
-            color: #9ca3af;
-            font-size: 12px;
-        }
-        .tray-notice {
-            background: #fef3c7;
-            border-left: 4px solid #f59e0b;
-            padding: 12px;
-            margin: 20px 0;
-            border-radius: 8px;
-            font-size: 13px;
-            color: #92400e;
-        }
-        .button-secondary {
-            background: #f3f4f6;
-            color: #374151;
-        }
-        .button-secondary:hover {
-            background: #e5e7eb;
-        }
-        .lang-switcher {
-            position: absolute;
-            top: 20px;
-            right: 20px;
-            display: flex;
-            gap: 8px;
-            background: white;
-            border-radius: 8px;
-            padding: 4px;
-            box-shadow: 0 2px 8px rgba(0, 0, 0, 0.1);
-        }
-        .lang-btn {
-            padding: 6px 12px;
-            border: none;
-            background: transparent;
-            cursor: pointer;
-            border-radius: 6px;
-            font-size: 13px;
-            font-weight: 500;
-            transition: all 0.2s;
-            color: #6b7280;
-        }
-        .lang-btn:hover {
-            background: #f3f4f6;
-        }
-        .lang-btn.active {
-            background: #2563eb;
-            color: white;
-        }
-        [dir="rtl"] {
-            direction: rtl;
-        }
-        [dir="rtl"] .lang-switcher {
-            left: 20px;
-            right: auto;
-        }
-    </style>
-</head>
-<body>
-    <div class="lang-switcher">
-        <button class="lang-btn active" onclick="setLanguage('en')" id="langEn">EN</button>
-        <button class="lang-btn" onclick="setLanguage('ar')" id="langAr">AR</button>
-    </div>
-    <div class="container">
-        <div style="text-align: center; margin-bottom: 20px;">
-            <img src="https://i.postimg.cc/rwZ7Sqpd/Tatbeeblink-logo.png" alt="Tatbeeb Link" style="width: 160px; height: 160px; margin: 0 auto 10px;">
-        </div>
-        <h1 data-i18n="title">Tatbeeb Link</h1>
-        <p class="subtitle" data-i18n="subtitle">Connect your Database to Tatbeeb HIS</p>
-        
-        <div class="status">
-            <div class="status-dot" id="statusDot"></div>
-            <span class="status-text" id="statusText">Disconnected</span>
-        </div>
-
-        <div class="error" id="errorBox"></div>
-
-        <div class="shareable-box" id="shareableBox">
-            <div class="shareable-link" id="shareableLink"></div>
-            <button class="copy-icon-btn" onclick="copyLink()" id="copyBtn" title="Copy link">
-                <svg fill="none" stroke="currentColor" viewBox="0 0 24 24">
-                    <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M8 16H6a2 2 0 01-2-2V6a2 2 0 012-2h8a2 2 0 012 2v2m-6 12h8a2 2 0 002-2v-8a2 2 0 00-2-2h-8a2 2 0 00-2 2v8a2 2 0 002 2z"></path>
-                </svg>
-            </button>
-        </div>
-
-        <div class="setup-form" id="setupForm">
-            <button class="button button-primary" onclick="connect()" id="connectBtn" data-i18n="startConnection">Start Connection</button>
-
-            <div class="advanced-settings" style="margin-top: 10px;">
-                <button class="button button-secondary" onclick="toggleAdvanced()" id="advancedBtn" data-i18n="advancedSettings">Advanced Settings</button>
-                <div id="advancedPanel" style="display: none; margin-top: 15px;">
-                    <div class="form-group">
-                        <label data-i18n="localPort">Local Port to Tunnel</label>
-                        <input type="number" id="localPort" value="9999" placeholder="9999" min="1" max="65535">
-                    </div>
-                </div>
-            </div>
-        </div>
-
-        <div class="setup-form hidden" id="connectedForm">
-            <button class="button button-danger" onclick="disconnect()" data-i18n="stopConnection">Stop Connection</button>
-        </div>
-
-        <div class="footer">
-            © 2025 Tatbeeb Healthcare Technology<br>
-            <span data-i18n="version">Version 1.0.0 • Running in system tray</span>
-        </div>
-    </div>
-
-    <script>
-        let pollingInterval;
-        let currentLang = localStorage.getItem('tatbeebLinkLang') || 'en';
-
-        const translations = {
-            en: {
-                title: 'Tatbeeb Link',
-                subtitle: 'Connect your Database to Tatbeeb HIS',
-                disconnected: 'Disconnected',
-                connected: 'Connected',
-                connecting: 'Connecting to relay...',
-                startConnection: 'Start Connection',
-                stopConnection: 'Stop Connection',
-                advancedSettings: 'Advanced Settings',
-                hideAdvancedSettings: 'Hide Advanced Settings',
-                localPort: 'Local Port to Tunnel',
-                version: 'Version 1.0.0 • Running in system tray',
-                copyLink: 'Copy link',
-                copied: '✅ Copied!',
-                errorInvalidPort: 'Please enter a valid port number (1-65535)',
-                errorConnectionFailed: 'Connection failed: ',
-                errorConnectFailed: 'Connect failed: ',
-                errorDisconnectFailed: 'Disconnect failed: '
-            },
-            ar: {
-                title: 'تطبيب لينك',
-                subtitle: 'ربط قاعدة البيانات بنظام تطبيب HIS',
-                disconnected: 'غير متصل',
-                connected: 'متصل',
-                connecting: 'جاري الاتصال بالخادم...',
-                startConnection: 'بدء الاتصال',
-                stopConnection: 'إيقاف الاتصال',
-                advancedSettings: 'إعدادات متقدمة',
-                hideAdvancedSettings: 'إخفاء الإعدادات المتقدمة',
-                localPort: 'المنفذ المحلي للنفق',
-                version: 'الإصدار 1.0.0 • يعمل في صينية النظام',
-                copyLink: 'نسخ الرابط',
-                copied: '✅ تم النسخ!',
-                errorInvalidPort: 'الرجاء إدخال رقم منفذ صحيح (1-65535)',
-                errorConnectionFailed: 'فشل الاتصال: ',
-                errorConnectFailed: 'فشل الاتصال: ',
-                errorDisconnectFailed: 'فشل قطع الاتصال: '
-            }
-        };
-
-        function setLanguage(lang) {
-            currentLang = lang;
-            localStorage.setItem('tatbeebLinkLang', lang);
-            
-            // Update UI direction
-            document.body.setAttribute('dir', lang === 'ar' ? 'rtl' : 'ltr');
-            
-            // Update active button
-            document.getElementById('langEn').classList.toggle('active', lang === 'en');
-            document.getElementById('langAr').classList.toggle('active', lang === 'ar');
-            
-            // Update all translatable elements
-            document.querySelectorAll('[data-i18n]').forEach(element => {
-                const key = element.getAttribute('data-i18n');
-                if (translations[lang][key]) {
-                    element.textContent = translations[lang][key];
-                }
-            });
-            
-            // Update copy button title
-            const copyBtn = document.getElementById('copyBtn');
-            if (copyBtn) {
-                copyBtn.setAttribute('title', t('copyLink'));
-            }
-            
-            // Update dynamic status text
-            updateStatus();
-        }
-
-        function t(key) {
-            return translations[currentLang][key] || translations['en'][key] || key;
-        }
-
-        // Initialize language on load
-        document.addEventListener('DOMContentLoaded', function() {
-            setLanguage(currentLang);
-        });
-
-        function showError(message) {
-            const errorBox = document.getElementById('errorBox');
-            errorBox.textContent = message;
-            errorBox.classList.add('show');
-            setTimeout(() => errorBox.classList.remove('show'), 5000);
-        }
-
-        async function connect() {
-            const localPort = document.getElementById('localPort').value;
-
-            if (!localPort || localPort < 1 || localPort > 65535) {
-                showError(t('errorInvalidPort'));
-                return;
-            }
-
-            document.getElementById('connectBtn').disabled = true;
-            document.getElementById('statusText').textContent = t('connecting');
-
-            try {
-                const response = await fetch('/api/connect', {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ localPort })
-                });
-
-                const result = await response.json();
-
-                if (result.success) {
-                    document.getElementById('setupForm').classList.add('hidden');
-                    document.getElementById('connectedForm').classList.remove('hidden');
-                    startPolling();
-                } else {
-                    showError(t('errorConnectionFailed') + result.error);
-                    document.getElementById('connectBtn').disabled = false;
-                }
-            } catch (error) {
-                showError(t('errorConnectFailed') + error.message);
-                document.getElementById('connectBtn').disabled = false;
-            }
-        }
-
-        async function disconnect() {
-            try {
-                await fetch('/api/disconnect', { method: 'POST' });
-                stopPolling();
-                document.getElementById('setupForm').classList.remove('hidden');
-                document.getElementById('connectedForm').classList.add('hidden');
-                document.getElementById('shareableBox').classList.remove('show');
-                document.getElementById('connectBtn').disabled = false;
-            } catch (error) {
-                showError(t('errorDisconnectFailed') + error.message);
-            }
-        }
-
-        async function updateStatus() {
-            try {
-                const response = await fetch('/api/status');
-                const status = await response.json();
-
-                const statusDot = document.getElementById('statusDot');
-                const statusText = document.getElementById('statusText');
-                const shareableBox = document.getElementById('shareableBox');
-                const shareableLink = document.getElementById('shareableLink');
-                const displayLocalPort = document.getElementById('displayLocalPort');
-
-                if (status.connected) {
-                    statusDot.classList.add('connected');
-                    statusText.textContent = t('connected');
-                    shareableLink.textContent = status.shareableLink;
-                    shareableBox.classList.add('show');
-                } else {
-                    statusDot.classList.remove('connected');
-                    statusText.textContent = t('disconnected');
-                    shareableBox.classList.remove('show');
-                }
-
-                if (status.error) {
-                    showError(status.error);
-                }
-            } catch (error) {
-                console.error('Failed to update status:', error);
-            }
-        }
-
-        function startPolling() {
-            updateStatus();
-            pollingInterval = setInterval(updateStatus, 2000);
-        }
-
-        function stopPolling() {
-            if (pollingInterval) {
-                clearInterval(pollingInterval);
-            }
-        }
-
-        function copyLink() {
-            const link = document.getElementById('shareableLink').textContent;
-            navigator.clipboard.writeText(link).then(() => {
-                const btn = event.target.closest('button');
-                btn.setAttribute('title', t('copied'));
-                setTimeout(() => btn.setAttribute('title', t('copyLink')), 2000);
-            });
-        }
-
-        function toggleAdvanced() {
-            const panel = document.getElementById('advancedPanel');
-            const btn = document.getElementById('advancedBtn');
-            if (panel.style.display === 'none') {
-                panel.style.display = 'block';
-                btn.textContent = t('hideAdvancedSettings');
-            } else {
-                panel.style.display = 'none';
-                btn.textContent = t('advancedSettings');
-            }
-        }
-
-        startPolling();
-    </script>
-</body>
-</html>`
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write([]byte(html))
+// port returns the port the dashboard is served on.
+func (a *App) port() string {
+	if port, ok := a.webPort.Load().(string); ok {
+		return port
+	}
+	return WebPort
 }
 
 func (a *App) handleStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("tunnel")
+	if id == "" {
+		id = a.defaultTunnelID()
+	}
+
+	tunnels := a.tunnelStatuses()
 	status := StatusUpdate{
-		Connected:     a.connected,
-		Status:        "Disconnected",
-		ShareableLink: a.shareableLink,
-		LocalPort:     a.localPort,
+		TunnelID: id,
+		State:    StateDisconnected,
+		Status:   "Disconnected",
+		Tunnels:  tunnels,
+		Service:  a.service,
+	}
+	for _, t := range tunnels {
+		if t.ID != id {
+			continue
+		}
+		status.State = t.State
+		status.Connected = t.Connected
+		status.ShareableLink = t.ShareableLink
+		status.Target = t.Target
+		status.Error = t.Error
 	}
 
-	if a.connected {
+	if status.Connected {
 		status.Status = "Connected"
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
+	writeJSON(w, http.StatusOK, status)
 }
 
 func (a *App) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+
 	var req ConnectRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Invalid request: " + err.Error(),
-		})
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
 		return
 	}
 
-	// Save local port
-	a.localPort = req.LocalPort
+	id := req.TunnelID
+	if id == "" {
+		id = a.defaultTunnelID()
+	}
 
-	// Start tunnel to relay
-	shareablePort, err := a.startTunnel()
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Tunnel failed: " + err.Error(),
+	// A bare local port is still accepted from older dashboards
+	target := req.Target
+	if target == "" {
+		target = req.LocalPort
+	}
+
+	// Remember the target so the tunnel comes back the same way next time
+	if target != "" {
+		err := a.settings.Update(func(s *Settings) error {
+			for i := range s.Tunnels {
+				if s.Tunnels[i].ID == id {
+					s.Tunnels[i].Target = target
+					return nil
+				}
+			}
+			return fmt.Errorf("unknown tunnel %q", id)
 		})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidTarget", err))
+			return
+		}
+	}
+
+	t := a.tunnel(id)
+	if t == nil {
+		writeError(w, http.StatusNotFound, a.tr(r, "api.unknownTunnel", id))
 		return
 	}
 
-	a.shareablePort = shareablePort
-	a.shareableLink = fmt.Sprintf("link.tatbeeb.sa:%s", shareablePort)
-	a.connected = true
+	// Start tunnel to relay
+	shareableLink, err := t.Start()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, a.tr(r, "api.tunnelFailed", err))
+		return
+	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"success":       true,
-		"shareableLink": a.shareableLink,
-		"localPort":     a.localPort,
+		"tunnelId":      id,
+		"shareableLink": shareableLink,
+		"target":        t.Status().Target,
 	})
 }
 
 func (a *App) handleDisconnect(w http.ResponseWriter, r *http.Request) {
-	a.closeTunnel()
-	a.connected = false
-	a.shareablePort = ""
-	a.shareableLink = ""
+	if !a.authorize(w, r) {
+		return
+	}
+
+	// An empty body stops every tunnel
+	var req DisconnectRequest
+	json.NewDecoder(r.Body).Decode(&req)
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	if req.TunnelID == "" {
+		a.stopAllTunnels()
+	} else if t := a.tunnel(req.TunnelID); t != nil {
+		t.Stop()
+	} else {
+		writeError(w, http.StatusNotFound, a.tr(r, "api.unknownTunnel", req.TunnelID))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"success": true,
 	})
 }
 
-func (a *App) startTunnel() (string, error) {
-	log.Printf("🚀 Starting tunnel to %s...", RelayServer)
-
-	tlsConfig := &tls.Config{
-		ServerName: "link.tatbeeb.sa",
-	}
+func (a *App) handleSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !a.authorize(w, r) {
+			return
+		}
 
-	log.Printf("🔐 Connecting to relay with TLS...")
-	conn, err := tls.Dial("tcp", RelayServer, tlsConfig)
-	if err != nil {
-		log.Printf("❌ Failed to connect to relay: %v", err)
-		return "", fmt.Errorf("failed to connect to relay: %w", err)
-	}
-	log.Printf("✅ TLS connection established")
+		var req struct {
+			Settings
+			// ClearRelayToken removes the relay token, which is never sent
+			// to the dashboard and so comes back empty
+			ClearRelayToken bool `json:"clearRelayToken"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
+			return
+		}
+		next := req.Settings
 
-	a.relayConn = conn
+		// New tunnels from the dashboard arrive without an id
+		for i := range next.Tunnels {
+			if next.Tunnels[i].ID == "" {
+				next.Tunnels[i].ID = newID()
+			}
+		}
 
-	// Send REGISTER command
-	registerMsg := "REGISTER\n"
-	log.Printf("📤 Sending REGISTER command...")
-	_, err = conn.Write([]byte(registerMsg))
-	if err != nil {
-		log.Printf("❌ Failed to send register: %v", err)
-		conn.Close()
-		return "", fmt.Errorf("failed to send register: %w", err)
-	}
-	log.Printf("✅ REGISTER command sent")
-
-	// Read response byte-by-byte to avoid buffering issues with yamux
-	log.Printf("📖 Reading response from relay...")
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	var response strings.Builder
-	buf := make([]byte, 1)
-	bytesRead := 0
-	for {
-		_, err := conn.Read(buf)
+		err := a.settings.Update(func(s *Settings) error {
+			// The PIN and API tokens have their own endpoints
+			next.Security = s.Security
+			next.API = s.API
+			if next.Relay.Token == "" && !req.ClearRelayToken {
+				next.Relay.Token = s.Relay.Token
+			}
+			*s = next
+			return nil
+		})
 		if err != nil {
-			log.Printf("❌ Failed to read response after %d bytes: %v", bytesRead, err)
-			conn.Close()
-			return "", fmt.Errorf("failed to read response: %w", err)
-		}
-		bytesRead++
-		if buf[0] == '\n' {
-			break
+			writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidSettings", err))
+			return
 		}
-		response.WriteByte(buf[0])
+		a.syncTunnels()
+		setLogLevel(a.settings.Get().Logging.Level)
+		slog.Info("settings saved")
 	}
-	conn.SetReadDeadline(time.Time{})
 
-	responseStr := strings.TrimSpace(response.String())
-	log.Printf("📥 Received response: '%s' (%d bytes)", responseStr, bytesRead)
+	// Secrets stay out of the dashboard, which only learns whether they
+	// are set
+	settings := a.settings.Get()
+	settings.Security.PINHash = ""
+	settings.API.Tokens = nil
+	relayTokenSet := settings.Relay.Token != ""
+	settings.Relay.Token = ""
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":       true,
+		"settings":      settings,
+		"pinSet":        a.pinSet(),
+		"relayTokenSet": relayTokenSet,
+		"unlocked":      a.unlocked(r),
+	})
+}
 
-	parts := strings.Split(responseStr, " ")
-	if len(parts) < 2 || parts[0] != "OK" {
-		log.Printf("❌ Unexpected response format: %s", responseStr)
-		conn.Close()
-		return "", fmt.Errorf("unexpected response: %s", responseStr)
-	}
+// handleLogs returns recent log entries. GET filters them with since, level,
+// tunnel, q and limit; POST {"level": ...} changes the log level and saves it.
+func (a *App) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !a.authorize(w, r) {
+			return
+		}
 
-	portParts := strings.Split(parts[1], ":")
-	if len(portParts) != 2 || portParts[0] != "port" {
-		log.Printf("❌ Invalid port format: %s", parts[1])
-		conn.Close()
-		return "", fmt.Errorf("invalid port format: %s", parts[1])
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
+			return
+		}
+		err := a.settings.Update(func(s *Settings) error {
+			s.Logging.Level = req.Level
+			return nil
+		})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidLevel", err))
+			return
+		}
+		setLogLevel(req.Level)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"level":   req.Level,
+		})
+		return
 	}
 
-	shareablePort := portParts[1]
-	log.Printf("✅ Assigned port: %s", shareablePort)
-
-	// Create yamux client session for multiplexing
-	log.Printf("🔀 Creating yamux client session...")
-	session, err := yamux.Client(conn, nil)
-	if err != nil {
-		log.Printf("❌ Failed to create yamux session: %v", err)
-		conn.Close()
-		return "", fmt.Errorf("failed to create yamux session: %w", err)
+	query := r.URL.Query()
+	filter := LogFilter{
+		Tunnel: query.Get("tunnel"),
+		Text:   strings.TrimSpace(query.Get("q")),
+		Limit:  500,
 	}
-	a.yamuxSession = session
-	log.Printf("✅ Yamux session created")
-
-	// Start accepting incoming streams (client connections)
-	log.Printf("🎧 Starting to accept streams...")
-	go a.acceptStreams()
-
-	log.Printf("✅ Tunnel ready: localhost:%s -> link.tatbeeb.sa:%s", a.localPort, shareablePort)
-
-	return shareablePort, nil
-}
-
-func (a *App) acceptStreams() {
-	log.Printf("🎧 Ready to accept streams from relay...")
-	streamCount := 0
-
-	for {
-		// Accept incoming streams from relay (each stream = one client connection)
-		log.Printf("⏳ Waiting for next stream...")
-		stream, err := a.yamuxSession.AcceptStream()
+	filter.Since, _ = strconv.ParseInt(query.Get("since"), 10, 64)
+	if n, err := strconv.Atoi(query.Get("limit")); err == nil && n > 0 {
+		filter.Limit = n
+	}
+	if name := query.Get("level"); name != "" {
+		level, err := parseLogLevel(name)
 		if err != nil {
-			log.Printf("❌ Session closed: %v", err)
-			a.connected = false
+			writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidLevel", err))
 			return
 		}
+		filter.MinLevel = level
+	}
 
-		streamCount++
-		log.Printf("🔗 Stream #%d accepted from relay", streamCount)
-
-		// Handle each stream in a goroutine
-		go a.handleStream(stream, streamCount)
+	entries, next := logRing.query(filter)
+	result := map[string]interface{}{
+		"success": true,
+		"entries": entries,
+		"next":    next,
+		"level":   a.settings.Get().Logging.Level,
+	}
+	if logFile != nil {
+		result["logDir"] = logFile.Dir()
 	}
+	writeJSON(w, http.StatusOK, result)
 }
 
-func (a *App) handleStream(stream net.Conn, streamNum int) {
-	defer stream.Close()
+// handleAudit exports the connection records of streams opened between from
+// and to (YYYY-MM-DD, both included, local time) as format=csv or json.
+func (a *App) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
 
-	log.Printf("🔗 [Stream#%d] New stream from relay, connecting to localhost:%s", streamNum, a.localPort)
+	if a.audit == nil {
+		writeError(w, http.StatusServiceUnavailable, a.tr(r, "api.auditUnavailable"))
+		return
+	}
 
-	// Connect to local port
-	localAddr := fmt.Sprintf("localhost:%s", a.localPort)
-	log.Printf("📡 [Stream#%d] Dialing %s...", streamNum, localAddr)
-	localConn, err := net.DialTimeout("tcp", localAddr, 10*time.Second)
+	query := r.URL.Query()
+	from, err := time.ParseInLocation("2006-01-02", query.Get("from"), time.Local)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidFromDate"))
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", query.Get("to"), time.Local)
 	if err != nil {
-		log.Printf("❌ [Stream#%d] Failed to connect to local port %s: %v", streamNum, a.localPort, err)
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidToDate"))
+		return
+	}
+	if to.Before(from) {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.dateOrder"))
 		return
 	}
-	defer localConn.Close()
 
-	log.Printf("✅ [Stream#%d] Connected to local port, starting data forwarding...", streamNum)
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType := map[string]string{
+		"csv":  "text/csv; charset=utf-8",
+		"json": "application/json",
+	}[format]
+	if contentType == "" {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.unknownFormat"))
+		return
+	}
 
-	// Forward data bidirectionally
-	done := make(chan bool, 2)
+	// Export to memory first so a read error can still be reported
+	var buf bytes.Buffer
+	head, err := a.audit.Export(&buf, from, to.AddDate(0, 0, 1), format)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, a.tr(r, "api.exportFailed", err))
+		return
+	}
 
-	// Stream -> Local
-	go func() {
-		n, err := io.Copy(localConn, stream)
-		if err != nil {
-			log.Printf("⚠️ [Stream#%d] Relay->Local error: %v", streamNum, err)
-		}
-		log.Printf("📥 [Stream#%d] Relay->Local: %d bytes", streamNum, n)
-		done <- true
-	}()
+	filename := fmt.Sprintf("tatbeeb-link-audit-%s-to-%s.%s", from.Format("2006-01-02"), to.Format("2006-01-02"), format)
+	// Sent with both formats, as a CSV file has no room for them
+	w.Header().Set("X-Audit-Device", a.audit.deviceID)
+	w.Header().Set("X-Audit-Chain-Head", fmt.Sprintf("%d %s", head.Seq, head.Hash))
+	if pub := a.audit.PublicKey(); pub != nil {
+		w.Header().Set("X-Audit-Public-Key", encodePublicKey(pub))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(buf.Bytes())
+}
 
-	// Local -> Stream
-	go func() {
-		n, err := io.Copy(stream, localConn)
-		if err != nil {
-			log.Printf("⚠️ [Stream#%d] Local->Relay error: %v", streamNum, err)
-		}
-		log.Printf("📤 [Stream#%d] Local->Relay: %d bytes", streamNum, n)
-		done <- true
-	}()
+// handleInstances finds SQL Server instances: on {"host": ...}, or by a
+// broadcast to the LAN without one. The broadcast reaches other machines, so
+// it is locked like connecting.
+func (a *App) handleInstances(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+	var req struct {
+		Host string `json:"host"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
+		return
+	}
 
-	// Wait for either direction to close
-	<-done
-	log.Printf("🔌 [Stream#%d] Connection closed", streamNum)
-}
+	var instances []SQLInstance
+	var err error
+	if host := strings.TrimSpace(req.Host); host != "" {
+		instances, err = listSQLInstances(host)
+	} else {
+		instances, err = discoverSQLInstances()
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, a.tr(r, "api.discoveryFailed", err))
+		return
+	}
 
-func (a *App) closeTunnel() error {
-	if a.yamuxSession != nil {
-		a.yamuxSession.Close()
-		a.yamuxSession = nil
+	type instanceResult struct {
+		SQLInstance
+		Target string `json:"target"`
 	}
-	if a.relayConn != nil {
-		a.relayConn.Close()
-		a.relayConn = nil
+	results := make([]instanceResult, 0, len(instances))
+	for _, inst := range instances {
+		results = append(results, instanceResult{SQLInstance: inst, Target: inst.Target()})
 	}
-	return nil
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"instances": results,
+	})
 }
 
 func openBrowser(url string) {
@@ -916,33 +601,6 @@ func openBrowser(url string) {
 	}
 
 	if err != nil {
-		log.Printf("Failed to open browser: %v", err)
-	}
-}
-
-func getIcon() []byte {
-	// Return the embedded icon data
-	if len(iconData) > 0 {
-		return iconData
-	}
-
-	// Fallback: Try to load from file system
-	exePath, err := os.Executable()
-	if err != nil {
-		log.Printf("Failed to get executable path: %v", err)
-		return []byte{}
-	}
-
-	iconPath := filepath.Join(filepath.Dir(exePath), "Tatbeeblink-logo.png")
-	fileData, err := os.ReadFile(iconPath)
-	if err != nil {
-		// If not found next to executable, try current directory
-		fileData, err = os.ReadFile("Tatbeeblink-logo.png")
-		if err != nil {
-			log.Printf("Failed to load icon: %v", err)
-			return []byte{}
-		}
+		slog.Warn("failed to open browser", "err", err)
 	}
-
-	return fileData
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel/tunneltest"
+)
+
+func TestMain(m *testing.M) {
+	// Keep test output readable; go test -v still shows t.Log
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// newTestApp returns an app whose only tunnel goes to target through the
+// given relay endpoints, trusting the test relay's certificate.
+func newTestApp(t *testing.T, target string, endpoints ...string) *App {
+	t.Helper()
+	s := defaultSettings()
+	s.Relay.Endpoints = endpoints
+	s.Tunnels = []TunnelSettings{{ID: "test", Name: "Test", Target: target}}
+	app := newAppWithSettings(&SettingsStore{settings: s})
+	app.relayTLS = tunneltest.ClientTLS()
+	t.Cleanup(app.stopAllTunnels)
+	return app
+}
+
+// newEchoTarget starts a local TCP server that echoes what it receives,
+// standing in for the database.
+func newEchoTarget(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// closedPort returns an address where nothing listens.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// waitFor polls cond until it holds or the timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel"
+)
+
+// healthDialTimeout bounds the target check of /readyz.
+const healthDialTimeout = 2 * time.Second
+
+// dialLatencyBuckets are the upper bounds, in seconds, of the target dial
+// latency histogram.
+var dialLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// targetMetrics are a tunnel's target dial counters for /metrics; the rest
+// come from its client's Stats. The zero value is ready to use.
+type targetMetrics struct {
+	resolveFailures int64
+	dialFailures    int64
+	dialLatency     histogram
+}
+
+// histogram is a cumulative Prometheus histogram over dialLatencyBuckets.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.counts == nil {
+		h.counts = make([]uint64, len(dialLatencyBuckets))
+	}
+	for i, bound := range dialLatencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) snapshot() ([]uint64, float64, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts := make([]uint64, len(dialLatencyBuckets))
+	copy(counts, h.counts)
+	return counts, h.sum, h.count
+}
+
+// metricsWriter renders the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value; labels are name, value pairs.
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=%q", labels[i], escapeLabel(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(m.w, "%s %s\n", b.String(), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// escapeLabel drops control characters other than newline, so that %q only
+// produces the escapes the format allows: \\, \" and \n.
+func escapeLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// writeMetrics renders every metric for the configured tunnels.
+func (a *App) writeMetrics(w io.Writer) {
+	m := metricsWriter{w}
+
+	type tunnelSample struct {
+		t      *Tunnel
+		status TunnelStatus
+		stats  tunnel.Stats
+	}
+	var tunnels []tunnelSample
+	for _, cfg := range a.settings.Get().Tunnels {
+		t := a.getTunnel(cfg.ID)
+		tunnels = append(tunnels, tunnelSample{t, t.Status(), t.client.Stats()})
+	}
+
+	m.family("tatbeeb_link_info", "gauge", "Agent version and build.")
+	m.sample("tatbeeb_link_info", 1, "version", build.Version, "commit", build.Commit, "goversion", build.GoVersion)
+
+	m.family("tatbeeb_link_tunnel_state", "gauge", "Tunnel state, 1 for the current one.")
+	for _, s := range tunnels {
+		for _, state := range []string{StateDisconnected, StateConnecting, StateConnected, StateReconnecting} {
+			value := 0.0
+			if s.status.State == state {
+				value = 1
+			}
+			m.sample("tatbeeb_link_tunnel_state", value, "tunnel", s.t.ID, "name", s.status.Name, "state", state)
+		}
+	}
+
+	m.family("tatbeeb_link_tunnel_up", "gauge", "Whether the tunnel has a relay session.")
+	for _, s := range tunnels {
+		up := 0.0
+		if s.status.Connected {
+			up = 1
+		}
+		m.sample("tatbeeb_link_tunnel_up", up, "tunnel", s.t.ID)
+	}
+
+	counters := []struct {
+		name, help string
+		value      func(tunnel.Stats) int64
+	}{
+		{"tatbeeb_link_relay_sessions_lost_total", "Relay sessions that dropped unexpectedly.", func(s tunnel.Stats) int64 { return s.SessionsLost }},
+		{"tatbeeb_link_relay_reconnect_attempts_total", "Attempts to reconnect to the relay.", func(s tunnel.Stats) int64 { return s.ReconnectAttempts }},
+		{"tatbeeb_link_relay_reconnects_total", "Successful reconnects to the relay.", func(s tunnel.Stats) int64 { return s.Reconnects }},
+		{"tatbeeb_link_streams_accepted_total", "Streams accepted from the relay.", func(s tunnel.Stats) int64 { return s.StreamsAccepted }},
+		{"tatbeeb_link_streams_rejected_total", "Streams rejected by the connection limit.", func(s tunnel.Stats) int64 { return s.StreamsRejected }},
+		{"tatbeeb_link_bytes_in_total", "Bytes received from the relay and sent to the target.", func(s tunnel.Stats) int64 { return s.BytesIn }},
+		{"tatbeeb_link_bytes_out_total", "Bytes received from the target and sent to the relay.", func(s tunnel.Stats) int64 { return s.BytesOut }},
+	}
+	for _, c := range counters {
+		m.family(c.name, "counter", c.help)
+		for _, s := range tunnels {
+			m.sample(c.name, float64(c.value(s.stats)), "tunnel", s.t.ID)
+		}
+	}
+
+	m.family("tatbeeb_link_streams_active", "gauge", "Streams currently forwarding to the target.")
+	for _, s := range tunnels {
+		m.sample("tatbeeb_link_streams_active", float64(s.status.ActiveStreams), "tunnel", s.t.ID)
+	}
+
+	m.family("tatbeeb_link_target_dial_failures_total", "counter", "Failed connections to the target, by reason.")
+	for _, s := range tunnels {
+		m.sample("tatbeeb_link_target_dial_failures_total", float64(atomic.LoadInt64(&s.t.metrics.resolveFailures)), "tunnel", s.t.ID, "reason", "resolve")
+		m.sample("tatbeeb_link_target_dial_failures_total", float64(atomic.LoadInt64(&s.t.metrics.dialFailures)), "tunnel", s.t.ID, "reason", "connect")
+	}
+
+	m.family("tatbeeb_link_target_dial_seconds", "histogram", "Time to connect to the target.")
+	for _, s := range tunnels {
+		counts, sum, count := s.t.metrics.dialLatency.snapshot()
+		for i, bound := range dialLatencyBuckets {
+			m.sample("tatbeeb_link_target_dial_seconds_bucket", float64(counts[i]), "tunnel", s.t.ID, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		m.sample("tatbeeb_link_target_dial_seconds_bucket", float64(count), "tunnel", s.t.ID, "le", "+Inf")
+		m.sample("tatbeeb_link_target_dial_seconds_sum", sum, "tunnel", s.t.ID)
+		m.sample("tatbeeb_link_target_dial_seconds_count", float64(count), "tunnel", s.t.ID)
+	}
+
+	m.family("tatbeeb_link_relay_rtt_seconds", "gauge", "Last measured round trip to the relay.")
+	for _, s := range tunnels {
+		if rtt := s.stats.RTT; rtt > 0 && s.status.Connected {
+			m.sample("tatbeeb_link_relay_rtt_seconds", rtt.Seconds(), "tunnel", s.t.ID)
+		}
+	}
+}
+
+// startMetricsServer serves /metrics, /healthz and /readyz on the metrics
+// address, if one is set. Nothing else is served there, and every request
+// needs an allowed address or an API token with the status:read scope.
+func (a *App) startMetricsServer() {
+	addr := a.settings.Get().Metrics.Listen
+	if addr == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("failed to start the metrics server", "addr", addr, "err", err)
+		return
+	}
+	slog.Info("metrics available", "addr", ln.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", a.metricsGuard(a.handleMetrics))
+	mux.HandleFunc("/healthz", a.metricsGuard(a.handleHealthz))
+	mux.HandleFunc("/readyz", a.metricsGuard(a.handleReadyz))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	a.metricsListener.Store(ln)
+	if err := server.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Error("metrics server stopped", "err", err)
+	}
+}
+
+// metricsGuard admits GETs from the allowed addresses, and from anywhere
+// with an API token that has the status:read scope. The allow list and the
+// tokens are read on every request, so changes apply at once.
+func (a *App) metricsGuard(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			a.reject(w, r, http.StatusMethodNotAllowed, "api.methodNotAllowed")
+			return
+		}
+		if a.settings.Get().Metrics.allows(r.RemoteAddr) {
+			h(w, r)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		token, ok := a.apiToken(auth)
+		switch {
+		case auth == "":
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			a.reject(w, r, http.StatusUnauthorized, "api.metricsNotAllowed")
+		case !ok:
+			a.reject(w, r, http.StatusUnauthorized, "api.badApiToken")
+		case !slices.Contains(token.Scopes, ScopeStatus):
+			a.reject(w, r, http.StatusForbidden, "api.tokenScope", ScopeStatus)
+			a.recordTokenUse(token, r, time.Now(), http.StatusForbidden)
+		default:
+			a.serveToken(w, r, h, token)
+		}
+	}
+}
+
+func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	a.writeMetrics(w)
+}
+
+// TunnelHealth is one tunnel's entry in /healthz and /readyz.
+type TunnelHealth struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// TargetReachable is only checked by /readyz.
+	TargetReachable *bool  `json:"targetReachable,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// expectedTunnels are the tunnels that should be up: auto-connect ones and
+// any started from the dashboard or the command line.
+func (a *App) expectedTunnels() []*Tunnel {
+	var expected []*Tunnel
+	for _, cfg := range a.settings.Get().Tunnels {
+		t := a.getTunnel(cfg.ID)
+		if cfg.AutoConnect || t.client.Status().Wanted {
+			expected = append(expected, t)
+		}
+	}
+	return expected
+}
+
+// handleHealthz reports whether the agent is alive and still trying: it fails
+// only when a tunnel that should be up gave up reconnecting.
+func (a *App) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	healthy := true
+	var tunnels []TunnelHealth
+	for _, t := range a.expectedTunnels() {
+		status := t.Status()
+		health := TunnelHealth{ID: t.ID, Name: status.Name, State: status.State, Error: status.Error}
+		if status.State == StateDisconnected && status.Error != "" {
+			healthy = false
+		}
+		tunnels = append(tunnels, health)
+	}
+	writeHealth(w, healthy, tunnels)
+}
+
+// handleReadyz reports whether every tunnel that should be up has a relay
+// session and can reach its target.
+func (a *App) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	expected := a.expectedTunnels()
+	tunnels := make([]TunnelHealth, len(expected))
+	ready := len(expected) > 0
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, t := range expected {
+		status := t.Status()
+		tunnels[i] = TunnelHealth{ID: t.ID, Name: status.Name, State: status.State, Error: status.Error}
+
+		wg.Add(1)
+		go func(health *TunnelHealth, target string, connected bool) {
+			defer wg.Done()
+
+			err := checkTarget(target)
+			reachable := err == nil
+			health.TargetReachable = &reachable
+			if err != nil && health.Error == "" {
+				health.Error = err.Error()
+			}
+
+			mu.Lock()
+			ready = ready && connected && reachable
+			mu.Unlock()
+		}(&tunnels[i], status.Target, status.Connected)
+	}
+	wg.Wait()
+
+	writeHealth(w, ready, tunnels)
+}
+
+// checkTarget opens and closes a connection to a tunnel target.
+func checkTarget(target string) error {
+	addr, err := resolveTarget(target)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, healthDialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, tunnels []TunnelHealth) {
+	status := "ok"
+	code := http.StatusOK
+	if !ok {
+		status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	if tunnels == nil {
+		tunnels = []TunnelHealth{}
+	}
+
+	writeJSON(w, code, map[string]interface{}{
+		"status":  status,
+		"tunnels": tunnels,
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsGuard(t *testing.T) {
+	app := newTestApp(t, closedPort(t), closedPort(t))
+	if err := app.settings.Update(func(s *Settings) error {
+		s.API.Tokens = []APIToken{
+			{ID: "a", Name: "monitoring", Hash: hashAPISecret("tlk_status"), Scopes: []string{ScopeStatus}},
+			{ID: "b", Name: "control", Hash: hashAPISecret("tlk_control"), Scopes: []string{ScopeTunnels}},
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(app.metricsGuard(app.handleMetrics))
+	defer server.Close()
+
+	get := func(method, token string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+"/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	allow := func(entries ...string) {
+		t.Helper()
+		if err := app.settings.Update(func(s *Settings) error {
+			s.Metrics.Allow = entries
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		allow  []string
+		method string
+		token  string
+		want   int
+	}{
+		{"no token", nil, http.MethodGet, "", http.StatusUnauthorized},
+		{"unknown token", nil, http.MethodGet, "tlk_other", http.StatusUnauthorized},
+		{"token without status:read", nil, http.MethodGet, "tlk_control", http.StatusForbidden},
+		{"status token", nil, http.MethodGet, "tlk_status", http.StatusOK},
+		{"other address allowed", []string{"10.0.0.0/8"}, http.MethodGet, "", http.StatusUnauthorized},
+		{"allowed address", []string{"10.0.0.0/8", "127.0.0.1"}, http.MethodGet, "", http.StatusOK},
+		{"allowed range", []string{"127.0.0.0/8"}, http.MethodGet, "", http.StatusOK},
+		{"POST", []string{"127.0.0.1"}, http.MethodPost, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		allow(tt.allow...)
+		if got := get(tt.method, tt.token); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsSettingsValidation(t *testing.T) {
+	for name, m := range map[string]MetricsSettings{
+		"address without port": {Listen: "0.0.0.0"},
+		"bad port":             {Listen: "0.0.0.0:99999"},
+		"bad allow entry":      {Listen: ":9465", Allow: []string{"clinic-pc"}},
+	} {
+		s := defaultSettings()
+		s.Metrics = m
+		if err := s.validate(); err == nil {
+			t.Errorf("%s: %+v was accepted", name, m)
+		}
+	}
+
+	s := defaultSettings()
+	s.Metrics = MetricsSettings{Listen: ":9465", Allow: []string{"10.0.5.20", "10.0.6.0/24", "fd00::/8"}}
+	if err := s.validate(); err != nil {
+		t.Errorf("valid metrics settings rejected: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Desktop notification events. Each can be muted in the settings.
+const (
+	EventTunnelUp        = "tunnelUp"
+	EventTunnelDown      = "tunnelDown"
+	EventReconnectGaveUp = "reconnectGaveUp"
+	EventNewLink         = "newLink"
+	EventTargetDown      = "targetDown"
+)
+
+var notificationEvents = []string{EventTunnelUp, EventTunnelDown, EventReconnectGaveUp, EventNewLink, EventTargetDown}
+
+const (
+	// notifyRepeatInterval is how soon the same event for the same tunnel
+	// is shown again, so a flapping link or a stopped database doesn't
+	// bury the desktop.
+	notifyRepeatInterval = time.Minute
+	// At most notifyBurst notifications are shown per notifyWindow.
+	notifyBurst  = 5
+	notifyWindow = time.Minute
+)
+
+// notifier shows a desktop notification. There is one implementation per
+// OS.
+type notifier interface {
+	Notify(title, body string) error
+}
+
+// notifications passes tunnel events to a notifier, skipping muted ones and
+// rate-limiting the rest. A nil *notifications shows nothing, which is what
+// the service and headless runs use.
+type notifications struct {
+	backend notifier
+
+	mu sync.Mutex
+	// last maps event/tunnel keys to when they were last shown
+	last   map[string]time.Time
+	recent []time.Time
+}
+
+func newNotifications(backend notifier) *notifications {
+	return &notifications{backend: backend, last: make(map[string]time.Time)}
+}
+
+// allow reports whether the event under key may be shown now, and if so
+// counts it.
+func (n *notifications) allow(key string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if last, ok := n.last[key]; ok && now.Sub(last) < notifyRepeatInterval {
+		return false
+	}
+	recent := n.recent[:0]
+	for _, t := range n.recent {
+		if now.Sub(t) < notifyWindow {
+			recent = append(recent, t)
+		}
+	}
+	n.recent = recent
+	if len(n.recent) >= notifyBurst {
+		return false
+	}
+
+	n.last[key] = now
+	n.recent = append(n.recent, now)
+	return true
+}
+
+// notifyEvent shows event for the tunnel with the given ID. The event's
+// message is formatted with the tunnel's name followed by args.
+func (a *App) notifyEvent(event, tunnelID string, args ...interface{}) {
+	n := a.notifications
+	if n == nil {
+		return
+	}
+	settings := a.settings.Get()
+	if settings.Notifications.muted(event) {
+		return
+	}
+	if !n.allow(event+"/"+tunnelID, time.Now()) {
+		slog.Debug("notification rate-limited", "event", event, "tunnel", tunnelID)
+		return
+	}
+
+	cfg, _ := settings.tunnel(tunnelID)
+	title := translate(settings.Language, "notify."+event+"Title")
+	body := translate(settings.Language, "notify."+event, append([]interface{}{cfg.Name}, args...)...)
+	// Some backends take a moment; tunnels shouldn't wait for them
+	go func() {
+		if err := n.backend.Notify(title, body); err != nil {
+			slog.Warn("can't show a desktop notification", "event", event, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// dbusNotifier shows notifications through the freedesktop notification
+// service on the session bus.
+type dbusNotifier struct {
+	mu   sync.Mutex
+	conn *dbus.Conn
+}
+
+func newNotifier() notifier {
+	return &dbusNotifier{}
+}
+
+func (n *dbusNotifier) Notify(title, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Connect on first use: the desktop may still be starting when we are
+	if n.conn == nil || !n.conn.Connected() {
+		conn, err := dbus.ConnectSessionBus()
+		if err != nil {
+			return err
+		}
+		n.conn = conn
+	}
+
+	obj := n.conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	// app name, replaces id, icon, summary, body, actions, hints, timeout
+	// (-1 lets the desktop decide)
+	return obj.Call("org.freedesktop.Notifications.Notify", 0,
+		"Tatbeeb Link", uint32(0), "network-transmit-receive", title, body,
+		[]string{}, map[string]dbus.Variant{}, int32(-1)).Err
+}
@@ -0,0 +1,29 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// scriptNotifier shows notifications with AppleScript on macOS.
+type scriptNotifier struct{}
+
+func newNotifier() notifier {
+	return scriptNotifier{}
+}
+
+func (scriptNotifier) Notify(title, body string) error {
+	if runtime.GOOS != "darwin" {
+		return fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+	}
+	script := fmt.Sprintf("display notification %s with title %s", appleScriptString(body), appleScriptString(title))
+	return exec.Command("osascript", "-e", script).Run()
+}
+
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"unicode/utf16"
+)
+
+// toastAppID is the identity toasts are shown under. Windows only shows
+// toasts for registered apps; PowerShell's is present on every install.
+const toastAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+const createNoWindow = 0x08000000
+
+// toastNotifier shows Windows toast notifications through PowerShell, which
+// can reach the WinRT notification API without cgo.
+type toastNotifier struct{}
+
+func newNotifier() notifier {
+	return toastNotifier{}
+}
+
+func (toastNotifier) Notify(title, body string) error {
+	toast := fmt.Sprintf(`<toast><visual><binding template="ToastGeneric"><text>%s</text><text>%s</text></binding></visual></toast>`,
+		escapeXML(title), escapeXML(body))
+	// A single-quoted here-string takes the XML literally; escaping
+	// turned any newlines into entities, so it can't end early
+	script := fmt.Sprintf(`[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] > $null
+$xml = New-Object Windows.Data.Xml.Dom.XmlDocument
+$xml.LoadXml(@'
+%s
+'@)
+$toast = New-Object Windows.UI.Notifications.ToastNotification $xml
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('%s').Show($toast)
+`, toast, toastAppID)
+
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass",
+		"-EncodedCommand", encodePowerShell(script))
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true, CreationFlags: createNoWindow}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// encodePowerShell encodes a script for -EncodedCommand: base64 of UTF-16LE.
+func encodePowerShell(script string) string {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, utf16.Encode([]rune(script)))
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
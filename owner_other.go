@@ -0,0 +1,47 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"syscall"
+)
+
+// dataOwner is the account that owns the data directory when root runs on
+// another user's settings, as the system service does. Files root creates
+// there are handed to it, or the user's own copy of the app could no longer
+// read them. Nil otherwise.
+var dataOwner *struct{ uid, gid int }
+
+// adoptDataOwner sets dataOwner from dataDir. Call it before anything is
+// written there. A directory that doesn't exist yet will be root's own.
+func adoptDataOwner(dataDir string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	info, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Uid == 0 {
+		return nil
+	}
+	dataOwner = &struct{ uid, gid int }{int(stat.Uid), int(stat.Gid)}
+	return nil
+}
+
+// chownData hands a file or directory root created in the data directory to
+// dataOwner.
+func chownData(path string) {
+	if dataOwner == nil {
+		return
+	}
+	if err := os.Lchown(path, dataOwner.uid, dataOwner.gid); err != nil {
+		slog.Warn("can't hand the file to the settings owner", "file", path, "err", err)
+	}
+}
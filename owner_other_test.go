@@ -0,0 +1,50 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestRootHandsDataFilesToTheOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody account")
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	gid, _ := strconv.Atoi(nobody.Gid)
+	dataDir := t.TempDir()
+	if err := os.Chown(dataDir, uid, gid); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dataOwner = nil })
+
+	if err := adoptDataOwner(dataDir); err != nil {
+		t.Fatal(err)
+	}
+	recordAudit(t, openTestAuditLog(t, dataDir, 365), 1)
+	if err := writeServiceInfo(dataDir, "8765"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if stat := info.Sys().(*syscall.Stat_t); int(stat.Uid) != uid {
+			t.Errorf("%s is owned by uid %d, want %d", path, stat.Uid, uid)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// scrypt parameters for new PIN hashes; existing hashes keep theirs
+	pinScryptN   = 32768
+	pinScryptR   = 8
+	pinScryptP   = 1
+	pinSaltBytes = 16
+	pinHashBytes = 32
+
+	minPINLength = 4
+
+	sessionCookieName  = "tatbeeb_session"
+	sessionIdleTimeout = 15 * time.Minute
+
+	// After maxPINFailures wrong PINs in a row, unlocking is refused for
+	// pinLockoutBase, doubling with every further wrong PIN up to
+	// pinLockoutMax.
+	maxPINFailures = 5
+	pinLockoutBase = time.Minute
+	pinLockoutMax  = 30 * time.Minute
+)
+
+// hashPIN returns a salted scrypt hash as
+// scrypt$N$r$p$base64(salt)$base64(hash).
+func hashPIN(pin string) (string, error) {
+	salt := make([]byte, pinSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(pin), salt, pinScryptN, pinScryptR, pinScryptP, pinHashBytes)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("scrypt$%d$%d$%d$%s$%s", pinScryptN, pinScryptR, pinScryptP,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPIN reports whether pin matches a hash made by hashPIN.
+func checkPIN(encoded, pin string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "scrypt" {
+		return false
+	}
+	n, errN := strconv.Atoi(parts[1])
+	r, errR := strconv.Atoi(parts[2])
+	p, errP := strconv.Atoi(parts[3])
+	salt, errSalt := base64.RawStdEncoding.DecodeString(parts[4])
+	want, errWant := base64.RawStdEncoding.DecodeString(parts[5])
+	if err := errors.Join(errN, errR, errP, errSalt, errWant); err != nil {
+		return false
+	}
+
+	got, err := scrypt.Key([]byte(pin), salt, n, r, p, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pinLock tracks unlocked dashboard sessions and wrong PIN guesses. The
+// dashboard is only reachable from this machine, so guesses are counted for
+// all callers together.
+type pinLock struct {
+	mu sync.Mutex
+	// sessions maps session tokens to when they were last used
+	sessions    map[string]time.Time
+	failures    int
+	lockedUntil time.Time
+}
+
+func (l *pinLock) newSession() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sessions == nil {
+		l.sessions = make(map[string]time.Time)
+	}
+	l.sessions[token] = time.Now()
+	return token
+}
+
+// valid reports whether token is an unexpired session and keeps it alive.
+func (l *pinLock) valid(token string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for t, used := range l.sessions {
+		if now.Sub(used) > sessionIdleTimeout {
+			delete(l.sessions, t)
+		}
+	}
+	if _, ok := l.sessions[token]; !ok || token == "" {
+		return false
+	}
+	l.sessions[token] = now
+	return true
+}
+
+func (l *pinLock) endSession(token string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sessions, token)
+}
+
+// endAllSessions locks every dashboard, e.g. after the PIN changed.
+func (l *pinLock) endAllSessions() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sessions = nil
+}
+
+// lockedFor returns how long guessing is still refused.
+func (l *pinLock) lockedFor() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Until(l.lockedUntil)
+}
+
+// record counts a guess and returns the guesses left before a lockout.
+func (l *pinLock) record(ok bool) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ok {
+		l.failures = 0
+		return maxPINFailures
+	}
+	l.failures++
+	if l.failures < maxPINFailures {
+		return maxPINFailures - l.failures
+	}
+	lockout := time.Duration(float64(pinLockoutBase) * math.Pow(2, float64(l.failures-maxPINFailures)))
+	if lockout > pinLockoutMax || lockout <= 0 {
+		lockout = pinLockoutMax
+	}
+	l.lockedUntil = time.Now().Add(lockout)
+	return 0
+}
+
+// guessPIN checks pin against the saved hash, enforcing the lockout. It
+// writes the error response and returns false when the PIN isn't accepted.
+func (a *App) guessPIN(w http.ResponseWriter, r *http.Request, pin string) bool {
+	if wait := a.lock.lockedFor(); wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"success":    false,
+			"error":      a.tr(r, "api.pinLockedOut", seconds),
+			"retryAfter": seconds,
+		})
+		return false
+	}
+
+	ok := checkPIN(a.settings.Get().Security.PINHash, pin)
+	left := a.lock.record(ok)
+	if ok {
+		return true
+	}
+
+	slog.Warn("wrong dashboard PIN", "attemptsLeft", left)
+	msg := a.tr(r, "api.wrongPin", left)
+	if left == 0 {
+		msg = a.tr(r, "api.wrongPinLocked", int(math.Ceil(a.lock.lockedFor().Seconds())))
+	}
+	writeJSON(w, http.StatusForbidden, map[string]interface{}{
+		"success":      false,
+		"error":        msg,
+		"attemptsLeft": left,
+	})
+	return false
+}
+
+func (a *App) pinSet() bool {
+	return a.settings.Get().Security.PINHash != ""
+}
+
+// unlocked reports whether r may change things: there is no PIN, or it
+// carries an unlocked session.
+func (a *App) unlocked(r *http.Request) bool {
+	if !a.pinSet() {
+		return true
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	return err == nil && a.lock.valid(cookie.Value)
+}
+
+// authorize lets the request through when unlocked or made with an API
+// token, and otherwise answers 401 with pinRequired so the dashboard asks
+// for the PIN.
+func (a *App) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if _, ok := requestToken(r); ok || a.unlocked(r) {
+		return true
+	}
+	writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+		"success":     false,
+		"error":       a.tr(r, "api.pinRequired"),
+		"pinRequired": true,
+	})
+	return false
+}
+
+func (a *App) startSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    a.lock.newSession(),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// handleUnlock starts a session for {"pin": ...}.
+func (a *App) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PIN string `json:"pin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
+		return
+	}
+
+	if a.pinSet() {
+		if !a.guessPIN(w, r, req.PIN) {
+			return
+		}
+		a.startSession(w)
+		slog.Info("dashboard unlocked")
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// handleLock ends the caller's session.
+func (a *App) handleLock(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		a.lock.endSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// handlePIN sets, changes or, with an empty pin, removes the admin PIN.
+// Changing or removing it needs an unlocked session and the current PIN.
+func (a *App) handlePIN(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CurrentPIN string `json:"currentPin"`
+		PIN        string `json:"pin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
+		return
+	}
+
+	if a.pinSet() {
+		if !a.authorize(w, r) || !a.guessPIN(w, r, req.CurrentPIN) {
+			return
+		}
+	}
+
+	var hash string
+	if req.PIN != "" {
+		if len([]rune(req.PIN)) < minPINLength {
+			writeError(w, http.StatusBadRequest, a.tr(r, "api.pinTooShort", minPINLength))
+			return
+		}
+		var err error
+		if hash, err = hashPIN(req.PIN); err != nil {
+			writeError(w, http.StatusInternalServerError, a.tr(r, "api.pinHashFailed", err))
+			return
+		}
+	}
+
+	err := a.settings.Update(func(s *Settings) error {
+		s.Security.PINHash = hash
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, a.tr(r, "api.pinSaveFailed", err))
+		return
+	}
+
+	// Other dashboards unlocked with the old PIN have to enter the new one
+	a.lock.endAllSessions()
+	if hash != "" {
+		a.startSession(w)
+		slog.Info("dashboard PIN set")
+	} else {
+		slog.Info("dashboard PIN removed")
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"pinSet":  hash != "",
+	})
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	// relayHandshakeTimeout bounds the TLS handshake and REGISTER line of a
+	// new agent connection.
+	relayHandshakeTimeout = 10 * time.Second
+	relayMaxLine          = 512
+	// relayMaxTokenLength leaves room in relayMaxLine for the rest of
+	// REGISTER.
+	relayMaxTokenLength = 256
+	// relayDryRunTimeout is how long a dry-run session stays open for the
+	// diagnostics to ping it.
+	relayDryRunTimeout = time.Minute
+	// Agents still in the handshake and open dry runs are capped, so
+	// connections that never register can't pile up.
+	relayMaxHandshakes = 64
+	relayMaxDryRuns    = 16
+)
+
+// relayConfig is how a self-hosted relay runs.
+type relayConfig struct {
+	// bind is the address public ports listen on, empty for all.
+	bind             string
+	portMin, portMax int
+	// minVersion turns away older agents with UPDATE; empty allows all.
+	minVersion    string
+	updateMessage string
+	// maxTunnels limits the registered agents; 0 means the size of the
+	// port range.
+	maxTunnels int
+	// token is the secret agents must send to register; empty lets any
+	// agent in.
+	token string
+	// maxHandshakes and maxDryRuns default to relayMaxHandshakes and
+	// relayMaxDryRuns.
+	maxHandshakes int
+	maxDryRuns    int
+}
+
+// relayServer is the server side of the tunnel protocol: agents register
+// over TLS and get a public port, and each connection to that port is
+// handed to the agent as a yamux stream.
+type relayServer struct {
+	cfg    relayConfig
+	logger *slog.Logger
+
+	// handshakes holds a slot for each agent that hasn't registered yet
+	handshakes chan struct{}
+
+	mu       sync.Mutex
+	inUse    map[int]bool
+	next     int
+	tunnels  map[*relayTunnel]struct{}
+	dryRuns  map[net.Conn]struct{}
+	listener net.Listener
+	closed   bool
+	ids      int64
+}
+
+// relayTunnel is one registered agent.
+type relayTunnel struct {
+	id      int64
+	port    int
+	session *yamux.Session
+	public  net.Listener
+	started time.Time
+	streams int64
+}
+
+func newRelayServer(cfg relayConfig, logger *slog.Logger) *relayServer {
+	if cfg.maxHandshakes <= 0 {
+		cfg.maxHandshakes = relayMaxHandshakes
+	}
+	if cfg.maxDryRuns <= 0 {
+		cfg.maxDryRuns = relayMaxDryRuns
+	}
+	return &relayServer{
+		cfg:        cfg,
+		logger:     logger,
+		handshakes: make(chan struct{}, cfg.maxHandshakes),
+		inUse:      make(map[int]bool),
+		next:       rand.Intn(cfg.portMax - cfg.portMin + 1),
+		tunnels:    make(map[*relayTunnel]struct{}),
+		dryRuns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts agents on ln, a TLS listener, until Close.
+func (s *relayServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		select {
+		case s.handshakes <- struct{}{}:
+		default:
+			// Agents retry, so shedding new connections during a flood
+			// only delays them
+			s.logger.Warn("too many agents registering at once, dropping a connection", "agent", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		go s.handleAgent(conn)
+	}
+}
+
+// Close stops accepting agents and ends every tunnel.
+func (s *relayServer) Close() {
+	s.mu.Lock()
+	s.closed = true
+	ln := s.listener
+	var sessions []*yamux.Session
+	for t := range s.tunnels {
+		sessions = append(sessions, t.session)
+	}
+	var dryRuns []net.Conn
+	for conn := range s.dryRuns {
+		dryRuns = append(dryRuns, conn)
+	}
+	s.mu.Unlock()
+
+	if ln != nil {
+		ln.Close()
+	}
+	for _, session := range sessions {
+		session.Close()
+	}
+	for _, conn := range dryRuns {
+		conn.Close()
+	}
+}
+
+// registerRequest is an agent's REGISTER line,
+// e.g. "REGISTER version=1.1.0 platform=windows/amd64 token=...".
+type registerRequest struct {
+	version  string
+	platform string
+	token    string
+	dryRun   bool
+}
+
+func parseRegister(line string) (registerRequest, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "REGISTER" {
+		return registerRequest{}, fmt.Errorf("expected REGISTER")
+	}
+	var req registerRequest
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "version":
+			req.version = value
+		case "platform":
+			req.platform = value
+		case "token":
+			req.token = value
+		case "dryrun":
+			req.dryRun = value == "1"
+		}
+	}
+	return req, nil
+}
+
+// readLine reads one line a byte at a time, so nothing the agent sends
+// after it is taken from yamux.
+func readLine(conn net.Conn, limit int) (string, error) {
+	var line strings.Builder
+	buf := make([]byte, 1)
+	for line.Len() < limit {
+		if _, err := conn.Read(buf); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return strings.TrimSpace(line.String()), nil
+		}
+		line.WriteByte(buf[0])
+	}
+	return "", fmt.Errorf("line longer than %d bytes", limit)
+}
+
+// authorized reports whether token is the relay's token. Both are hashed
+// first, so the comparison takes as long whatever their lengths.
+func (s *relayServer) authorized(token string) bool {
+	if s.cfg.token == "" {
+		return true
+	}
+	want := sha256.Sum256([]byte(s.cfg.token))
+	got := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// startDryRun counts conn towards the dry-run limit until endDryRun, so
+// Close can end it with the tunnels.
+func (s *relayServer) startDryRun(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.dryRuns) >= s.cfg.maxDryRuns {
+		return false
+	}
+	s.dryRuns[conn] = struct{}{}
+	return true
+}
+
+func (s *relayServer) endDryRun(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.dryRuns, conn)
+}
+
+func (s *relayServer) handleAgent(conn net.Conn) {
+	logger := s.logger.With("agent", conn.RemoteAddr().String())
+	conn.SetDeadline(time.Now().Add(relayHandshakeTimeout))
+	// The slot Serve took is given back once the agent is registered or
+	// turned away
+	handshakeDone := sync.OnceFunc(func() { <-s.handshakes })
+	defer handshakeDone()
+
+	line, err := readLine(conn, relayMaxLine)
+	if err != nil {
+		logger.Debug("agent dropped before registering", "err", err)
+		conn.Close()
+		return
+	}
+	req, err := parseRegister(line)
+	if err != nil {
+		logger.Warn("agent sent an unknown command", "line", line)
+		fmt.Fprintf(conn, "ERR %v\n", err)
+		conn.Close()
+		return
+	}
+	logger = logger.With("version", req.version, "platform", req.platform)
+
+	if !s.authorized(req.token) {
+		logger.Warn("agent refused, wrong or missing token")
+		fmt.Fprintf(conn, "ERR unauthorized\n")
+		conn.Close()
+		return
+	}
+
+	// Agents from before versions were sent count as too old
+	if s.cfg.minVersion != "" && (req.version == "" || compareVersions(req.version, s.cfg.minVersion) < 0) {
+		logger.Info("agent too old, asked to update", "minimum", s.cfg.minVersion)
+		fmt.Fprintf(conn, "UPDATE %s %s\n", s.cfg.minVersion, s.cfg.updateMessage)
+		conn.Close()
+		return
+	}
+
+	if req.dryRun {
+		if !s.startDryRun(conn) {
+			logger.Warn("dry run refused, too many open")
+			fmt.Fprintf(conn, "ERR too many dry runs, try again later\n")
+			conn.Close()
+			return
+		}
+		defer s.endDryRun(conn)
+	}
+
+	public, port, err := s.allocate()
+	if err != nil {
+		logger.Warn("tunnel refused", "err", err)
+		fmt.Fprintf(conn, "ERR %v\n", err)
+		conn.Close()
+		return
+	}
+	if req.dryRun {
+		// A dry run goes through the same checks but never opens the port
+		public.Close()
+		s.release(port)
+	}
+
+	if _, err := fmt.Fprintf(conn, "OK port:%d\n", port); err != nil {
+		logger.Debug("agent dropped before the reply", "err", err)
+		if !req.dryRun {
+			public.Close()
+			s.release(port)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	handshakeDone()
+
+	yamuxConfig := yamux.DefaultConfig()
+	yamuxConfig.LogOutput = nil
+	yamuxConfig.Logger = slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
+	session, err := yamux.Server(conn, yamuxConfig)
+	if err != nil {
+		logger.Error("failed to create yamux session", "err", err)
+		if !req.dryRun {
+			public.Close()
+			s.release(port)
+		}
+		conn.Close()
+		return
+	}
+
+	if req.dryRun {
+		logger.Info("dry run registered", "port", port)
+		select {
+		case <-session.CloseChan():
+		case <-time.After(relayDryRunTimeout):
+		}
+		session.Close()
+		return
+	}
+
+	t := &relayTunnel{
+		id:      atomic.AddInt64(&s.ids, 1),
+		port:    port,
+		session: session,
+		public:  public,
+		started: time.Now(),
+	}
+	if !s.add(t) {
+		session.Close()
+		public.Close()
+		s.release(port)
+		return
+	}
+	logger = logger.With("tunnel", t.id, "port", port)
+	logger.Info("tunnel registered")
+
+	go s.servePublic(t, logger)
+	<-session.CloseChan()
+
+	public.Close()
+	s.remove(t)
+	s.release(port)
+	logger.Info("tunnel closed",
+		"streams", atomic.LoadInt64(&t.streams),
+		"duration", time.Since(t.started).Round(time.Second))
+}
+
+// servePublic hands each connection to the tunnel's port to the agent.
+func (s *relayServer) servePublic(t *relayTunnel, logger *slog.Logger) {
+	for {
+		client, err := t.public.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		stream, err := t.session.Open()
+		if err != nil {
+			logger.Warn("can't open a stream to the agent", "client", client.RemoteAddr().String(), "err", err)
+			client.Close()
+			if t.session.IsClosed() {
+				return
+			}
+			continue
+		}
+		n := atomic.AddInt64(&t.streams, 1)
+		logger.Debug("stream opened", "stream", n, "client", client.RemoteAddr().String())
+		go relayPipe(client, stream)
+	}
+}
+
+// relayPipe copies both ways until either side ends, then closes both.
+func relayPipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyAndSignal := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyAndSignal(a, b)
+	go copyAndSignal(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// allocate listens on the next free port of the range. Ports are handed out
+// in turn rather than lowest first, so a link that just closed isn't given
+// to the next agent straight away.
+func (s *relayServer) allocate() (net.Listener, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, 0, fmt.Errorf("relay is shutting down")
+	}
+	size := s.cfg.portMax - s.cfg.portMin + 1
+	limit := s.cfg.maxTunnels
+	if limit <= 0 || limit > size {
+		limit = size
+	}
+	if len(s.inUse) >= limit {
+		return nil, 0, fmt.Errorf("tunnel limit reached")
+	}
+	for i := 0; i < size; i++ {
+		port := s.cfg.portMin + (s.next+i)%size
+		if s.inUse[port] {
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(s.cfg.bind, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		s.inUse[port] = true
+		s.next = (s.next + i + 1) % size
+		return ln, port, nil
+	}
+	return nil, 0, fmt.Errorf("no free ports")
+}
+
+func (s *relayServer) release(port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inUse, port)
+}
+
+func (s *relayServer) add(t *relayTunnel) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.tunnels[t] = struct{}{}
+	return true
+}
+
+func (s *relayServer) remove(t *relayTunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tunnels, t)
+}
+
+// certReloader serves a certificate from PEM files and picks up a renewed
+// one without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil && info.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// Mid-renewal the files may not match yet; keep the old one
+			slog.Warn("can't load the renewed certificate, keeping the current one", "err", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		slog.Info("certificate reloaded", "file", c.certFile)
+	}
+	c.cert, c.modTime = &cert, info.ModTime()
+	return c.cert, nil
+}
+
+// validateRelayToken checks that a token fits in the REGISTER line.
+func validateRelayToken(token string) error {
+	if strings.ContainsFunc(token, unicode.IsSpace) {
+		return errors.New("the relay token can't contain spaces")
+	}
+	if len(token) > relayMaxTokenLength {
+		return fmt.Errorf("the relay token is longer than %d characters", relayMaxTokenLength)
+	}
+	return nil
+}
+
+// parsePortRange parses "20000-20999" or a single port.
+func parsePortRange(s string) (int, int, error) {
+	low, high, ok := strings.Cut(s, "-")
+	if !ok {
+		high = low
+	}
+	if validatePort(low) != nil || validatePort(high) != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: use first-last, e.g. 20000-20999", s)
+	}
+	first, _ := strconv.Atoi(low)
+	last, _ := strconv.Atoi(high)
+	if first > last {
+		return 0, 0, fmt.Errorf("invalid port range %q: the first port is above the last", s)
+	}
+	return first, last, nil
+}
+
+const relayUsageText = `Usage: tatbeeb-link relay --cert <file> --key <file> [flags]
+
+Runs a relay that Tatbeeb Link agents connect to instead of the Tatbeeb
+cloud. Each agent gets a port from the range, and connections to that port
+reach the agent's database. Point agents at it with the relay server
+setting, e.g. relay.example.org:8443, and give them the relay token.
+
+A relay that agents reach from other machines needs a token, so it can't be
+used by anyone to open public ports. Generate one with e.g.
+"openssl rand -hex 32" and keep it in a file passed with --token-file.
+`
+
+func runRelayCommand(args []string) int {
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	listen := fs.String("listen", ":8443", "address agents connect to")
+	certFile := fs.String("cert", "", "TLS certificate (PEM, with any intermediates), reloaded when it changes")
+	keyFile := fs.String("key", "", "TLS private key (PEM)")
+	ports := fs.String("ports", "20000-20999", "range of public ports handed to agents")
+	bind := fs.String("bind", "", "address the public ports listen on (default: all)")
+	minVersion := fs.String("min-version", "", "ask agents older than this version to update")
+	updateMessage := fs.String("update-message", "", "reason shown to agents asked to update")
+	maxTunnels := fs.Int("max-tunnels", 0, "maximum registered agents (default: the size of the port range)")
+	token := fs.String("token", "", "secret agents must send to register (prefer --token-file)")
+	tokenFile := fs.String("token-file", "", "file holding the secret agents must send to register")
+	logLevelName := fs.String("log-level", "info", "debug, info, warn or error")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, relayUsageText+"\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *certFile == "" || *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "❌ --cert and --key are required")
+		return exitUsage
+	}
+	portMin, portMax, err := parsePortRange(*ports)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitUsage
+	}
+	if *minVersion != "" {
+		if _, _, err := parseVersion(*minVersion); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return exitUsage
+		}
+	}
+	if _, err := parseLogLevel(*logLevelName); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitUsage
+	}
+	if *tokenFile != "" {
+		if *token != "" {
+			fmt.Fprintln(os.Stderr, "❌ --token and --token-file can't be combined")
+			return exitUsage
+		}
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return exitConfig
+		}
+		*token = strings.TrimSpace(string(data))
+	}
+	if err := validateRelayToken(*token); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitUsage
+	}
+	if host, _, err := net.SplitHostPort(*listen); *token == "" && (err != nil || !isLocalHost(host)) {
+		fmt.Fprintf(os.Stderr, "❌ --token or --token-file is required when agents connect from other machines (--listen %s)\n", *listen)
+		return exitUsage
+	}
+
+	setupLogging(os.Stdout, "", "")
+	setLogLevel(*logLevelName)
+
+	certs, err := newCertReloader(*certFile, *keyFile)
+	if err != nil {
+		slog.Error("can't load the certificate", "err", err)
+		return exitConfig
+	}
+	ln, err := tls.Listen("tcp", *listen, &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+	if err != nil {
+		slog.Error("can't listen for agents", "err", err)
+		return exitError
+	}
+
+	server := newRelayServer(relayConfig{
+		bind:          *bind,
+		portMin:       portMin,
+		portMax:       portMax,
+		minVersion:    *minVersion,
+		updateMessage: *updateMessage,
+		maxTunnels:    *maxTunnels,
+		token:         *token,
+	}, slog.With("component", "relay"))
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		s := <-sig
+		slog.Info("shutting down", "signal", s.String())
+		server.Close()
+	}()
+
+	slog.Info("relay listening", "addr", ln.Addr().String(), "ports", *ports, "version", build.Version)
+	if err := server.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Error("relay stopped", "err", err)
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel"
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel/tunneltest"
+)
+
+// newTestRelay runs a relayServer on a local TLS port. Unless cfg says
+// otherwise, it hands out a single free port on 127.0.0.1.
+func newTestRelay(t *testing.T, cfg relayConfig) (*relayServer, string) {
+	t.Helper()
+	if cfg.portMin == 0 {
+		_, port, _ := net.SplitHostPort(closedPort(t))
+		cfg.portMin, _ = strconv.Atoi(port)
+		cfg.portMax = cfg.portMin
+	}
+	if cfg.bind == "" {
+		cfg.bind = "127.0.0.1"
+	}
+	cert, _ := tunneltest.Certificate()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newRelayServer(cfg, slog.Default())
+	go s.Serve(ln)
+	t.Cleanup(s.Close)
+	return s, ln.Addr().String()
+}
+
+// registerRaw registers on the relay by hand, without starting a tunnel.
+func registerRaw(t *testing.T, endpoint string, reg tunnel.Registration) (net.Conn, string, error) {
+	t.Helper()
+	_, roots := tunneltest.Certificate()
+	conn, err := tls.Dial("tcp", endpoint, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	reg.Version, reg.Platform = build.Version, build.Platform
+	port, err := tunnel.Register(ctx, conn, reg)
+	return conn, port, err
+}
+
+func (s *relayServer) portsInUse() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inUse)
+}
+
+func TestRelayForwardsToAgent(t *testing.T) {
+	relay, endpoint := newTestRelay(t, relayConfig{})
+	app := newTestApp(t, newEchoTarget(t), endpoint)
+	agent := app.tunnel("test")
+
+	link, err := agent.Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if want := net.JoinHostPort("127.0.0.1", strconv.Itoa(relay.cfg.portMin)); link != want {
+		t.Errorf("link = %q, want %q", link, want)
+	}
+
+	client, err := net.DialTimeout("tcp", link, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial link: %v", err)
+	}
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(client, "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len("SELECT 1"))
+	if _, err := io.ReadFull(client, echo); err != nil || string(echo) != "SELECT 1" {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+	client.Close()
+
+	result, err := agent.client.TestLink(context.Background())
+	if err != nil {
+		t.Fatalf("TestLink: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("link test failed at %s: %s", result.Stage, result.Error)
+	}
+
+	// Stopping the agent gives the port back
+	agent.Stop()
+	waitFor(t, 5*time.Second, "the port to be released", func() bool {
+		return relay.portsInUse() == 0
+	})
+	if conn, err := net.DialTimeout("tcp", link, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("the link still accepts connections after the agent left")
+	}
+}
+
+func TestRelayDryRun(t *testing.T) {
+	relay, endpoint := newTestRelay(t, relayConfig{})
+
+	_, port, err := registerRaw(t, endpoint, tunnel.Registration{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if port != strconv.Itoa(relay.cfg.portMin) {
+		t.Errorf("port = %s, want %d", port, relay.cfg.portMin)
+	}
+	if n := relay.portsInUse(); n != 0 {
+		t.Errorf("%d ports in use after a dry run", n)
+	}
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("a dry run opened the public port")
+	}
+}
+
+func TestRelayRefusesOldAgents(t *testing.T) {
+	relay, endpoint := newTestRelay(t, relayConfig{minVersion: "99.0.0", updateMessage: "please update"})
+	app := newTestApp(t, newEchoTarget(t), endpoint)
+
+	_, err := app.tunnel("test").Start()
+	var update *tunnel.UpdateRequiredError
+	if !errors.As(err, &update) {
+		t.Fatalf("Start error = %v, want an update required", err)
+	}
+	if update.Minimum != "99.0.0" || update.Message != "please update" {
+		t.Errorf("update = %+v", update)
+	}
+	if n := relay.portsInUse(); n != 0 {
+		t.Errorf("%d ports in use for a refused agent", n)
+	}
+}
+
+func TestRelayTunnelLimit(t *testing.T) {
+	_, port, _ := net.SplitHostPort(closedPort(t))
+	first, _ := strconv.Atoi(port)
+	_, endpoint := newTestRelay(t, relayConfig{portMin: first, portMax: first + 1, maxTunnels: 1})
+
+	if _, _, err := registerRaw(t, endpoint, tunnel.Registration{}); err != nil {
+		t.Fatalf("first agent: %v", err)
+	}
+	_, _, err := registerRaw(t, endpoint, tunnel.Registration{})
+	if !errors.Is(err, tunnel.ErrRefused) {
+		t.Fatalf("second agent error = %v, want a refusal", err)
+	}
+}
+
+func TestRelayRequiresToken(t *testing.T) {
+	_, endpoint := newTestRelay(t, relayConfig{token: "clinic-secret"})
+
+	for _, token := range []string{"", "guess"} {
+		_, _, err := registerRaw(t, endpoint, tunnel.Registration{Token: token})
+		if !errors.Is(err, tunnel.ErrUnauthorized) || !errors.Is(err, tunnel.ErrRefused) {
+			t.Errorf("token %q: error = %v, want unauthorized", token, err)
+		}
+	}
+	if _, _, err := registerRaw(t, endpoint, tunnel.Registration{Token: "clinic-secret"}); err != nil {
+		t.Errorf("the right token: %v", err)
+	}
+}
+
+func TestRelayLimitsDryRuns(t *testing.T) {
+	_, port, _ := net.SplitHostPort(closedPort(t))
+	first, _ := strconv.Atoi(port)
+	relay, endpoint := newTestRelay(t, relayConfig{portMin: first, portMax: first + 1, maxDryRuns: 1})
+
+	dryRun, _, err := registerRaw(t, endpoint, tunnel.Registration{DryRun: true})
+	if err != nil {
+		t.Fatalf("first dry run: %v", err)
+	}
+	if _, _, err := registerRaw(t, endpoint, tunnel.Registration{DryRun: true}); !errors.Is(err, tunnel.ErrRefused) {
+		t.Fatalf("second dry run error = %v, want a refusal", err)
+	}
+	// Tunnels aren't held up by dry runs
+	if _, _, err := registerRaw(t, endpoint, tunnel.Registration{}); err != nil {
+		t.Fatalf("agent during a dry run: %v", err)
+	}
+
+	dryRun.Close()
+	waitFor(t, 5*time.Second, "the dry run to end", func() bool {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return len(relay.dryRuns) == 0
+	})
+	if _, _, err := registerRaw(t, endpoint, tunnel.Registration{DryRun: true}); err != nil {
+		t.Errorf("dry run after the first ended: %v", err)
+	}
+}
+
+func TestRelayLimitsHandshakes(t *testing.T) {
+	_, endpoint := newTestRelay(t, relayConfig{maxHandshakes: 1})
+	_, roots := tunneltest.Certificate()
+	config := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+
+	// A connection that never registers holds the only slot
+	idle, err := net.Dial("tcp", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "new agents to be turned away", func() bool {
+		conn, err := tls.Dial("tcp", endpoint, config)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+
+	idle.Close()
+	waitFor(t, 5*time.Second, "an agent to register again", func() bool {
+		conn, err := tls.Dial("tcp", endpoint, config)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = tunnel.Register(ctx, conn, tunnel.Registration{Version: build.Version})
+		return err == nil
+	})
+}
+
+func TestParseRegister(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    registerRequest
+		wantErr bool
+	}{
+		{"REGISTER", registerRequest{}, false},
+		{"REGISTER version=1.2.0 platform=windows/amd64", registerRequest{version: "1.2.0", platform: "windows/amd64"}, false},
+		{"REGISTER version=1.2.0 dryrun=1", registerRequest{version: "1.2.0", dryRun: true}, false},
+		{"REGISTER version=1.2.0 token=s3cret", registerRequest{version: "1.2.0", token: "s3cret"}, false},
+		{"REGISTER dryrun=0 extra=ignored", registerRequest{}, false},
+		{"", registerRequest{}, true},
+		{"HELLO version=1.2.0", registerRequest{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRegister(tt.line)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseRegister(%q) = %+v, %v; want %+v, error %v", tt.line, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in          string
+		first, last int
+		wantErr     bool
+	}{
+		{"20000-20999", 20000, 20999, false},
+		{"30000", 30000, 30000, false},
+		{"5000-5000", 5000, 5000, false},
+		{"20999-20000", 0, 0, true},
+		{"0-10", 0, 0, true},
+		{"20000-70000", 0, 0, true},
+		{"ports", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, tt := range tests {
+		first, last, err := parsePortRange(tt.in)
+		if (err != nil) != tt.wantErr || first != tt.first || last != tt.last {
+			t.Errorf("parsePortRange(%q) = %d, %d, %v; want %d, %d, error %v", tt.in, first, last, err, tt.first, tt.last, tt.wantErr)
+		}
+	}
+}
+
+func TestRelayCloseEndsDryRuns(t *testing.T) {
+	relay, endpoint := newTestRelay(t, relayConfig{})
+
+	dryRun, _, err := registerRaw(t, endpoint, tunnel.Registration{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	relay.Close()
+
+	dryRun.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := dryRun.Read(make([]byte, 64)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read after Close = %v, want the dry run ended", err)
+	}
+}
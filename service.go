@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+const (
+	serviceName        = "tatbeeb-link"
+	serviceDisplayName = "Tatbeeb Link"
+	serviceDescription = "Tatbeeb Link secure database tunnel"
+)
+
+// serviceManager registers the agent with the operating system's service
+// manager: systemd on Linux, the Service Control Manager on Windows.
+type serviceManager interface {
+	Install(cfg serviceConfig) error
+	Uninstall() error
+	// Status returns a short human-readable state such as "running".
+	Status() (string, bool, error)
+}
+
+// serviceConfig describes how the service launches the agent.
+type serviceConfig struct {
+	Executable string
+	Args       []string
+	// User runs the service as this account instead of the default one
+	// (root on Linux, LocalSystem on Windows).
+	User string
+}
+
+// serviceArgs are the "run" arguments the service starts the agent with: the
+// saved tunnels from a fixed settings file, retrying forever, with the
+// dashboard up so the tray app can attach to it.
+func serviceArgs(configPath string) []string {
+	return []string{"run", "--service", "--web", "--retry", "--config", configPath}
+}
+
+const serviceUsageText = `Usage: tatbeeb-link service <install|uninstall|status> [flags]
+
+  install     Register and start the service (needs administrator rights)
+  uninstall   Stop and remove the service
+  status      Print whether the service is installed and running
+
+The service runs the saved auto-connect tunnels before anyone logs in. The
+tray app then only shows the service's state instead of starting its own.
+`
+
+func runServiceCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, serviceUsageText)
+		return exitUsage
+	}
+
+	manager, err := newServiceManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitError
+	}
+
+	switch args[0] {
+	case "install":
+		fs := flag.NewFlagSet("service install", flag.ContinueOnError)
+		configPath := fs.String("config", "", "settings file the service uses (default: the settings of the user running sudo, or this user's)")
+		user := fs.String("user", "", "account to run the service as (default: the system account)")
+		if code, ok := parseFlags(fs, args[1:]); !ok {
+			return code
+		}
+		return installService(manager, *configPath, *user)
+
+	case "uninstall":
+		if err := manager.Uninstall(); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Uninstall failed: %v\n", err)
+			return exitError
+		}
+		fmt.Println("✅ Service removed")
+		return exitOK
+
+	case "status":
+		state, running, err := manager.Status()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return exitError
+		}
+		fmt.Printf("%s: %s\n", serviceName, state)
+		if !running {
+			return exitError
+		}
+		return exitOK
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown service command %q\n\n%s", args[0], serviceUsageText)
+		return exitUsage
+	}
+}
+
+func installService(manager serviceManager, configPath, user string) int {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Can't locate this program: %v\n", err)
+		return exitError
+	}
+
+	// The service account has its own config directory, so pin the file of
+	// the user installing it. Loading it also validates it up front.
+	if configPath == "" {
+		if configPath, err = installerSettingsPath(); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return exitConfig
+		}
+	}
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitConfig
+	}
+	if _, err := loadSettings(configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitConfig
+	}
+
+	cfg := serviceConfig{
+		Executable: exe,
+		Args:       serviceArgs(configPath),
+		User:       user,
+	}
+	if err := manager.Install(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Install failed: %v\n", err)
+		return exitError
+	}
+
+	fmt.Printf("✅ Service %q installed and started\n", serviceName)
+	fmt.Printf("   Settings: %s\n", configPath)
+	fmt.Printf("   Dashboard: http://localhost:%s\n", WebPort)
+	return exitOK
+}
+
+// installerSettingsPath returns the settings file of the user installing the
+// service. Under sudo that is the user who ran sudo rather than root, whose
+// settings must already exist: creating them as root would leave the user
+// unable to open them.
+func installerSettingsPath() (string, error) {
+	name := os.Getenv("SUDO_USER")
+	if name == "" || name == "root" || os.Geteuid() != 0 {
+		dir, err := appDataDir()
+		if err != nil {
+			return "", fmt.Errorf("no settings directory: %w", err)
+		}
+		return filepath.Join(dir, settingsFileName), nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", fmt.Errorf("can't find the settings of %s: %w", name, err)
+	}
+	path := filepath.Join(u.HomeDir, ".config", appDirName, settingsFileName)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("no settings at %s, open Tatbeeb Link as %s first or pass --config: %w", path, name, err)
+	}
+	return path, nil
+}
+
+// findRunningService returns the dashboard URL of the system service if it
+// is running on this machine, or "" if it isn't. The service records its
+// port in dataDir, since WebPort may have been taken when it started.
+func findRunningService(dataDir string) string {
+	ports := []string{WebPort}
+	if info, ok := readServiceInfo(dataDir); ok && info.Web != WebPort {
+		ports = append([]string{info.Web}, ports...)
+	}
+
+	for _, port := range ports {
+		url := "http://localhost:" + port
+		status, err := fetchStatus(url)
+		if err != nil || !status.Service {
+			continue
+		}
+		slog.Info("Tatbeeb Link service is running, attaching to it", "url", url)
+		return url
+	}
+	return ""
+}
+
+func fetchStatus(baseURL string) (StatusUpdate, error) {
+	client := http.Client{Timeout: 2 * time.Second}
+
+	var status StatusUpdate
+	resp, err := client.Get(baseURL + "/api/status")
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("status request failed: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// currentStatuses reports the tunnels this app shows: its own, or those of
+// the service it attached to.
+func (a *App) currentStatuses() []TunnelStatus {
+	if a.viewerURL == "" {
+		return a.tunnelStatuses()
+	}
+
+	status, err := fetchStatus(a.viewerURL)
+	if err != nil {
+		slog.Warn("can't reach the Tatbeeb Link service", "url", a.viewerURL, "err", err)
+		return nil
+	}
+	return status.Tunnels
+}
+
+// dashboardURL is the address "Open Dashboard" opens.
+func (a *App) dashboardURL() string {
+	if a.viewerURL != "" {
+		return a.viewerURL
+	}
+	return "http://localhost:" + a.port()
+}
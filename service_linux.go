@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const systemdUnitDir = "/etc/systemd/system"
+
+// systemdManager installs the agent as a systemd system unit so it starts at
+// boot, before anyone logs in.
+type systemdManager struct {
+	unitPath string
+}
+
+func newServiceManager() (serviceManager, error) {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return nil, errors.New("systemd (systemctl) is required to run as a service")
+	}
+	return &systemdManager{unitPath: filepath.Join(systemdUnitDir, serviceName+".service")}, nil
+}
+
+// enableServiceRestart has nothing to do: the unit restarts on any
+// non-zero exit.
+func enableServiceRestart() error {
+	return nil
+}
+
+// runAsService only matters on Windows; systemd runs "run" as a plain
+// process and stops it with SIGTERM.
+func runAsService(run func(stop <-chan struct{}) int) (int, bool) {
+	return 0, false
+}
+
+// systemdUnit renders the unit file for cfg.
+func systemdUnit(cfg serviceConfig) string {
+	execStart := []string{systemdQuote(cfg.Executable)}
+	for _, arg := range cfg.Args {
+		execStart = append(execStart, systemdQuote(arg))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by %s service install; reinstall rather than edit.\n", serviceName)
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s\n", serviceDescription)
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=simple\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(execStart, " "))
+	if cfg.User != "" {
+		fmt.Fprintf(&b, "User=%s\n", cfg.User)
+	}
+	b.WriteString("Restart=on-failure\n")
+	b.WriteString("RestartSec=5\n")
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// systemdQuote quotes a word for ExecStart when it contains spaces, quotes,
+// backslashes or the specifier character.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+func (m *systemdManager) Install(cfg serviceConfig) error {
+	if os.Geteuid() != 0 {
+		return errors.New("installing a service needs root, try again with sudo")
+	}
+
+	if err := os.WriteFile(m.unitPath, []byte(systemdUnit(cfg)), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", "--now", serviceName)
+}
+
+func (m *systemdManager) Uninstall() error {
+	if os.Geteuid() != 0 {
+		return errors.New("removing a service needs root, try again with sudo")
+	}
+	if _, err := os.Stat(m.unitPath); errors.Is(err, os.ErrNotExist) {
+		return errors.New("the service is not installed")
+	}
+
+	// Disabling fails harmlessly if the unit is already stopped or broken
+	systemctl("disable", "--now", serviceName)
+	if err := os.Remove(m.unitPath); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+func (m *systemdManager) Status() (string, bool, error) {
+	if _, err := os.Stat(m.unitPath); errors.Is(err, os.ErrNotExist) {
+		return "not installed", false, nil
+	}
+
+	// is-active exits non-zero for anything but "active", so only the
+	// output matters
+	out, _ := exec.Command("systemctl", "is-active", serviceName).Output()
+	state := strings.TrimSpace(string(out))
+	if state == "" {
+		return "", false, errors.New("systemctl is-active gave no answer")
+	}
+	return state, state == "active", nil
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func newServiceManager() (serviceManager, error) {
+	return nil, fmt.Errorf("installing as a service is not supported on %s", runtime.GOOS)
+}
+
+func enableServiceRestart() error {
+	return nil
+}
+
+func runAsService(run func(stop <-chan struct{}) int) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServiceRecordsDashboardPort(t *testing.T) {
+	app := newTestApp(t, closedPort(t), closedPort(t))
+	app.service = true
+	app.dataDir = t.TempDir()
+
+	ln, err := app.listenWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.webListener.Store(ln)
+	if info, ok := readServiceInfo(app.dataDir); !ok || info.Web != app.port() || info.PID != os.Getpid() {
+		t.Errorf("service info = %+v, want port %s", info, app.port())
+	}
+
+	app.stopWebServer()
+	if _, err := os.Stat(filepath.Join(app.dataDir, serviceInfoName)); !os.IsNotExist(err) {
+		t.Errorf("the service info outlived the dashboard: %v", err)
+	}
+}
+
+func TestFindRunningServiceUsesRecordedPort(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(StatusUpdate{Service: true})
+	}))
+	defer service.Close()
+	_, port, _ := net.SplitHostPort(service.Listener.Addr().String())
+	dataDir := t.TempDir()
+
+	if err := writeServiceInfo(dataDir, port); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := findRunningService(dataDir), "http://localhost:"+port; got != want {
+		t.Errorf("findRunningService = %q, want %q", got, want)
+	}
+
+	// A copy left behind by a service that crashed
+	_, stale, _ := net.SplitHostPort(closedPort(t))
+	if err := writeServiceInfo(dataDir, stale); err != nil {
+		t.Fatal(err)
+	}
+	if got := findRunningService(dataDir); got != "" {
+		t.Errorf("findRunningService = %q with the service gone, want none", got)
+	}
+}
+
+func TestInstallerSettingsPath(t *testing.T) {
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	t.Setenv("HOME", config)
+	t.Setenv("SUDO_USER", "")
+	if path, err := installerSettingsPath(); err != nil || !strings.HasPrefix(path, config) {
+		t.Errorf("installerSettingsPath() = %q, %v, want this user's settings", path, err)
+	}
+
+	if os.Geteuid() != 0 {
+		return
+	}
+	// Under sudo, root's settings are not the installing user's
+	t.Setenv("SUDO_USER", "nobody")
+	if path, err := installerSettingsPath(); err == nil || strings.HasPrefix(path, config) {
+		t.Errorf("installerSettingsPath() = %q, %v under sudo by a user without settings, want an error", path, err)
+	}
+}
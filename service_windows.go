@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// windowsManager registers the agent with the Service Control Manager as an
+// automatic-start service.
+type windowsManager struct{}
+
+func newServiceManager() (serviceManager, error) {
+	return windowsManager{}, nil
+}
+
+func (windowsManager) Install(cfg serviceConfig) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("can't reach the service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.New("the service is already installed, uninstall it first")
+	}
+
+	s, err := m.CreateService(serviceName, cfg.Executable, mgr.Config{
+		DisplayName:      serviceDisplayName,
+		Description:      serviceDescription,
+		StartType:        mgr.StartAutomatic,
+		ServiceStartName: cfg.User,
+	}, cfg.Args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Restart after a crash or a non-zero exit, like Restart=on-failure.
+	// The recovery actions alone only cover a crash: a service that stops
+	// with an exit code, as it does after giving up or updating itself,
+	// needs them turned on for non-crash failures too.
+	restart := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}
+	if err := s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		s.Delete()
+		return fmt.Errorf("can't set the service recovery actions: %w", err)
+	}
+	if err := s.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		s.Delete()
+		return fmt.Errorf("can't set the service recovery actions: %w", err)
+	}
+
+	return s.Start()
+}
+
+func (windowsManager) Uninstall() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("can't reach the service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.New("the service is not installed")
+	}
+	defer s.Close()
+
+	if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+		if _, err := s.Control(svc.Stop); err != nil {
+			slog.Warn("could not stop the service", "err", err)
+		}
+	}
+	return s.Delete()
+}
+
+func (windowsManager) Status() (string, bool, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", false, err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return "not installed", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer s.Close()
+
+	status, err := s.Query()
+	if err != nil {
+		return "", false, err
+	}
+
+	switch status.State {
+	case svc.Running:
+		return "running", true, nil
+	case svc.Stopped:
+		return "stopped", false, nil
+	case svc.StartPending:
+		return "starting", false, nil
+	case svc.StopPending:
+		return "stopping", false, nil
+	case svc.Paused, svc.PausePending, svc.ContinuePending:
+		return "paused", false, nil
+	}
+	return fmt.Sprintf("state %d", status.State), false, nil
+}
+
+// enableServiceRestart turns on the recovery actions for non-crash
+// failures, which services installed before they were set at install time
+// lack. Without it the service stays stopped after exiting with an update
+// or a give-up code.
+func enableServiceRestart() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if on, err := s.RecoveryActionsOnNonCrashFailures(); err == nil && on {
+		return nil
+	}
+	return s.SetRecoveryActionsOnNonCrashFailures(true)
+}
+
+// runAsService hands control to the Service Control Manager when Windows
+// started us as a service. It reports false when running from a console.
+func runAsService(run func(stop <-chan struct{}) int) (int, bool) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return 0, false
+	}
+
+	handler := &windowsService{run: run}
+	if err := svc.Run(serviceName, handler); err != nil {
+		slog.Error("service failed", "err", err)
+		return exitError, true
+	}
+	return handler.code, true
+}
+
+// windowsService adapts the headless engine to the service control protocol.
+type windowsService struct {
+	run  func(stop <-chan struct{}) int
+	code int
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan int, 1)
+	go func() {
+		done <- s.run(stop)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				s.code = <-done
+				return false, 0
+			}
+		case s.code = <-done:
+			// The engine stopped on its own: report its exit code so the
+			// recovery actions restart it
+			return s.code != exitOK, uint32(s.code)
+		}
+	}
+}
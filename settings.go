@@ -0,0 +1,567 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// settingsVersion is bumped whenever a section or field is added, and
+// migrateSettings upgrades older files on load. It tells a version that
+// can't keep a newer file's settings not to write over them.
+const settingsVersion = 10
+
+const (
+	appDirName       = "TatbeebLink"
+	settingsFileName = "settings.json"
+)
+
+type Settings struct {
+	Version       int                  `json:"version"`
+	Language      string               `json:"language"`
+	Relay         RelaySettings        `json:"relay"`
+	Tunnels       []TunnelSettings     `json:"tunnels"`
+	Startup       StartupSettings      `json:"startup"`
+	Policies      PolicySettings       `json:"policies"`
+	Logging       LoggingSettings      `json:"logging"`
+	Audit         AuditSettings        `json:"audit"`
+	Security      SecuritySettings     `json:"security"`
+	API           APISettings          `json:"api"`
+	Notifications NotificationSettings `json:"notifications"`
+	Update        UpdateSettings       `json:"update"`
+	Metrics       MetricsSettings      `json:"metrics"`
+}
+
+type RelaySettings struct {
+	// Endpoints are relay host:port pairs, tried in order until one accepts
+	// the connection. The host also names the shareable link.
+	Endpoints []string `json:"endpoints"`
+	// ReconnectAttempts limits how often a dropped tunnel is retried before
+	// giving up; 0 keeps retrying.
+	ReconnectAttempts int `json:"reconnectAttempts"`
+	// Token is sent to a self-hosted relay that only admits its own
+	// agents.
+	Token string `json:"token,omitempty"`
+}
+
+type TunnelSettings struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	// AutoConnect brings the tunnel up as soon as the app starts.
+	AutoConnect bool `json:"autoConnect"`
+}
+
+type StartupSettings struct {
+	OpenBrowser bool `json:"openBrowser"`
+	// SkipBrowserOnAutoConnect suppresses the dashboard when every
+	// auto-connect tunnel came up, so a rebooted PC starts quietly.
+	SkipBrowserOnAutoConnect bool `json:"skipBrowserOnAutoConnect"`
+}
+
+type PolicySettings struct {
+	// AllowRemoteTargets permits tunnels to hosts other than this machine,
+	// e.g. a SQL Server elsewhere on the clinic LAN.
+	AllowRemoteTargets bool `json:"allowRemoteTargets"`
+	// MaxStreams caps concurrent connections per tunnel; 0 means no limit.
+	MaxStreams int `json:"maxStreams"`
+}
+
+type LoggingSettings struct {
+	// Level is the least severe level written: debug, info, warn or error.
+	Level string `json:"level"`
+}
+
+type AuditSettings struct {
+	// RetentionDays is how long connection records are kept; 0 keeps them
+	// forever.
+	RetentionDays int `json:"retentionDays"`
+	// SignRecords signs every record with the device key, so a rewritten
+	// chain can't pass verification.
+	SignRecords bool `json:"signRecords"`
+}
+
+type NotificationSettings struct {
+	// Muted lists the events that don't show desktop notifications.
+	Muted []string `json:"muted"`
+}
+
+func (n NotificationSettings) muted(event string) bool {
+	return slices.Contains(n.Muted, event)
+}
+
+type UpdateSettings struct {
+	// FeedURL is the release manifest checked for new versions; empty turns
+	// update checks off.
+	FeedURL string `json:"feedUrl"`
+	// AutoInstall installs a new version as soon as it is found and
+	// restarts into it.
+	AutoInstall bool `json:"autoInstall"`
+}
+
+type MetricsSettings struct {
+	// Listen is an extra host:port that serves only /metrics, /healthz and
+	// /readyz, for a scraper on another machine; empty serves them on the
+	// dashboard port only. Changes apply after a restart.
+	Listen string `json:"listen,omitempty"`
+	// Allow lists the addresses and CIDR ranges that may scrape Listen
+	// without an API token. Others need a token with the status:read
+	// scope.
+	Allow []string `json:"allow"`
+}
+
+// allows reports whether a request from remoteAddr needs no API token.
+func (m MetricsSettings) allows(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range m.Allow {
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+			return true
+		}
+		if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type SecuritySettings struct {
+	// PINHash is the salted hash of the admin PIN that locks connecting,
+	// disconnecting, settings and the audit log; empty means no PIN. It is
+	// only changed through /api/pin and never sent to the dashboard.
+	PINHash string `json:"pinHash,omitempty"`
+}
+
+type APISettings struct {
+	// Tokens let scripts call the local API. They are only changed through
+	// /api/tokens.
+	Tokens []APIToken `json:"tokens"`
+}
+
+type APIToken struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is the SHA-256 of the secret, which is only shown once.
+	Hash    string    `json:"hash"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+}
+
+func defaultSettings() Settings {
+	return Settings{
+		Version:  settingsVersion,
+		Language: detectLanguage(),
+		Relay: RelaySettings{
+			Endpoints: []string{RelayServer},
+		},
+		Tunnels: []TunnelSettings{
+			{ID: "default", Name: "Database", Target: "9999"},
+		},
+		Startup: StartupSettings{
+			OpenBrowser: true,
+		},
+		Policies: PolicySettings{
+			AllowRemoteTargets: true,
+		},
+		Logging: LoggingSettings{
+			Level: "info",
+		},
+		Audit: AuditSettings{
+			RetentionDays: 365,
+			SignRecords:   true,
+		},
+	}
+}
+
+// clone returns a deep copy so callers can't mutate the store's slices.
+func (s Settings) clone() Settings {
+	c := s
+	c.Relay.Endpoints = append([]string(nil), s.Relay.Endpoints...)
+	c.Tunnels = append([]TunnelSettings(nil), s.Tunnels...)
+	c.Notifications.Muted = append([]string(nil), s.Notifications.Muted...)
+	c.Metrics.Allow = append([]string(nil), s.Metrics.Allow...)
+	c.API.Tokens = append([]APIToken(nil), s.API.Tokens...)
+	for i := range c.API.Tokens {
+		c.API.Tokens[i].Scopes = append([]string(nil), c.API.Tokens[i].Scopes...)
+	}
+	return c
+}
+
+func (s Settings) tunnel(id string) (TunnelSettings, bool) {
+	for _, t := range s.Tunnels {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return TunnelSettings{}, false
+}
+
+func (s Settings) validate() error {
+	if !isLanguage(s.Language) {
+		return fmt.Errorf("unsupported language %q", s.Language)
+	}
+
+	if len(s.Relay.Endpoints) == 0 {
+		return fmt.Errorf("at least one relay endpoint is required")
+	}
+	for _, endpoint := range s.Relay.Endpoints {
+		host, port, err := net.SplitHostPort(endpoint)
+		if err != nil || host == "" {
+			return fmt.Errorf("invalid relay endpoint %q: use host:port", endpoint)
+		}
+		if err := validatePort(port); err != nil {
+			return fmt.Errorf("invalid relay endpoint %q: %w", endpoint, err)
+		}
+	}
+
+	if len(s.Tunnels) == 0 {
+		return fmt.Errorf("at least one tunnel is required")
+	}
+	ids := make(map[string]bool)
+	for _, t := range s.Tunnels {
+		if t.ID == "" {
+			return fmt.Errorf("tunnel %q has no id", t.Name)
+		}
+		if ids[t.ID] {
+			return fmt.Errorf("duplicate tunnel id %q", t.ID)
+		}
+		ids[t.ID] = true
+		if t.Name == "" {
+			return fmt.Errorf("tunnel %s has no name", t.ID)
+		}
+		if err := s.Policies.checkTarget(t.Target); err != nil {
+			return fmt.Errorf("tunnel %q: %w", t.Name, err)
+		}
+	}
+
+	if err := validateRelayToken(s.Relay.Token); err != nil {
+		return err
+	}
+	if s.Relay.ReconnectAttempts < 0 {
+		return fmt.Errorf("reconnectAttempts cannot be negative")
+	}
+	if s.Policies.MaxStreams < 0 {
+		return fmt.Errorf("maxStreams cannot be negative")
+	}
+	if !slices.Contains(logLevels, s.Logging.Level) {
+		return fmt.Errorf("unsupported log level %q", s.Logging.Level)
+	}
+	if s.Audit.RetentionDays < 0 {
+		return fmt.Errorf("retentionDays cannot be negative")
+	}
+	for _, event := range s.Notifications.Muted {
+		if !slices.Contains(notificationEvents, event) {
+			return fmt.Errorf("unknown notification event %q", event)
+		}
+	}
+	if s.Update.FeedURL != "" {
+		if err := checkUpdateURL(s.Update.FeedURL); err != nil {
+			return err
+		}
+	}
+	if s.Metrics.Listen != "" {
+		_, port, err := net.SplitHostPort(s.Metrics.Listen)
+		if err != nil {
+			return fmt.Errorf("invalid metrics address %q: use host:port", s.Metrics.Listen)
+		}
+		if err := validatePort(port); err != nil {
+			return fmt.Errorf("invalid metrics address %q: %w", s.Metrics.Listen, err)
+		}
+	}
+	for _, entry := range s.Metrics.Allow {
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid metrics allow entry %q: use an address or a CIDR range", entry)
+		}
+	}
+	for _, token := range s.API.Tokens {
+		if token.Name == "" {
+			return fmt.Errorf("API token %s has no name", token.ID)
+		}
+		if len(token.Scopes) == 0 {
+			return fmt.Errorf("API token %q has no scopes", token.Name)
+		}
+		for _, scope := range token.Scopes {
+			if !slices.Contains(apiScopes, scope) {
+				return fmt.Errorf("API token %q: unknown scope %q", token.Name, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// checkTarget validates a tunnel target against the policy.
+func (p PolicySettings) checkTarget(target string) error {
+	host, _, _, err := parseTarget(target)
+	if err != nil {
+		return err
+	}
+	if !p.AllowRemoteTargets && !isLocalHost(host) {
+		return fmt.Errorf("target %s is not on this machine and remote targets are disabled", target)
+	}
+	return nil
+}
+
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// migrateSettings upgrades settings written by older versions in place.
+func migrateSettings(s *Settings) {
+	if s.Version < 1 {
+		// Files without a version predate the field; nothing else changed.
+		s.Version = 1
+	}
+	if s.Version < 2 {
+		// v2 added logging
+		s.Logging.Level = "info"
+		s.Version = 2
+	}
+	if s.Version < 3 {
+		// v3 added the audit log
+		s.Audit.RetentionDays = 365
+		s.Version = 3
+	}
+	if s.Version < 4 {
+		// v4 added audit signatures
+		s.Audit.SignRecords = true
+		s.Version = 4
+	}
+	if s.Version < 5 {
+		// v5 added the admin PIN; none is set
+		s.Version = 5
+	}
+	if s.Version < 6 {
+		// v6 added API tokens; none exist
+		s.Version = 6
+	}
+	if s.Version < 7 {
+		// v7 added notifications; none are muted
+		s.Version = 7
+	}
+	if s.Version < 8 {
+		// v8 added updates; no feed is configured
+		s.Version = 8
+	}
+	if s.Version < 9 {
+		// v9 added the relay token; the Tatbeeb relay needs none
+		s.Version = 9
+	}
+	if s.Version < 10 {
+		// v10 added the metrics address; metrics stay on the dashboard
+		s.Version = 10
+	}
+}
+
+// dropUnknown removes the values of a newer version's settings that this
+// version doesn't know, so the rest can still be used. It returns what was
+// left out.
+func (s *Settings) dropUnknown() []string {
+	var dropped []string
+	if !slices.Contains(logLevels, s.Logging.Level) {
+		dropped = append(dropped, "log level "+s.Logging.Level)
+		s.Logging.Level = "info"
+	}
+	s.Notifications.Muted = slices.DeleteFunc(s.Notifications.Muted, func(event string) bool {
+		if slices.Contains(notificationEvents, event) {
+			return false
+		}
+		dropped = append(dropped, "notification event "+event)
+		return true
+	})
+	for i := range s.API.Tokens {
+		token := &s.API.Tokens[i]
+		token.Scopes = slices.DeleteFunc(token.Scopes, func(scope string) bool {
+			if slices.Contains(apiScopes, scope) {
+				return false
+			}
+			dropped = append(dropped, fmt.Sprintf("scope %s of API token %q", scope, token.Name))
+			return true
+		})
+	}
+	// A token left without scopes can do nothing here
+	s.API.Tokens = slices.DeleteFunc(s.API.Tokens, func(token APIToken) bool {
+		return len(token.Scopes) == 0
+	})
+	return dropped
+}
+
+// errSettingsNewer refuses changes to settings written by a newer version:
+// saving them would lose what this version doesn't know.
+var errSettingsNewer = errors.New("the settings were saved by a newer version of Tatbeeb Link and can't be changed by this one, update it first")
+
+// SettingsStore holds the current settings and persists every change. A
+// store without a path keeps changes in memory only.
+type SettingsStore struct {
+	path     string
+	mu       sync.RWMutex
+	settings Settings
+	// readOnly is set for a file written by a newer version
+	readOnly bool
+}
+
+// appDataDir returns the per-user directory for settings and other state,
+// creating it if needed.
+func appDataDir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, appDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// settingsPath returns configPath, or the settings file in the user's config
+// directory when it is empty.
+func settingsPath(configPath string) (string, error) {
+	if configPath != "" {
+		return configPath, nil
+	}
+	dir, err := appDataDir()
+	if err != nil {
+		return "", fmt.Errorf("no settings directory: %w", err)
+	}
+	return filepath.Join(dir, settingsFileName), nil
+}
+
+// loadSettings reads the settings file at path. A missing file yields the
+// defaults. A file that can't be used is left alone and reported, since
+// replacing it would lose the tunnels, the PIN and the API tokens. A file
+// written by a newer version is used as far as this version understands it,
+// and never written.
+func loadSettings(path string) (*SettingsStore, error) {
+	// The settings may pick a language added next to them
+	loadLocaleDir(filepath.Join(filepath.Dir(path), localeDirName))
+	store := &SettingsStore{path: path, settings: defaultSettings()}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("no settings file, using defaults", "path", path)
+		return store, store.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Settings
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("the settings file %s is damaged, fix or delete it: %w", path, err)
+	}
+	if s.Version > settingsVersion {
+		slog.Warn("settings were saved by a newer version, they can't be changed until it is installed again", "version", s.Version, "supported", settingsVersion)
+		store.readOnly = true
+		if dropped := s.dropUnknown(); len(dropped) > 0 {
+			slog.Warn("ignoring settings this version doesn't know", "settings", dropped)
+		}
+	}
+	migrateSettings(&s)
+	if !isLanguage(s.Language) {
+		slog.Warn("language is not available, using the system language", "language", s.Language)
+		s.Language = detectLanguage()
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("the settings file %s is invalid, fix or delete it: %w", path, err)
+	}
+
+	store.settings = s
+	slog.Info("loaded settings", "path", path)
+	return store, nil
+}
+
+// newMemorySettings returns a store that is never written to disk, used when
+// command-line flags override the saved settings for one run.
+func newMemorySettings(settings Settings) (*SettingsStore, error) {
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	return &SettingsStore{settings: settings}, nil
+}
+
+func (s *SettingsStore) Get() Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.settings.clone()
+}
+
+// Update applies fn to a copy of the settings, validates the result and
+// saves it. Nothing changes if fn or validation fails.
+func (s *SettingsStore) Update(fn func(*Settings) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return errSettingsNewer
+	}
+
+	next := s.settings.clone()
+	if err := fn(&next); err != nil {
+		return err
+	}
+	next.Version = settingsVersion
+	if err := next.validate(); err != nil {
+		return err
+	}
+
+	prev := s.settings
+	s.settings = next
+	if err := s.save(); err != nil {
+		s.settings = prev
+		return err
+	}
+	return nil
+}
+
+// save writes the settings atomically. Callers hold the lock, except during
+// loading when the store isn't shared yet.
+func (s *SettingsStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.settings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), settingsFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	chownData(tmp.Name())
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func newID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
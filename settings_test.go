@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSettingsFile saves s as the settings file of a fresh directory.
+func writeSettingsFile(t *testing.T, s any) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), settingsFileName)
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSettingsMigrates(t *testing.T) {
+	// A file from before the audit log, with a PIN set by hand
+	path := writeSettingsFile(t, map[string]any{
+		"version":  2,
+		"language": "en",
+		"relay":    map[string]any{"endpoints": []string{"relay.example.org:8443"}},
+		"tunnels":  []map[string]any{{"id": "db", "name": "Database", "target": "1433"}},
+		"logging":  map[string]any{"level": "warn"},
+		"security": map[string]any{"pinHash": "hash"},
+	})
+
+	store, err := loadSettings(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	s := store.Get()
+	if s.Version != settingsVersion || s.Audit.RetentionDays != 365 || !s.Audit.SignRecords {
+		t.Errorf("settings = %+v, want migrated to version %d with the audit defaults", s, settingsVersion)
+	}
+	if s.Logging.Level != "warn" || s.Security.PINHash != "hash" {
+		t.Errorf("settings = %+v, lost saved values", s)
+	}
+}
+
+func TestLoadSettingsKeepsInvalidFile(t *testing.T) {
+	for name, content := range map[string]string{
+		"damaged": `{"version": 9, "tunnels": [`,
+		"invalid": `{"version": 9, "language": "en", "relay": {"endpoints": []}, "security": {"pinHash": "hash"}}`,
+	} {
+		path := filepath.Join(t.TempDir(), settingsFileName)
+		os.WriteFile(path, []byte(content), 0600)
+
+		if _, err := loadSettings(path); err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: error = %v, want one naming the file", name, err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != content {
+			t.Errorf("%s: the settings file was replaced with %s", name, data)
+		}
+	}
+}
+
+func TestLoadSettingsFromNewerVersion(t *testing.T) {
+	newer := map[string]any{
+		"version":       settingsVersion + 1,
+		"language":      "en",
+		"relay":         map[string]any{"endpoints": []string{"relay.example.org:8443"}, "proxy": "socks5://proxy:1080"},
+		"tunnels":       []map[string]any{{"id": "db", "name": "Database", "target": "1433"}},
+		"logging":       map[string]any{"level": "trace"},
+		"notifications": map[string]any{"muted": []string{EventTunnelDown, "certificateExpiring"}},
+		"security":      map[string]any{"pinHash": "hash"},
+		"api": map[string]any{"tokens": []map[string]any{
+			{"id": "a", "name": "monitoring", "hash": "h1", "scopes": []string{ScopeStatus, "audit:read"}},
+			{"id": "b", "name": "export", "hash": "h2", "scopes": []string{"audit:read"}},
+		}},
+	}
+	path := writeSettingsFile(t, newer)
+	before, _ := os.ReadFile(path)
+
+	store, err := loadSettings(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	s := store.Get()
+	if s.Logging.Level != "info" || len(s.Notifications.Muted) != 1 || s.Security.PINHash != "hash" {
+		t.Errorf("settings = %+v, want unknown values left out and the rest kept", s)
+	}
+	if len(s.API.Tokens) != 1 || len(s.API.Tokens[0].Scopes) != 1 {
+		t.Errorf("API tokens = %+v, want monitoring with status access only", s.API.Tokens)
+	}
+
+	err = store.Update(func(s *Settings) error {
+		s.Language = "ar"
+		return nil
+	})
+	if !errors.Is(err, errSettingsNewer) {
+		t.Errorf("Update = %v, want errSettingsNewer", err)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Error("the newer version's settings file was rewritten")
+	}
+}
+
+func TestSettingsAPIHidesRelayToken(t *testing.T) {
+	app := newTestApp(t, closedPort(t), closedPort(t))
+	if err := app.settings.Update(func(s *Settings) error {
+		s.Relay.Token = "relay-secret"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(method string, body any) map[string]any {
+		t.Helper()
+		var req *http.Request
+		if body != nil {
+			data, _ := json.Marshal(body)
+			req = httptest.NewRequest(method, "/api/settings", bytes.NewReader(data))
+		} else {
+			req = httptest.NewRequest(method, "/api/settings", nil)
+		}
+		rec := httptest.NewRecorder()
+		app.handleSettings(rec, req)
+		if strings.Contains(rec.Body.String(), "relay-secret") {
+			t.Errorf("%s /api/settings returned the relay token: %s", method, rec.Body)
+		}
+		var result map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return result
+	}
+
+	result := call(http.MethodGet, nil)
+	if result["relayTokenSet"] != true {
+		t.Errorf("relayTokenSet = %v, want true", result["relayTokenSet"])
+	}
+
+	// The dashboard sends the settings back with the token empty
+	next := app.settings.Get()
+	next.Relay.Token = ""
+	next.Language = "ar"
+	call(http.MethodPost, next)
+	if s := app.settings.Get(); s.Relay.Token != "relay-secret" || s.Language != "ar" {
+		t.Errorf("after saving: token %q, language %q, want the token kept", s.Relay.Token, s.Language)
+	}
+
+	call(http.MethodPost, map[string]any{
+		"version": next.Version, "language": "ar", "relay": next.Relay, "tunnels": next.Tunnels,
+		"logging": next.Logging, "clearRelayToken": true,
+	})
+	if s := app.settings.Get(); s.Relay.Token != "" {
+		t.Errorf("token %q after clearing it", s.Relay.Token)
+	}
+}
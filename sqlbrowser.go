@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQL Server Browser (SSRP) client.
+//
+// Named instances such as SQLEXPRESS usually listen on a dynamic TCP port that
+// changes whenever the service restarts. The SQL Server Browser service answers
+// on UDP 1434 with the port each instance is currently listening on, so a
+// tunnel target written as host\INSTANCE is resolved through it before every
+// dial instead of being pinned to a port.
+
+const (
+	sqlBrowserPort    = "1434"
+	sqlDefaultPort    = "1433"
+	sqlBrowserTimeout = 2 * time.Second
+
+	ssrpBroadcastEx = 0x02 // CLNT_BCAST_EX: every instance on every host
+	ssrpUnicastEx   = 0x03 // CLNT_UCAST_EX: every instance on one host
+	ssrpUnicastInst = 0x04 // CLNT_UCAST_INST: one named instance on one host
+	ssrpResponse    = 0x05 // SVR_RESP
+
+	ssrpMaxInstanceName = 32
+)
+
+// SQLInstance is one SQL Server instance advertised by a Browser service.
+type SQLInstance struct {
+	Server    string `json:"server"`
+	Instance  string `json:"instance"`
+	Version   string `json:"version"`
+	Clustered bool   `json:"clustered"`
+	TCPPort   string `json:"tcpPort"`
+	Address   string `json:"address"`
+}
+
+// Target returns the tunnel target that reaches this instance through the
+// Browser service, e.g. "192.168.1.20\SQLEXPRESS". The default instance is
+// reached by its port, 1433 unless the Browser service reports another.
+func (i SQLInstance) Target() string {
+	host := i.Address
+	if host == "" {
+		host = i.Server
+	}
+	if i.Instance == "" || strings.EqualFold(i.Instance, "MSSQLSERVER") {
+		port := i.TCPPort
+		if port == "" {
+			port = sqlDefaultPort
+		}
+		return net.JoinHostPort(host, port)
+	}
+	return host + `\` + i.Instance
+}
+
+// parseTarget splits a tunnel target into its parts. A target is a bare port
+// ("9999", meaning localhost), a host:port pair, or a SQL Server named
+// instance ("host\INSTANCE", with "." or "(local)" meaning localhost).
+// LocalDB instances can't be reached over TCP and are refused.
+func parseTarget(target string) (host, port, instance string, err error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return "", "", "", fmt.Errorf("target is empty")
+	}
+
+	if host, instance, ok := strings.Cut(target, `\`); ok {
+		if instance == "" || len(instance) > ssrpMaxInstanceName {
+			return "", "", "", fmt.Errorf("invalid instance name in %q", target)
+		}
+		switch strings.ToLower(host) {
+		case "", ".", "(local)":
+			host = "localhost"
+		case "(localdb)":
+			// LocalDB listens on a named pipe only and isn't registered
+			// with the SQL Server Browser
+			return "", "", "", fmt.Errorf("%s is a LocalDB instance, which only accepts local named pipe connections: use a SQL Server Express or full instance with TCP enabled", target)
+		}
+		return host, "", instance, nil
+	}
+
+	if _, err := strconv.Atoi(target); err == nil {
+		if err := validatePort(target); err != nil {
+			return "", "", "", err
+		}
+		return "localhost", target, "", nil
+	}
+
+	host, port, err = net.SplitHostPort(target)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid target %q: use a port, host:port or host\\INSTANCE", target)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if err := validatePort(port); err != nil {
+		return "", "", "", err
+	}
+	return host, port, "", nil
+}
+
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q (1-65535)", port)
+	}
+	return nil
+}
+
+// resolveTarget turns a tunnel target into a dialable address. Named
+// instances are looked up through the SQL Server Browser on every call so a
+// port change after a service restart is picked up by the next stream.
+func resolveTarget(target string) (string, error) {
+	host, port, instance, err := parseTarget(target)
+	if err != nil {
+		return "", err
+	}
+	if instance != "" {
+		port, err = resolveSQLInstance(host, instance)
+		if err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// resolveSQLInstance asks the Browser service on host for the TCP port of a
+// named instance.
+func resolveSQLInstance(host, instance string) (string, error) {
+	req := append([]byte{ssrpUnicastInst}, instance...)
+	req = append(req, 0)
+
+	instances, err := querySQLBrowser(host, req)
+	if err != nil {
+		return "", fmt.Errorf("SQL Server Browser on %s: %w", host, err)
+	}
+	for _, inst := range instances {
+		if !strings.EqualFold(inst.Instance, instance) {
+			continue
+		}
+		if inst.TCPPort == "" {
+			return "", fmt.Errorf("instance %s\\%s has TCP/IP disabled", host, instance)
+		}
+		return inst.TCPPort, nil
+	}
+	return "", fmt.Errorf("instance %s\\%s not found", host, instance)
+}
+
+// listSQLInstances returns every instance the Browser service on host knows.
+func listSQLInstances(host string) ([]SQLInstance, error) {
+	return querySQLBrowser(host, []byte{ssrpUnicastEx})
+}
+
+// discoverSQLInstances broadcasts on the local network and also asks the local
+// machine directly, since a broadcast is not always looped back.
+func discoverSQLInstances() ([]SQLInstance, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	targets := []string{"255.255.255.255", "127.0.0.1"}
+	for _, host := range targets {
+		addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, sqlBrowserPort))
+		if err != nil {
+			return nil, err
+		}
+		req := []byte{ssrpBroadcastEx}
+		if host == "127.0.0.1" {
+			req = []byte{ssrpUnicastEx}
+		}
+		if _, err := conn.WriteToUDP(req, addr); err != nil {
+			slog.Warn("SQL Server Browser query failed", "host", host, "err", err)
+		}
+	}
+
+	var found []SQLInstance
+	seen := make(map[string]bool)
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(sqlBrowserTimeout))
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// The deadline ends collection; anything else is a real error only
+			// if nothing was collected at all.
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if len(found) == 0 {
+				return nil, err
+			}
+			break
+		}
+		instances, err := parseSSRPResponse(buf[:n], from.IP.String())
+		if err != nil {
+			slog.Warn("ignoring malformed SQL Server Browser reply", "from", from.String(), "err", err)
+			continue
+		}
+		for _, inst := range instances {
+			key := strings.ToLower(inst.Server + `\` + inst.Instance)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			found = append(found, inst)
+		}
+	}
+	return found, nil
+}
+
+func querySQLBrowser(host string, req []byte) ([]SQLInstance, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(host, sqlBrowserPort), sqlBrowserTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(sqlBrowserTimeout))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, fmt.Errorf("no reply (is the SQL Server Browser service running?)")
+		}
+		return nil, err
+	}
+	return parseSSRPResponse(buf[:n], host)
+}
+
+// parseSSRPResponse decodes an SVR_RESP datagram. The payload is a list of
+// "key;value;" pairs per instance, with instances separated by ";;".
+func parseSSRPResponse(resp []byte, address string) ([]SQLInstance, error) {
+	if len(resp) < 3 || resp[0] != ssrpResponse {
+		return nil, fmt.Errorf("not an SSRP response")
+	}
+	size := int(binary.LittleEndian.Uint16(resp[1:3]))
+	data := resp[3:]
+	if size < len(data) {
+		data = data[:size]
+	}
+	data = bytes.TrimRight(data, "\x00")
+
+	var instances []SQLInstance
+	for _, block := range strings.Split(string(data), ";;") {
+		if strings.TrimSpace(block) == "" {
+			continue
+		}
+		fields := strings.Split(block, ";")
+		inst := SQLInstance{Address: address}
+		for i := 0; i+1 < len(fields); i += 2 {
+			value := fields[i+1]
+			switch strings.ToLower(fields[i]) {
+			case "servername":
+				inst.Server = value
+			case "instancename":
+				inst.Instance = value
+			case "version":
+				inst.Version = value
+			case "isclustered":
+				inst.Clustered = strings.EqualFold(value, "yes")
+			case "tcp":
+				inst.TCPPort = value
+			}
+		}
+		if inst.Instance == "" {
+			continue
+		}
+		instances = append(instances, inst)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("response lists no instances")
+	}
+	return instances, nil
+}
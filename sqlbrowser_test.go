@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target               string
+		host, port, instance string
+		wantErr              string
+	}{
+		{target: "9999", host: "localhost", port: "9999"},
+		{target: "db.clinic.local:1433", host: "db.clinic.local", port: "1433"},
+		{target: ":1433", host: "localhost", port: "1433"},
+		{target: `.\SQLEXPRESS`, host: "localhost", instance: "SQLEXPRESS"},
+		{target: `(local)\SQLEXPRESS`, host: "localhost", instance: "SQLEXPRESS"},
+		{target: `SERVER\HIS`, host: "SERVER", instance: "HIS"},
+		{target: `(localdb)\MSSQLLocalDB`, wantErr: "LocalDB"},
+		{target: `(LocalDB)\v11.0`, wantErr: "LocalDB"},
+		{target: `SERVER\`, wantErr: "invalid instance name"},
+		{target: "70000", wantErr: "invalid port"},
+		{target: "", wantErr: "empty"},
+	}
+	for _, tt := range tests {
+		host, port, instance, err := parseTarget(tt.target)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseTarget(%q) error = %v, want one about %q", tt.target, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || host != tt.host || port != tt.port || instance != tt.instance {
+			t.Errorf("parseTarget(%q) = %q, %q, %q, %v, want %q, %q, %q", tt.target, host, port, instance, err, tt.host, tt.port, tt.instance)
+		}
+	}
+}
+
+func TestSQLInstanceTarget(t *testing.T) {
+	tests := []struct {
+		inst SQLInstance
+		want string
+	}{
+		{SQLInstance{Server: "SERVER", Instance: "SQLEXPRESS", TCPPort: "49702", Address: "192.168.1.20"}, `192.168.1.20\SQLEXPRESS`},
+		{SQLInstance{Server: "SERVER", Instance: "HIS"}, `SERVER\HIS`},
+		{SQLInstance{Server: "SERVER", Instance: "MSSQLSERVER", TCPPort: "1500", Address: "192.168.1.20"}, "192.168.1.20:1500"},
+		// No tcp entry in the Browser reply
+		{SQLInstance{Server: "SERVER", Instance: "MSSQLSERVER", Address: "192.168.1.20"}, "192.168.1.20:1433"},
+	}
+	for _, tt := range tests {
+		if got := tt.inst.Target(); got != tt.want {
+			t.Errorf("%+v.Target() = %q, want %q", tt.inst, got, tt.want)
+		}
+	}
+}
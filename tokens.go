@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API token scopes.
+const (
+	// ScopeStatus reads tunnel status, logs, instances and metrics.
+	ScopeStatus = "status:read"
+	// ScopeTunnels starts and stops tunnels.
+	ScopeTunnels = "tunnels:control"
+	// ScopeSettings reads and changes settings and exports the audit log.
+	ScopeSettings = "settings:manage"
+)
+
+var apiScopes = []string{ScopeStatus, ScopeTunnels, ScopeSettings}
+
+// apiTokenPrefix marks secrets as Tatbeeb Link tokens, which makes leaked
+// ones easy to spot.
+const apiTokenPrefix = "tlk_"
+
+type apiTokenKey struct{}
+
+var errUnknownToken = errors.New("unknown API token")
+
+// access maps the methods a route accepts to the scope an API token needs
+// for them. An empty scope means API tokens can't be used.
+type access map[string]string
+
+func newAPISecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return apiTokenPrefix + hex.EncodeToString(b)
+}
+
+func hashAPISecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiToken returns the token an "Authorization: Bearer" header names.
+func (a *App) apiToken(header string) (APIToken, bool) {
+	secret, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return APIToken{}, false
+	}
+	hash := []byte(hashAPISecret(strings.TrimSpace(secret)))
+	for _, token := range a.settings.Get().API.Tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(token.Hash)) == 1 {
+			return token, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// requestToken returns the API token a request was made with, if any.
+func requestToken(r *http.Request) (APIToken, bool) {
+	token, ok := r.Context().Value(apiTokenKey{}).(APIToken)
+	return token, ok
+}
+
+// serveToken runs an API token's call and records it in the audit log.
+func (a *App) serveToken(w http.ResponseWriter, r *http.Request, h http.HandlerFunc, token APIToken) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	h(rec, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)))
+	a.recordTokenUse(token, r, start, rec.status)
+}
+
+// recordTokenUse writes the audit record of a call made with token,
+// including calls refused for lack of scope.
+func (a *App) recordTokenUse(token APIToken, r *http.Request, start time.Time, status int) {
+	a.tokenUse.touch(token.ID, start)
+	a.audit.Record(AuditRecord{
+		Opened:    start,
+		Closed:    time.Now(),
+		Event:     AuditAPICall,
+		TokenID:   token.ID,
+		TokenName: token.Name,
+		Request:   r.Method + " " + r.URL.RequestURI(),
+		Reason:    fmt.Sprintf("%d %s", status, http.StatusText(status)),
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// tokenUsage remembers when each token was last used. It is kept in memory
+// so scripts polling the API don't rewrite the settings file.
+type tokenUsage struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func (u *tokenUsage) touch(id string, t time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.used == nil {
+		u.used = make(map[string]time.Time)
+	}
+	u.used[id] = t
+}
+
+func (u *tokenUsage) lastUsed(id string) (time.Time, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	t, ok := u.used[id]
+	return t, ok
+}
+
+// TokenInfo is an API token as listed by /api/tokens, without its hash.
+type TokenInfo struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+// handleTokens lists the API tokens, and on POST {"name", "scopes"} creates
+// one. The secret is only returned by the POST that creates it.
+func (a *App) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		a.createToken(w, r)
+		return
+	}
+
+	tokens := []TokenInfo{}
+	for _, token := range a.settings.Get().API.Tokens {
+		info := TokenInfo{ID: token.ID, Name: token.Name, Scopes: token.Scopes, Created: token.Created}
+		if used, ok := a.tokenUse.lastUsed(token.ID); ok {
+			info.LastUsed = &used
+		}
+		tokens = append(tokens, info)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"tokens":  tokens,
+		"scopes":  apiScopes,
+	})
+}
+
+func (a *App) createToken(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
+		return
+	}
+
+	secret := newAPISecret()
+	token := APIToken{
+		ID:      newID(),
+		Name:    strings.TrimSpace(req.Name),
+		Hash:    hashAPISecret(secret),
+		Scopes:  req.Scopes,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	err := a.settings.Update(func(s *Settings) error {
+		s.API.Tokens = append(s.API.Tokens, token)
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidToken", err))
+		return
+	}
+	slog.Info("API token created", "tokenId", token.ID, "name", token.Name, "scopes", token.Scopes)
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"success": true,
+		"token":   TokenInfo{ID: token.ID, Name: token.Name, Scopes: token.Scopes, Created: token.Created},
+		"secret":  secret,
+	})
+}
+
+// handleRevokeToken deletes the token {"id": ...}.
+func (a *App) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
+		return
+	}
+
+	var name string
+	err := a.settings.Update(func(s *Settings) error {
+		i := slices.IndexFunc(s.API.Tokens, func(t APIToken) bool { return t.ID == req.ID })
+		if i < 0 {
+			return errUnknownToken
+		}
+		name = s.API.Tokens[i].Name
+		s.API.Tokens = slices.Delete(s.API.Tokens, i, i+1)
+		return nil
+	})
+	if errors.Is(err, errUnknownToken) {
+		writeError(w, http.StatusNotFound, a.tr(r, "api.unknownToken", req.ID))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, a.tr(r, "api.revokeFailed", err))
+		return
+	}
+	slog.Info("API token revoked", "tokenId", req.ID, "name", name)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
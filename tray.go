@@ -0,0 +1,463 @@
+//go:build !notray && (windows || cgo)
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/systray"
+)
+
+// maxTrayTunnels is how many tunnels get a submenu. The tray library can't
+// insert items later, so the submenus are made up front and shown as
+// tunnels are added.
+const maxTrayTunnels = 10
+
+// maxTooltipLength is the longest tooltip Windows shows.
+const maxTooltipLength = 127
+
+var trayStateKeys = map[string]string{
+	StateConnected:    "tray.stateConnected",
+	StateConnecting:   "tray.stateConnecting",
+	StateReconnecting: "tray.stateReconnecting",
+	StateDisconnected: "tray.stateDisconnected",
+}
+
+// trayMenu holds the tray menu items.
+type trayMenu struct {
+	mStatus *systray.MenuItem
+	mCopy   *systray.MenuItem
+	// mConnect and mDisconnect are shown when there is a single tunnel,
+	// the submenus when there are more
+	mConnect    *systray.MenuItem
+	mDisconnect *systray.MenuItem
+	tunnels     []*trayTunnel
+	mPause      *systray.MenuItem
+	mOpen       *systray.MenuItem
+	mLogs       *systray.MenuItem
+	mVersion    *systray.MenuItem
+	mQuit       *systray.MenuItem
+
+	// mu guards statuses, which the click handlers act on
+	mu       sync.Mutex
+	statuses []TunnelStatus
+
+	// icon is the badge and count the icon shows
+	icon string
+	// traffic holds each tunnel's byte counts when last sampled, to work
+	// out the throughput
+	traffic map[string][2]int64
+	sampled time.Time
+}
+
+// trayTunnel is the submenu of one tunnel.
+type trayTunnel struct {
+	item        *systray.MenuItem
+	mConnect    *systray.MenuItem
+	mDisconnect *systray.MenuItem
+	mCopy       *systray.MenuItem
+	shown       bool
+}
+
+// runTray shows the tray icon and blocks until the user chooses Exit.
+func runTray(app *App) error {
+	systray.Run(app.onReady, app.onExit)
+	return nil
+}
+
+func (a *App) onReady() {
+	systray.SetIcon(trayIcon(badgeNone, 0))
+	systray.SetTitle("Tatbeeb Link")
+	systray.SetTooltip(a.trayText("tray.tooltip"))
+
+	menu := &trayMenu{}
+
+	// Create menu items
+	menu.mStatus = systray.AddMenuItem(a.trayText("tray.disconnected"), a.trayText("tray.statusHint"))
+	menu.mStatus.Disable()
+	menu.mCopy = systray.AddMenuItem(a.trayText("tray.copyLink"), a.trayText("tray.copyLinkHint"))
+	menu.mCopy.Disable()
+
+	systray.AddSeparator()
+
+	menu.mConnect = systray.AddMenuItem(a.trayText("tray.connect"), a.trayText("tray.connectHint"))
+	menu.mDisconnect = systray.AddMenuItem(a.trayText("tray.disconnect"), a.trayText("tray.disconnectHint"))
+	for i := 0; i < maxTrayTunnels; i++ {
+		tt := &trayTunnel{item: systray.AddMenuItem("", "")}
+		tt.mConnect = tt.item.AddSubMenuItem(a.trayText("tray.connect"), a.trayText("tray.connectHint"))
+		tt.mDisconnect = tt.item.AddSubMenuItem(a.trayText("tray.disconnect"), a.trayText("tray.disconnectHint"))
+		tt.mCopy = tt.item.AddSubMenuItem(a.trayText("tray.copyLink"), a.trayText("tray.copyLinkHint"))
+		tt.item.Hide()
+		menu.tunnels = append(menu.tunnels, tt)
+	}
+	menu.mPause = systray.AddMenuItem(a.trayText("tray.pause"), a.trayText("tray.pauseHint"))
+
+	systray.AddSeparator()
+
+	menu.mOpen = systray.AddMenuItem(a.trayText("tray.open"), a.trayText("tray.openHint"))
+	menu.mLogs = systray.AddMenuItem(a.trayText("tray.logs"), a.trayText("tray.logsHint"))
+
+	systray.AddSeparator()
+
+	menu.mVersion = systray.AddMenuItem(a.trayText("tray.version", build.Version), build.String())
+	menu.mVersion.Disable()
+	menu.mQuit = systray.AddMenuItem(a.trayText("tray.exit"), a.trayText("tray.exitHint"))
+
+	// Attached to the system service: it owns the tunnels and dashboard
+	if a.viewerURL == "" {
+		a.startBackground()
+	}
+
+	// Handle menu clicks
+	onClick(menu.mCopy, func() { a.copyTrayLink(menu.status(-1)) })
+	onClick(menu.mConnect, func() { a.trayConnect(menu.status(0)) })
+	onClick(menu.mDisconnect, func() { a.trayDisconnect(menu.status(0)) })
+	for i, tt := range menu.tunnels {
+		i := i
+		onClick(tt.mConnect, func() { a.trayConnect(menu.status(i)) })
+		onClick(tt.mDisconnect, func() { a.trayDisconnect(menu.status(i)) })
+		onClick(tt.mCopy, func() { a.copyTrayLink(menu.status(i)) })
+	}
+	onClick(menu.mPause, func() {
+		if a.isPaused() {
+			a.resumeTunnels()
+		} else {
+			a.pauseTunnels()
+		}
+	})
+	onClick(menu.mOpen, func() { openBrowser(a.dashboardURL()) })
+	onClick(menu.mLogs, func() { openBrowser(a.dashboardURL() + "/#logs") })
+	onClick(menu.mQuit, systray.Quit)
+
+	// Keep the menu in step with the tunnels
+	go a.updateTrayStatus(menu)
+
+	// An installed update restarts the app; runDefault starts the new copy
+	go func() {
+		<-a.updates.installed
+		systray.Quit()
+	}()
+}
+
+// onClick runs fn for every click on item.
+func onClick(item *systray.MenuItem, fn func()) {
+	go func() {
+		for range item.ClickedCh {
+			fn()
+		}
+	}()
+}
+
+func (a *App) onExit() {
+	slog.Info("Tatbeeb Link shutting down")
+	a.stopAllTunnels()
+}
+
+// status returns the tunnel shown at index i of the menu, or for i < 0 the
+// first connected one. ok is false when there is none.
+func (m *trayMenu) status(i int) (TunnelStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i < 0 {
+		for _, status := range m.statuses {
+			if status.Connected && status.ShareableLink != "" {
+				return status, true
+			}
+		}
+		return TunnelStatus{}, false
+	}
+	if i >= len(m.statuses) {
+		return TunnelStatus{}, false
+	}
+	return m.statuses[i], true
+}
+
+func (a *App) trayConnect(status TunnelStatus, ok bool) {
+	t := a.tunnel(status.ID)
+	if !ok || t == nil || a.trayLocked() != "" {
+		return
+	}
+	if _, err := t.Start(); err != nil {
+		t.logger().Warn("connecting from the tray failed", "err", err)
+	}
+}
+
+func (a *App) trayDisconnect(status TunnelStatus, ok bool) {
+	t := a.tunnel(status.ID)
+	if !ok || t == nil || a.trayLocked() != "" {
+		return
+	}
+	t.Stop()
+	t.logger().Info("disconnected from the tray")
+}
+
+func (a *App) copyTrayLink(status TunnelStatus, ok bool) {
+	if !ok || status.ShareableLink == "" {
+		return
+	}
+	if err := copyToClipboard(status.ShareableLink); err != nil {
+		slog.Warn("can't copy the shareable link", "err", err)
+		return
+	}
+	slog.Info("shareable link copied", "tunnel", status.ID, "link", status.ShareableLink)
+}
+
+// trayLocked returns why the tray can't start and stop tunnels, or "" if
+// it can. The service's tunnels and PIN-protected ones are changed from
+// the dashboard.
+func (a *App) trayLocked() string {
+	switch {
+	case a.viewerURL != "":
+		return "tray.serviceManaged"
+	case a.pinSet():
+		return "tray.pinLocked"
+	}
+	return ""
+}
+
+func (a *App) updateTrayStatus(menu *trayMenu) {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	lang, locked := "", "-"
+	for {
+		// Follow language changes made in the dashboard
+		next, nextLocked := a.settings.Get().Language, a.trayLocked()
+		if next != lang || nextLocked != locked {
+			lang, locked = next, nextLocked
+			a.relabelTray(menu, locked)
+		}
+		a.refreshTray(menu, a.currentStatuses(), locked)
+
+		// Tunnels report changes right away; the service attached to is
+		// polled
+		select {
+		case <-ticker.C:
+		case <-a.statusChannel:
+		}
+	}
+}
+
+func (a *App) refreshTray(menu *trayMenu, statuses []TunnelStatus, locked string) {
+	menu.mu.Lock()
+	menu.statuses = statuses
+	menu.mu.Unlock()
+
+	var links []string
+	reconnecting := false
+	for _, status := range statuses {
+		if status.Connected && status.ShareableLink != "" {
+			links = append(links, status.ShareableLink)
+		}
+		if status.State == StateReconnecting {
+			reconnecting = true
+		}
+	}
+
+	switch len(links) {
+	case 0:
+		if reconnecting {
+			menu.mStatus.SetTitle(a.trayText("tray.reconnecting"))
+		} else {
+			menu.mStatus.SetTitle(a.trayText("tray.disconnected"))
+		}
+	case 1:
+		menu.mStatus.SetTitle(a.trayText("tray.connected", links[0]))
+	default:
+		menu.mStatus.SetTitle(a.trayText("tray.connectedMany", len(links)))
+	}
+	setEnabled(menu.mCopy, len(links) > 0)
+
+	badge, count := trayBadge(statuses)
+	if icon := fmt.Sprintf("%s/%d", badge, count); icon != menu.icon {
+		systray.SetIcon(trayIcon(badge, count))
+		menu.icon = icon
+	}
+	systray.SetTooltip(a.trayTooltip(menu, statuses))
+
+	control := locked == ""
+	single := len(statuses) == 1
+	setShown(menu.mConnect, single)
+	setShown(menu.mDisconnect, single)
+	if single {
+		setEnabled(menu.mConnect, control && statuses[0].State == StateDisconnected)
+		setEnabled(menu.mDisconnect, control && statuses[0].State != StateDisconnected)
+	}
+
+	for i, tt := range menu.tunnels {
+		show := !single && i < len(statuses)
+		if show != tt.shown {
+			setShown(tt.item, show)
+			tt.shown = show
+		}
+		if !show {
+			continue
+		}
+		status := statuses[i]
+		tt.item.SetTitle(a.trayText("tray.tunnel", status.Name, a.trayText(trayStateKeys[status.State])))
+		setEnabled(tt.mConnect, control && status.State == StateDisconnected)
+		setEnabled(tt.mDisconnect, control && status.State != StateDisconnected)
+		setEnabled(tt.mCopy, status.Connected && status.ShareableLink != "")
+	}
+
+	if a.isPaused() {
+		menu.mPause.SetTitle(a.trayText("tray.resume"))
+		setEnabled(menu.mPause, control)
+	} else {
+		menu.mPause.SetTitle(a.trayText("tray.pause"))
+		active := false
+		for _, status := range statuses {
+			active = active || status.State != StateDisconnected
+		}
+		setEnabled(menu.mPause, control && active)
+	}
+}
+
+// trayBadge picks the icon badge: an error if a tunnel failed, then
+// reconnecting, then connected with the number of active connections.
+func trayBadge(statuses []TunnelStatus) (string, int64) {
+	badge, count := badgeNone, int64(0)
+	for _, status := range statuses {
+		switch {
+		case status.State == StateDisconnected && status.Error != "":
+			return badgeError, 0
+		case status.State == StateReconnecting || status.State == StateConnecting:
+			badge = badgeReconnecting
+		case status.Connected && badge == badgeNone:
+			badge = badgeConnected
+		}
+		count += status.ActiveStreams
+	}
+	if badge != badgeConnected {
+		count = 0
+	}
+	return badge, count
+}
+
+// trayTooltip shows each connected tunnel's link, uptime and throughput
+// since the previous refresh.
+func (a *App) trayTooltip(menu *trayMenu, statuses []TunnelStatus) string {
+	now := time.Now()
+	elapsed := now.Sub(menu.sampled).Seconds()
+	traffic := make(map[string][2]int64, len(statuses))
+
+	lines := []string{a.trayText("tray.tooltip")}
+	for _, status := range statuses {
+		traffic[status.ID] = [2]int64{status.BytesIn, status.BytesOut}
+		if !status.Connected {
+			continue
+		}
+		if len(statuses) > 1 {
+			lines = append(lines, a.trayText("tray.tunnelLink", status.Name, status.ShareableLink))
+		} else {
+			lines = append(lines, status.ShareableLink)
+		}
+
+		var details []string
+		if status.ConnectedAt != nil {
+			details = append(details, a.trayText("tray.uptime", a.formatUptime(now.Sub(*status.ConnectedAt))))
+		}
+		if prev, ok := menu.traffic[status.ID]; ok && elapsed > 0 {
+			in := float64(max(status.BytesIn-prev[0], 0)) / elapsed
+			out := float64(max(status.BytesOut-prev[1], 0)) / elapsed
+			details = append(details, a.trayText("tray.throughput", formatBytes(in), formatBytes(out)))
+		}
+		if len(details) > 0 {
+			lines = append(lines, strings.Join(details, " · "))
+		}
+	}
+	menu.traffic, menu.sampled = traffic, now
+
+	// Windows cuts tooltips at 127 characters
+	tooltip := []rune(strings.Join(lines, "\n"))
+	if len(tooltip) > maxTooltipLength {
+		tooltip = append(tooltip[:maxTooltipLength-1], '…')
+	}
+	return string(tooltip)
+}
+
+func (a *App) formatUptime(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days, hours, minutes := int(d.Hours())/24, int(d.Hours())%24, int(d.Minutes())%60
+	switch {
+	case days > 0:
+		return a.trayText("tray.uptimeDays", days, hours)
+	case hours > 0:
+		return a.trayText("tray.uptimeHours", hours, minutes)
+	}
+	return a.trayText("tray.uptimeMinutes", minutes)
+}
+
+// formatBytes formats a byte count such as 1536 as "1.5 KB".
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	unit := 0
+	for n >= 1024 && unit < len(units)-1 {
+		n /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[unit])
+}
+
+func setEnabled(item *systray.MenuItem, enabled bool) {
+	if enabled && item.Disabled() {
+		item.Enable()
+	} else if !enabled && !item.Disabled() {
+		item.Disable()
+	}
+}
+
+func setShown(item *systray.MenuItem, shown bool) {
+	if shown {
+		item.Show()
+	} else {
+		item.Hide()
+	}
+}
+
+// trayText translates key into the dashboard's language.
+func (a *App) trayText(key string, args ...interface{}) string {
+	return translate(a.settings.Get().Language, key, args...)
+}
+
+// relabelTray sets the menu's fixed texts. While the tray can't change
+// tunnels, their items explain why instead.
+func (a *App) relabelTray(menu *trayMenu, locked string) {
+	hint := func(key string) string {
+		if locked != "" {
+			return a.trayText(locked)
+		}
+		return a.trayText(key)
+	}
+
+	menu.mStatus.SetTooltip(a.trayText("tray.statusHint"))
+	menu.mCopy.SetTitle(a.trayText("tray.copyLink"))
+	menu.mCopy.SetTooltip(a.trayText("tray.copyLinkHint"))
+	menu.mConnect.SetTitle(a.trayText("tray.connect"))
+	menu.mConnect.SetTooltip(hint("tray.connectHint"))
+	menu.mDisconnect.SetTitle(a.trayText("tray.disconnect"))
+	menu.mDisconnect.SetTooltip(hint("tray.disconnectHint"))
+	for _, tt := range menu.tunnels {
+		tt.mConnect.SetTitle(a.trayText("tray.connect"))
+		tt.mConnect.SetTooltip(hint("tray.connectHint"))
+		tt.mDisconnect.SetTitle(a.trayText("tray.disconnect"))
+		tt.mDisconnect.SetTooltip(hint("tray.disconnectHint"))
+		tt.mCopy.SetTitle(a.trayText("tray.copyLink"))
+		tt.mCopy.SetTooltip(a.trayText("tray.copyLinkHint"))
+	}
+	menu.mPause.SetTooltip(hint("tray.pauseHint"))
+	menu.mOpen.SetTitle(a.trayText("tray.open"))
+	menu.mOpen.SetTooltip(a.trayText("tray.openHint"))
+	menu.mLogs.SetTitle(a.trayText("tray.logs"))
+	menu.mLogs.SetTooltip(a.trayText("tray.logsHint"))
+	menu.mVersion.SetTitle(a.trayText("tray.version", build.Version))
+	menu.mQuit.SetTitle(a.trayText("tray.exit"))
+	menu.mQuit.SetTooltip(a.trayText("tray.exitHint"))
+}
@@ -0,0 +1,12 @@
+//go:build notray || (!windows && !cgo)
+
+package main
+
+import "errors"
+
+// Builds tagged notray (or without cgo on Linux and macOS, where the tray
+// library needs it) carry no GUI dependencies and always run headless.
+
+func runTray(app *App) error {
+	return errors.New("this build has no system tray support")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log/slog"
+	"math"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// trayIconSize is the size tray icons are drawn at. The OS scales them down
+// to the tray, which keeps the badge sharp on high-DPI screens.
+const trayIconSize = 64
+
+// Tray icon badges. An icon without a badge means no tunnel is up.
+const (
+	badgeNone         = ""
+	badgeConnected    = "connected"
+	badgeReconnecting = "reconnecting"
+	badgeError        = "error"
+)
+
+var badgeColors = map[string]color.RGBA{
+	badgeConnected:    {0x2e, 0xa0, 0x43, 0xff},
+	badgeReconnecting: {0xf0, 0xa0, 0x20, 0xff},
+	badgeError:        {0xd9, 0x30, 0x25, 0xff},
+}
+
+// badgeGlyphs is a 3x5 pixel font for badge labels, one row per string.
+var badgeGlyphs = map[rune][5]string{
+	'0': {"###", "#.#", "#.#", "#.#", "###"},
+	'1': {".#.", "##.", ".#.", ".#.", "###"},
+	'2': {"###", "..#", "###", "#..", "###"},
+	'3': {"###", "..#", "###", "..#", "###"},
+	'4': {"#.#", "#.#", "###", "..#", "..#"},
+	'5': {"###", "#..", "###", "..#", "###"},
+	'6': {"###", "#..", "###", "#.#", "###"},
+	'7': {"###", "..#", ".#.", ".#.", ".#."},
+	'8': {"###", "#.#", "###", "#.#", "###"},
+	'9': {"###", "#.#", "###", "..#", "###"},
+	'+': {"...", ".#.", "###", ".#.", "..."},
+	'!': {".#.", ".#.", ".#.", "...", ".#."},
+}
+
+// trayIcons caches the encoded icons; there are only a few dozen variants.
+var trayIcons = struct {
+	sync.Mutex
+	base  *image.RGBA
+	icons map[string][]byte
+}{icons: make(map[string][]byte)}
+
+// trayIcon returns the logo with a badge for the given state, showing the
+// number of active connections when count > 0. Errors are marked "!" so
+// they don't rely on colour alone. The result is an ICO on Windows and a
+// PNG elsewhere, as the tray expects. It falls back to the plain logo if
+// anything goes wrong.
+func trayIcon(badge string, count int64) []byte {
+	label := ""
+	switch {
+	case badge == badgeNone:
+	case badge == badgeError:
+		label = "!"
+	case count > 9:
+		label = "9+"
+	case count > 0:
+		label = strconv.FormatInt(count, 10)
+	}
+	key := badge + "/" + label
+
+	trayIcons.Lock()
+	defer trayIcons.Unlock()
+	if icon, ok := trayIcons.icons[key]; ok {
+		return icon
+	}
+
+	if trayIcons.base == nil {
+		logo, err := png.Decode(bytes.NewReader(iconData))
+		if err != nil {
+			slog.Warn("can't decode the tray logo", "err", err)
+			return iconData
+		}
+		trayIcons.base = fitImage(logo, trayIconSize)
+	}
+
+	img := image.NewRGBA(trayIcons.base.Bounds())
+	draw.Draw(img, img.Bounds(), trayIcons.base, image.Point{}, draw.Src)
+	if badge != badgeNone {
+		drawBadge(img, badgeColors[badge], label)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		slog.Warn("can't encode the tray icon", "err", err)
+		return iconData
+	}
+	icon := buf.Bytes()
+	if runtime.GOOS == "windows" {
+		icon = pngToICO(icon, trayIconSize)
+	}
+	trayIcons.icons[key] = icon
+	return icon
+}
+
+// fitImage scales src down to a size x size square, keeping its aspect
+// ratio and centring it. Each pixel averages the source pixels it covers.
+func fitImage(src image.Image, size int) *image.RGBA {
+	rgba := image.NewRGBA(src.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+	sw, sh := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+
+	scale := float64(size) / math.Max(float64(sw), float64(sh))
+	w, h := int(math.Round(float64(sw)*scale)), int(math.Round(float64(sh)*scale))
+	offX, offY := (size-w)/2, (size-h)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r, g, b, a = r+int(p[0]), g+int(p[1]), b+int(p[2]), a+int(p[3])
+					n++
+				}
+			}
+			i := dst.PixOffset(offX+x, offY+y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// drawBadge paints a filled circle with a white rim in the bottom right
+// corner, with label written in it.
+func drawBadge(img *image.RGBA, c color.RGBA, label string) {
+	size := float64(img.Bounds().Dx())
+	radius := size * 0.3
+	cx, cy := size-radius-1, size-radius-1
+	rim := size * 0.05
+
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy)
+			// Anti-alias the edges by pixel coverage
+			blend(img, x, y, color.RGBA{0xff, 0xff, 0xff, 0xff}, clamp01(radius+0.5-d))
+			blend(img, x, y, c, clamp01(radius-rim+0.5-d))
+		}
+	}
+
+	if label == "" {
+		return
+	}
+	scale := int(radius / 6)
+	width := (len(label)*4 - 1) * scale
+	x := int(cx) - width/2
+	y := int(cy) - 5*scale/2
+	for _, ch := range label {
+		for row, bits := range badgeGlyphs[ch] {
+			for col, bit := range bits {
+				if bit != '#' {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						img.SetRGBA(x+col*scale+dx, y+row*scale+dy, color.RGBA{0xff, 0xff, 0xff, 0xff})
+					}
+				}
+			}
+		}
+		x += 4 * scale
+	}
+}
+
+// blend draws c over the pixel at x, y with the given opacity.
+func blend(img *image.RGBA, x, y int, c color.RGBA, opacity float64) {
+	if opacity <= 0 {
+		return
+	}
+	i := img.PixOffset(x, y)
+	p := img.Pix[i : i+4]
+	a := opacity * float64(c.A) / 0xff
+	for j, v := range []uint8{c.R, c.G, c.B, 0xff} {
+		p[j] = uint8(float64(v)*a + float64(p[j])*(1-a) + 0.5)
+	}
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// pngToICO wraps a square PNG in an ICO file, which Windows needs for tray
+// icons. Windows Vista and later read PNG-compressed icon images.
+func pngToICO(data []byte, size int) []byte {
+	var buf bytes.Buffer
+	dim := uint8(size)
+	if size >= 256 {
+		dim = 0
+	}
+	// ICONDIR: reserved, type 1 (icon), one image
+	binary.Write(&buf, binary.LittleEndian, [3]uint16{0, 1, 1})
+	// ICONDIRENTRY: width, height, palette size, reserved, colour planes,
+	// bits per pixel, data size, data offset
+	buf.Write([]byte{dim, dim, 0, 0})
+	binary.Write(&buf, binary.LittleEndian, [2]uint16{1, 32})
+	binary.Write(&buf, binary.LittleEndian, [2]uint32{uint32(len(data)), 6 + 16})
+	buf.Write(data)
+	return buf.Bytes()
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel"
+)
+
+// relayTimeout bounds connecting to a relay, the TLS handshake and the wait
+// for the reply to REGISTER.
+var relayTimeout = tunnel.DefaultTimeout
+
+// Tunnel states reported to the dashboard and tray.
+const (
+	StateDisconnected = string(tunnel.StateDisconnected)
+	StateConnecting   = string(tunnel.StateConnecting)
+	StateConnected    = string(tunnel.StateConnected)
+	StateReconnecting = string(tunnel.StateReconnecting)
+)
+
+// errTunnelRemoved ends streams that arrive after their tunnel was deleted
+// from the settings.
+var errTunnelRemoved = errors.New(AuditRemoved)
+
+// errConnectionLimit turns streams away at the connection limit. The audit
+// log shows it as AuditRejected.
+var errConnectionLimit = errors.New("connection limit")
+
+// Tunnel is one saved tunnel's link through the relay, run by a
+// tunnel.Client. Its name and target are read from the settings when
+// needed, so an edited target applies to the next stream without
+// reconnecting.
+type Tunnel struct {
+	ID     string
+	app    *App
+	client *tunnel.Client
+
+	// metrics count what the client can't tell apart: the target failing
+	// to resolve or to accept the connection
+	metrics targetMetrics
+}
+
+type TunnelStatus struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Target        string `json:"target"`
+	State         string `json:"state"`
+	Connected     bool   `json:"connected"`
+	ShareableLink string `json:"shareableLink"`
+	ActiveStreams int64  `json:"activeStreams"`
+	Error         string `json:"error"`
+	// ConnectedAt is when the current relay session started.
+	ConnectedAt *time.Time `json:"connectedAt,omitempty"`
+	// BytesIn and BytesOut count the traffic since the app started.
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+}
+
+// newTunnel sets up the client for a saved tunnel and starts passing its
+// events on to the tray.
+func (a *App) newTunnel(id string) *Tunnel {
+	relay := a.settings.Get().Relay
+	t := &Tunnel{ID: id, app: a}
+	t.client = tunnel.NewClient(tunnel.Config{
+		Relays:            relay.Endpoints,
+		TLSConfig:         a.relayTLS,
+		Timeout:           relayTimeout,
+		Token:             relay.Token,
+		DialTarget:        t.dialTarget,
+		Version:           build.Version,
+		Platform:          build.Platform,
+		ReconnectAttempts: relay.ReconnectAttempts,
+		Logger:            t.logger(),
+		Hooks: tunnel.Hooks{
+			Accept: t.acceptStream,
+			Closed: t.streamClosed,
+		},
+	})
+	go t.watch()
+	return t
+}
+
+func (t *Tunnel) config() (TunnelSettings, bool) {
+	return t.app.settings.Get().tunnel(t.ID)
+}
+
+func (t *Tunnel) Status() TunnelStatus {
+	cfg, _ := t.config()
+	status := t.client.Status()
+	stats := t.client.Stats()
+
+	connected := status.State == tunnel.StateConnected
+	ts := TunnelStatus{
+		ID:            t.ID,
+		Name:          cfg.Name,
+		Target:        cfg.Target,
+		State:         string(status.State),
+		Connected:     connected,
+		ShareableLink: status.Link,
+		ActiveStreams: stats.ActiveStreams,
+		Error:         status.Error,
+		BytesIn:       stats.BytesIn,
+		BytesOut:      stats.BytesOut,
+	}
+	if connected {
+		ts.ConnectedAt = &status.ConnectedAt
+	}
+	return ts
+}
+
+// Start connects the tunnel to the first relay endpoint that accepts it and
+// returns the shareable link. Starting a connected tunnel is a no-op. Once
+// started, a tunnel that loses its relay session reconnects on its own.
+func (t *Tunnel) Start() (string, error) {
+	cfg, ok := t.config()
+	if !ok {
+		return "", fmt.Errorf("tunnel %s is not configured", t.ID)
+	}
+	settings := t.app.settings.Get()
+	if err := settings.Policies.checkTarget(cfg.Target); err != nil {
+		return "", err
+	}
+	t.configure(settings)
+	return t.client.Start(context.Background())
+}
+
+// Stop closes the relay session and cancels any pending reconnect. The relay
+// releases the shareable port.
+func (t *Tunnel) Stop() {
+	t.client.Stop(context.Background())
+}
+
+// keepTrying starts a background retry loop unless one is already running.
+// It is used when a wanted tunnel failed to auto-connect.
+func (t *Tunnel) keepTrying() {
+	t.client.KeepTrying()
+}
+
+// configure passes the relay settings on to the client, for its next
+// connection attempt.
+func (t *Tunnel) configure(settings Settings) {
+	t.client.SetRelays(settings.Relay.Endpoints)
+	t.client.SetToken(settings.Relay.Token)
+	t.client.SetReconnectAttempts(settings.Relay.ReconnectAttempts)
+}
+
+// watch turns the client's events into tray updates and desktop
+// notifications until the tunnel is removed.
+func (t *Tunnel) watch() {
+	for event := range t.client.Events() {
+		t.notify()
+		switch event.Type {
+		case tunnel.EventConnected:
+			t.app.notifyEvent(EventTunnelUp, t.ID, event.Link)
+		case tunnel.EventNewLink:
+			t.app.notifyEvent(EventNewLink, t.ID, event.Link)
+		case tunnel.EventLost:
+			t.app.notifyEvent(EventTunnelDown, t.ID)
+		case tunnel.EventGaveUp:
+			t.app.notifyEvent(EventReconnectGaveUp, t.ID, event.Attempts)
+		case tunnel.EventUpdateRequired:
+			t.app.updates.checkSoon()
+		}
+	}
+}
+
+// dialTarget connects a stream to the tunnel's target. The target is
+// resolved on every stream: named instances move to a new dynamic port
+// whenever SQL Server restarts.
+func (t *Tunnel) dialTarget(ctx context.Context) (net.Conn, error) {
+	cfg, ok := t.config()
+	if !ok {
+		return nil, errTunnelRemoved
+	}
+	addr, err := resolveTarget(cfg.Target)
+	if err != nil {
+		atomic.AddInt64(&t.metrics.resolveFailures, 1)
+		return nil, fmt.Errorf("target unresolved: %w", err)
+	}
+
+	dialStart := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		atomic.AddInt64(&t.metrics.dialFailures, 1)
+		return nil, fmt.Errorf("target unreachable: %w", err)
+	}
+	t.metrics.dialLatency.observe(time.Since(dialStart).Seconds())
+	return conn, nil
+}
+
+// acceptStream turns streams away once the tunnel is at its connection
+// limit.
+func (t *Tunnel) acceptStream(tunnel.Stream) error {
+	max := t.app.settings.Get().Policies.MaxStreams
+	if max > 0 && t.client.Stats().ActiveStreams >= int64(max) {
+		return errConnectionLimit
+	}
+	return nil
+}
+
+// streamClosed records a finished stream in the audit log, and tells the
+// user when it couldn't reach the target.
+func (t *Tunnel) streamClosed(s tunnel.Stream) {
+	cfg, _ := t.config()
+	t.app.audit.Record(AuditRecord{
+		Opened:     s.Opened,
+		Closed:     s.Closed,
+		TunnelID:   t.ID,
+		TunnelName: cfg.Name,
+		Stream:     s.ID,
+		Remote:     s.Remote,
+		Target:     cfg.Target,
+		TargetAddr: s.TargetAddr,
+		BytesIn:    s.BytesIn,
+		BytesOut:   s.BytesOut,
+		Reason:     s.Reason,
+	})
+	if s.Err != nil && !s.Rejected && !errors.Is(s.Err, errTunnelRemoved) {
+		t.app.notifyEvent(EventTargetDown, t.ID, cfg.Target)
+	}
+}
+
+// notify tells the tray the tunnel's state changed. Updates are dropped
+// while nobody reads them.
+func (t *Tunnel) notify() {
+	status := t.Status()
+	select {
+	case t.app.statusChannel <- StatusUpdate{
+		TunnelID:      t.ID,
+		State:         status.State,
+		Connected:     status.Connected,
+		ShareableLink: status.ShareableLink,
+		Target:        status.Target,
+		Error:         status.Error,
+	}:
+	default:
+	}
+}
+
+// active reports whether the tunnel is up or trying to be.
+func (t *Tunnel) active() bool {
+	status := t.client.Status()
+	return status.State != tunnel.StateDisconnected || status.Wanted
+}
+
+// logger returns the logger for this tunnel's records.
+func (t *Tunnel) logger() *slog.Logger {
+	return slog.With("tunnel", t.ID)
+}
+
+// tunnel returns the running state for a configured tunnel, creating it on
+// first use. It returns nil for IDs that aren't in the settings.
+func (a *App) tunnel(id string) *Tunnel {
+	if _, ok := a.settings.Get().tunnel(id); !ok {
+		return nil
+	}
+	return a.getTunnel(id)
+}
+
+func (a *App) getTunnel(id string) *Tunnel {
+	a.tunnelMutex.Lock()
+	defer a.tunnelMutex.Unlock()
+	t, ok := a.tunnels[id]
+	if !ok {
+		t = a.newTunnel(id)
+		a.tunnels[id] = t
+	}
+	return t
+}
+
+func (a *App) defaultTunnelID() string {
+	return a.settings.Get().Tunnels[0].ID
+}
+
+// tunnelStatuses reports every configured tunnel in settings order.
+func (a *App) tunnelStatuses() []TunnelStatus {
+	settings := a.settings.Get()
+	statuses := make([]TunnelStatus, 0, len(settings.Tunnels))
+	for _, cfg := range settings.Tunnels {
+		statuses = append(statuses, a.getTunnel(cfg.ID).Status())
+	}
+	return statuses
+}
+
+// syncTunnels applies saved settings to the running tunnels and stops
+// those whose configuration was removed.
+func (a *App) syncTunnels() {
+	settings := a.settings.Get()
+
+	a.tunnelMutex.Lock()
+	var removed []*Tunnel
+	for id, t := range a.tunnels {
+		if _, ok := settings.tunnel(id); !ok {
+			removed = append(removed, t)
+			delete(a.tunnels, id)
+			continue
+		}
+		t.configure(settings)
+	}
+	a.tunnelMutex.Unlock()
+
+	for _, t := range removed {
+		t.logger().Info("tunnel was removed from settings, stopping it")
+		t.client.Close()
+	}
+}
+
+// autoConnect starts every tunnel marked for auto-connect. Tunnels that fail
+// keep retrying in the background. It reports whether there were any such
+// tunnels and all of them connected on the first try.
+func (a *App) autoConnect() bool {
+	var auto []TunnelSettings
+	for _, cfg := range a.settings.Get().Tunnels {
+		if cfg.AutoConnect {
+			auto = append(auto, cfg)
+		}
+	}
+	if len(auto) == 0 {
+		return false
+	}
+
+	results := make(chan bool, len(auto))
+	for _, cfg := range auto {
+		go func(cfg TunnelSettings) {
+			t := a.getTunnel(cfg.ID)
+			t.logger().Info("auto-connecting", "name", cfg.Name)
+			if _, err := t.Start(); err != nil {
+				t.logger().Warn("auto-connect failed, will keep trying", "name", cfg.Name, "err", err)
+				t.keepTrying()
+				results <- false
+				return
+			}
+			results <- true
+		}(cfg)
+	}
+
+	ok := true
+	for range auto {
+		ok = <-results && ok
+	}
+	return ok
+}
+
+func (a *App) stopAllTunnels() {
+	a.tunnelMutex.RLock()
+	tunnels := make([]*Tunnel, 0, len(a.tunnels))
+	for _, t := range a.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	a.tunnelMutex.RUnlock()
+
+	for _, t := range tunnels {
+		t.Stop()
+	}
+}
+
+// pauseTunnels stops every active tunnel and remembers them, so
+// resumeTunnels can bring the same ones back.
+func (a *App) pauseTunnels() {
+	a.tunnelMutex.RLock()
+	var active []*Tunnel
+	for _, t := range a.tunnels {
+		if t.active() {
+			active = append(active, t)
+		}
+	}
+	a.tunnelMutex.RUnlock()
+
+	ids := make([]string, 0, len(active))
+	for _, t := range active {
+		t.Stop()
+		ids = append(ids, t.ID)
+	}
+
+	a.tunnelMutex.Lock()
+	a.paused = append(a.paused, ids...)
+	a.tunnelMutex.Unlock()
+	slog.Info("tunnels paused", "tunnels", ids)
+}
+
+// resumeTunnels restarts the tunnels pauseTunnels stopped. Those that fail
+// keep retrying in the background.
+func (a *App) resumeTunnels() {
+	a.tunnelMutex.Lock()
+	ids := a.paused
+	a.paused = nil
+	a.tunnelMutex.Unlock()
+
+	slog.Info("resuming tunnels", "tunnels", ids)
+	for _, id := range ids {
+		// Tunnels removed while paused stay gone
+		t := a.tunnel(id)
+		if t == nil {
+			continue
+		}
+		go func() {
+			if _, err := t.Start(); err != nil {
+				t.logger().Warn("resume failed, will keep trying", "err", err)
+				t.keepTrying()
+			}
+		}()
+	}
+}
+
+// isPaused reports whether tunnels are waiting for resumeTunnels.
+func (a *App) isPaused() bool {
+	a.tunnelMutex.RLock()
+	defer a.tunnelMutex.RUnlock()
+	return len(a.paused) > 0
+}
@@ -0,0 +1,537 @@
+// Package tunnel opens a Tatbeeb link: it registers with a relay over TLS,
+// is given a public port, and forwards every connection the relay hands
+// over to a target, usually a local database.
+//
+//	client := tunnel.NewClient(tunnel.Config{
+//		Relays: []string{"link.tatbeeb.sa:8443"},
+//		Target: "127.0.0.1:1433",
+//	})
+//	link, err := client.Start(ctx)
+//	if err != nil {
+//		client.KeepTrying()
+//	}
+//	for event := range client.Events() {
+//		...
+//	}
+//
+// Once started, a client that loses its relay session reconnects on its
+// own until Stop.
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	reconnectMinDelay = 2 * time.Second
+	reconnectMaxDelay = time.Minute
+	// targetDialTimeout bounds connecting a stream to the target.
+	targetDialTimeout = 10 * time.Second
+	// eventBuffer is how many events wait for a slow reader before new ones
+	// are dropped.
+	eventBuffer = 64
+)
+
+// State is where a client stands with its relay.
+type State string
+
+const (
+	StateDisconnected State = "disconnected"
+	StateConnecting   State = "connecting"
+	StateConnected    State = "connected"
+	StateReconnecting State = "reconnecting"
+)
+
+// Transport opens the network connection to a relay, which the client then
+// secures with TLS. *net.Dialer is one; a proxy dialer is another.
+type Transport interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Config is how a Client connects. Only Relays and a target are required.
+type Config struct {
+	// Relays are the relay endpoints, host:port, tried in order.
+	Relays []string
+	// Transport opens connections to the relays; nil dials TCP directly.
+	Transport Transport
+	// TLSConfig is cloned for relay connections, with ServerName set to
+	// the relay's host. Nil trusts the system roots.
+	TLSConfig *tls.Config
+	// Timeout bounds each attempt to register with a relay; zero means
+	// DefaultTimeout.
+	Timeout time.Duration
+	// Token is sent to relays that require one to register.
+	Token string
+
+	// DialTarget connects a stream to the target. It is called for every
+	// stream, so it can follow a target that moves. Nil dials Target over
+	// TCP.
+	DialTarget func(ctx context.Context) (net.Conn, error)
+	// Target is the host:port streams are forwarded to when DialTarget is
+	// nil.
+	Target string
+
+	// Version and Platform are sent to the relay, which may turn away
+	// versions it no longer supports. Platform defaults to GOOS/GOARCH.
+	Version  string
+	Platform string
+	// ReconnectAttempts limits how often a lost session is retried; zero
+	// retries until Stop.
+	ReconnectAttempts int
+
+	// Logger receives the client's records; nil uses slog.Default.
+	Logger *slog.Logger
+	Hooks  Hooks
+}
+
+// Client is one tunnel through a relay. Its methods are safe for
+// concurrent use.
+type Client struct {
+	cfg    Config
+	logger *slog.Logger
+	events chan Event
+
+	// startSem serializes Start and Stop. It is a channel so that waiting
+	// for it can be given up with a context.
+	startSem chan struct{}
+
+	mu                sync.RWMutex
+	relays            []string
+	token             string
+	reconnectAttempts int
+	connected         bool
+	connecting        bool
+	endpoint          string
+	link              string
+	relayConn         net.Conn
+	session           *yamux.Session
+	connectedAt       time.Time
+	lastError         string
+	// lastLink outlives the session, to notice when the relay hands out a
+	// different link
+	lastLink string
+	// cancelStart abandons the connection attempt in progress
+	cancelStart context.CancelFunc
+	closed      bool
+
+	// wanted is set while the tunnel should be up; a lost session is only
+	// retried while it holds. stopReconnect ends a running retry loop.
+	wanted        bool
+	stopReconnect chan struct{}
+
+	// linkTest is the link test waiting for its stream, if one is running
+	linkTest *linkTest
+
+	streamCount int64
+	counters    counters
+}
+
+// Status is a snapshot of a client.
+type Status struct {
+	State State
+	// Link is the public host:port that reaches the target while
+	// connected.
+	Link string
+	// Relay is the endpoint the session is with.
+	Relay string
+	// ConnectedAt is when the current relay session started, zero while
+	// not connected.
+	ConnectedAt time.Time
+	// Error is why the last attempt failed or the session was lost.
+	Error string
+	// Wanted is set from a successful Start, or KeepTrying, until Stop or
+	// the retries give up.
+	Wanted bool
+}
+
+// ErrClosed is returned by a Client after Close.
+var ErrClosed = errors.New("tunnel client is closed")
+
+// NewClient returns a client for cfg. It doesn't connect until Start.
+func NewClient(cfg Config) *Client {
+	if cfg.Platform == "" {
+		cfg.Platform = runtime.GOOS + "/" + runtime.GOARCH
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Client{
+		cfg:               cfg,
+		logger:            logger,
+		events:            make(chan Event, eventBuffer),
+		startSem:          make(chan struct{}, 1),
+		relays:            slices.Clone(cfg.Relays),
+		token:             cfg.Token,
+		reconnectAttempts: cfg.ReconnectAttempts,
+	}
+}
+
+// SetRelays replaces the relay endpoints. The next connection attempt uses
+// them; a running session is kept.
+func (c *Client) SetRelays(relays []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.relays = slices.Clone(relays)
+}
+
+// SetToken replaces the relay token for the next connection attempt.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// SetReconnectAttempts changes the limit on retries of a lost session. It
+// applies from the next time the session is lost.
+func (c *Client) SetReconnectAttempts(attempts int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnectAttempts = attempts
+}
+
+// Status reports the client's state.
+func (c *Client) Status() Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	status := Status{
+		State:  c.state(),
+		Link:   c.link,
+		Error:  c.lastError,
+		Wanted: c.wanted,
+	}
+	if c.connected {
+		status.Relay = c.endpoint
+		status.ConnectedAt = c.connectedAt
+	}
+	return status
+}
+
+// state must be called with c.mu held.
+func (c *Client) state() State {
+	switch {
+	case c.connected:
+		return StateConnected
+	case c.connecting:
+		return StateConnecting
+	case c.stopReconnect != nil:
+		return StateReconnecting
+	}
+	return StateDisconnected
+}
+
+// Start connects to the first relay that accepts the tunnel and returns the
+// shareable link. Starting a connected client is a no-op. ctx bounds the
+// attempt, not the tunnel: once started, a client that loses its relay
+// session reconnects on its own until Stop. A failed Start isn't retried;
+// call KeepTrying for that.
+func (c *Client) Start(ctx context.Context) (string, error) {
+	select {
+	case c.startSem <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-c.startSem }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return "", ErrClosed
+	}
+	if c.connected {
+		link := c.link
+		c.mu.Unlock()
+		return link, nil
+	}
+	c.connecting = true
+	c.cancelStart = cancel
+	relays := c.relays
+	c.mu.Unlock()
+	c.emit(Event{Type: EventStateChanged})
+
+	lastErr := errors.New("no relay configured")
+	var updateErr error
+	for _, endpoint := range relays {
+		conn, session, port, err := c.dial(ctx, endpoint)
+		if err != nil {
+			if ctx.Err() != nil {
+				// Abandoned by the caller or Stop; the other relays needn't
+				// be tried
+				lastErr = ctx.Err()
+				break
+			}
+			c.logger.Warn("relay unavailable", "endpoint", endpoint, "err", err)
+			lastErr = err
+			if errors.As(err, new(*UpdateRequiredError)) {
+				updateErr = err
+			}
+			continue
+		}
+
+		host, _, _ := net.SplitHostPort(endpoint)
+		link := net.JoinHostPort(host, port)
+
+		c.mu.Lock()
+		if ctx.Err() != nil {
+			// Stop, or the caller, gave up while the relay was accepting;
+			// Stop cancels under mu, so this can't miss it
+			c.mu.Unlock()
+			session.Close()
+			conn.Close()
+			lastErr = ctx.Err()
+			break
+		}
+		c.relayConn = conn
+		c.session = session
+		c.endpoint = endpoint
+		c.link = link
+		c.connected = true
+		c.connecting = false
+		c.cancelStart = nil
+		c.connectedAt = time.Now()
+		c.wanted = true
+		c.lastError = ""
+		previousLink := c.lastLink
+		c.lastLink = link
+		c.mu.Unlock()
+
+		event := Event{Type: EventConnected, Link: link}
+		if previousLink != "" && previousLink != link {
+			event.Type = EventNewLink
+		}
+		c.emit(event)
+
+		// Start accepting incoming streams (client connections)
+		go c.acceptStreams(session)
+		go c.monitorSession(session)
+
+		c.logger.Info("tunnel ready", "endpoint", endpoint, "link", link)
+		return link, nil
+	}
+
+	// Being told to update says more than a later relay being down
+	if updateErr != nil {
+		lastErr = updateErr
+	}
+	c.mu.Lock()
+	c.connecting = false
+	c.cancelStart = nil
+	c.lastError = lastErr.Error()
+	c.mu.Unlock()
+
+	if updateErr != nil {
+		c.emit(Event{Type: EventUpdateRequired, Err: updateErr})
+	} else {
+		c.emit(Event{Type: EventStateChanged, Err: lastErr})
+	}
+	return "", lastErr
+}
+
+// Stop closes the relay session, abandons a connection attempt in progress
+// and cancels any pending reconnect. The relay releases the shareable port.
+// ctx bounds the wait for an attempt in progress to unwind.
+func (c *Client) Stop(ctx context.Context) error {
+	// Cancel reconnecting first: the retry loop may be blocked in Start,
+	// which holds startSem
+	c.mu.Lock()
+	c.wanted = false
+	if c.stopReconnect != nil {
+		close(c.stopReconnect)
+		c.stopReconnect = nil
+	}
+	if c.cancelStart != nil {
+		c.cancelStart()
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.startSem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-c.startSem }()
+
+	c.mu.Lock()
+	session, conn := c.session, c.relayConn
+	c.session = nil
+	c.relayConn = nil
+	c.connected = false
+	c.endpoint = ""
+	c.link = ""
+	c.lastError = ""
+	c.mu.Unlock()
+
+	if session != nil {
+		session.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	c.emit(Event{Type: EventStateChanged})
+	return nil
+}
+
+// Close stops the client for good and closes the event channel.
+func (c *Client) Close() error {
+	err := c.Stop(context.Background())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.events)
+	}
+	return err
+}
+
+// KeepTrying connects in the background, retrying with backoff, unless a
+// retry loop is already running. Use it when Start failed and the tunnel
+// should come up as soon as the relay can be reached.
+func (c *Client) KeepTrying() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.wanted = true
+	if c.stopReconnect != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.stopReconnect = make(chan struct{})
+	go c.reconnect(c.stopReconnect, c.reconnectAttempts)
+	c.mu.Unlock()
+	c.emit(Event{Type: EventStateChanged})
+}
+
+func (c *Client) reconnect(stop chan struct{}, limit int) {
+	delay := reconnectMinDelay
+
+	for attempt := 1; limit == 0 || attempt <= limit; attempt++ {
+		c.logger.Info("reconnecting", "delay", delay, "attempt", attempt)
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		}
+
+		atomic.AddInt64(&c.counters.reconnectAttempts, 1)
+		_, err := c.Start(context.Background())
+		if err == nil {
+			atomic.AddInt64(&c.counters.reconnects, 1)
+			if c.finishReconnect(stop, nil) {
+				c.emit(Event{Type: EventStateChanged})
+			}
+			c.logger.Info("reconnected", "attempt", attempt)
+			return
+		}
+		// Retrying can't help until this version is updated
+		if errors.As(err, new(*UpdateRequiredError)) {
+			c.logger.Error("not reconnecting", "err", err)
+			if c.finishReconnect(stop, err) {
+				c.emit(Event{Type: EventStateChanged, Err: err})
+			}
+			return
+		}
+
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+
+	c.logger.Error("gave up reconnecting", "attempts", limit)
+	err := fmt.Errorf("gave up after %d reconnect attempts", limit)
+	if c.finishReconnect(stop, err) {
+		c.emit(Event{Type: EventGaveUp, Err: err, Attempts: limit})
+	}
+}
+
+// finishReconnect clears the retry loop's channel if Stop hasn't already,
+// and reports whether it did. An error means the loop gave up.
+func (c *Client) finishReconnect(stop chan struct{}, err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopReconnect != stop {
+		return false
+	}
+	c.stopReconnect = nil
+	if err != nil {
+		c.wanted = false
+		c.lastError = err.Error()
+	}
+	return true
+}
+
+// dial opens a TLS connection to a relay endpoint through the transport,
+// registers, and wraps the connection in a yamux client session. It
+// returns the assigned port.
+func (c *Client) dial(ctx context.Context, endpoint string) (net.Conn, *yamux.Session, string, error) {
+	logger := c.logger.With("endpoint", endpoint)
+	logger.Debug("connecting to relay")
+
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("invalid relay endpoint %q: %w", endpoint, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	var transport Transport = &net.Dialer{}
+	if c.cfg.Transport != nil {
+		transport = c.cfg.Transport
+	}
+	raw, err := transport.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to connect to relay: %w", err)
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.cfg.TLSConfig != nil {
+		tlsConfig = c.cfg.TLSConfig.Clone()
+	}
+	tlsConfig.ServerName = host
+	conn := tls.Client(raw, tlsConfig)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, nil, "", fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	logger.Debug("TLS connection established")
+
+	c.mu.RLock()
+	token := c.token
+	c.mu.RUnlock()
+	port, err := Register(ctx, conn, Registration{Version: c.cfg.Version, Platform: c.cfg.Platform, Token: token})
+	if err != nil {
+		conn.Close()
+		return nil, nil, "", err
+	}
+	logger.Debug("relay assigned port", "port", port)
+
+	session, err := NewSession(conn, logger)
+	if err != nil {
+		conn.Close()
+		return nil, nil, "", err
+	}
+	return conn, session, port, nil
+}
@@ -0,0 +1,649 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel/tunneltest"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestClient returns a client for target through the given relays,
+// trusting the test relay's certificate. It is closed when the test ends.
+func newTestClient(t *testing.T, cfg Config, relays ...string) *Client {
+	t.Helper()
+	cfg.Relays = relays
+	cfg.TLSConfig = tunneltest.ClientTLS()
+	cfg.Version = "1.2.0"
+	cfg.Logger = quiet
+	c := NewClient(cfg)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// newEchoTarget starts a local TCP server that echoes what it receives,
+// standing in for the database.
+func newEchoTarget(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// closedPort returns an address where nothing listens.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// waitFor polls cond until it holds or the timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// nextEvent waits for the next event of one of the given types, skipping
+// the others.
+func nextEvent(t *testing.T, c *Client, types ...EventType) Event {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-c.Events():
+			for _, typ := range types {
+				if e.Type == typ {
+					return e
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v", types)
+			return Event{}
+		}
+	}
+}
+
+// noRegister checks that the relay isn't registered with for a while.
+func noRegister(t *testing.T, relay *tunneltest.Relay, why string) {
+	t.Helper()
+	select {
+	case line := <-relay.Registers():
+		t.Errorf("%s: %q", why, line)
+	case <-time.After(reconnectMinDelay + time.Second):
+	}
+}
+
+func TestClientForwardsStreams(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	var mu sync.Mutex
+	var closed []Stream
+	c := newTestClient(t, Config{
+		Target: newEchoTarget(t),
+		Hooks: Hooks{Closed: func(s Stream) {
+			mu.Lock()
+			defer mu.Unlock()
+			closed = append(closed, s)
+		}},
+	}, relay.Endpoint())
+
+	link, err := c.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if want := "127.0.0.1:4242"; link != want {
+		t.Errorf("link = %q, want %q", link, want)
+	}
+	register := relay.Register()
+	for _, field := range []string{"REGISTER ", "version=1.2.0", "platform=" + runtime.GOOS + "/" + runtime.GOARCH} {
+		if !strings.Contains(register, field) {
+			t.Errorf("REGISTER line %q lacks %q", register, field)
+		}
+	}
+	if strings.Contains(register, "dryrun") {
+		t.Errorf("REGISTER line %q asks for a dry run", register)
+	}
+	if status := c.Status(); status.State != StateConnected || status.Link != link || status.Relay != relay.Endpoint() || !status.Wanted {
+		t.Errorf("status = %+v, want connected to %q", status, link)
+	}
+	if e := nextEvent(t, c, EventConnected); e.Link != link || e.State != StateConnected {
+		t.Errorf("event = %+v", e)
+	}
+
+	// Several clients at once, each with enough data to need many frames
+	session := relay.Session()
+	const clients = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := session.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+
+			payload := make([]byte, 256<<10)
+			rand.Read(payload)
+			go stream.Write(payload)
+			echo := make([]byte, len(payload))
+			if _, err := io.ReadFull(stream, echo); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(echo, payload) {
+				errs <- errors.New("echoed data differs")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	waitFor(t, 5*time.Second, "streams to close", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(closed) == clients
+	})
+	stats := c.Stats()
+	if want := int64(clients * 256 << 10); stats.BytesIn != want || stats.BytesOut != want {
+		t.Errorf("bytes in/out = %d/%d, want %d each", stats.BytesIn, stats.BytesOut, want)
+	}
+	if stats.StreamsAccepted != clients || stats.ActiveStreams != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range closed {
+		if s.Err != nil || s.BytesIn != 256<<10 || s.TargetAddr == "" || s.Closed.Before(s.Opened) {
+			t.Errorf("closed stream = %+v", s)
+		}
+	}
+}
+
+func TestClientTargetDown(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	closed := make(chan Stream, 1)
+	c := newTestClient(t, Config{
+		Target: closedPort(t),
+		Hooks:  Hooks{Closed: func(s Stream) { closed <- s }},
+	}, relay.Endpoint())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	stream, err := relay.Session().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from a stream to a stopped target = %v, want EOF", err)
+	}
+	s := <-closed
+	if s.Err == nil || s.Rejected || s.Reason != s.Err.Error() || s.TargetAddr == "" {
+		t.Errorf("closed stream = %+v, want a dial error", s)
+	}
+	if failures := c.Stats().TargetFailures; failures != 1 {
+		t.Errorf("target failures = %d, want 1", failures)
+	}
+	// The relay session stays up for the next client
+	if state := c.Status().State; state != StateConnected {
+		t.Errorf("state after a target failure = %s", state)
+	}
+}
+
+func TestClientAcceptHook(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	closed := make(chan Stream, 2)
+	dialed := make(chan struct{}, 2)
+	target := newEchoTarget(t)
+	c := newTestClient(t, Config{
+		DialTarget: func(ctx context.Context) (net.Conn, error) {
+			dialed <- struct{}{}
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", target)
+		},
+		Hooks: Hooks{
+			Accept: func(s Stream) error {
+				if s.ID > 1 {
+					return errors.New("one is enough")
+				}
+				return nil
+			},
+			Closed: func(s Stream) { closed <- s },
+		},
+	}, relay.Endpoint())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	session := relay.Session()
+
+	first, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("ping"))
+	if _, err := io.ReadFull(first, make([]byte, 4)); err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+
+	second, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Write([]byte("ping"))
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from a rejected stream = %v, want EOF", err)
+	}
+	s := <-closed
+	if !s.Rejected || s.Reason != "rejected: one is enough" {
+		t.Errorf("rejected stream = %+v", s)
+	}
+	if len(dialed) != 1 {
+		t.Errorf("the target was dialed %d times, want once", len(dialed))
+	}
+	if stats := c.Stats(); stats.StreamsAccepted != 1 || stats.StreamsRejected != 1 {
+		t.Errorf("accepted/rejected = %d/%d, want 1/1", stats.StreamsAccepted, stats.StreamsRejected)
+	}
+}
+
+func TestClientHandshakeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+		check func(error) bool
+	}{
+		{
+			name:  "refused",
+			reply: "ERR tunnel quota reached",
+			want:  "relay refused the tunnel: tunnel quota reached",
+			check: func(err error) bool { return errors.Is(err, ErrRefused) },
+		},
+		{
+			name:  "update required",
+			reply: "UPDATE 9.0.0 security fix",
+			want:  "requires Tatbeeb Link 9.0.0 or later (this is 1.2.0)",
+			check: func(err error) bool {
+				var updateErr *UpdateRequiredError
+				return errors.As(err, &updateErr) && updateErr.Minimum == "9.0.0" && updateErr.Message == "security fix"
+			},
+		},
+		{name: "unknown reply", reply: "HELLO there", want: "unexpected response: HELLO there"},
+		{name: "malformed port", reply: "OK 4242", want: "invalid port format: 4242"},
+		{name: "empty reply", reply: "", want: "unexpected response"},
+		{name: "timeout", reply: tunneltest.ReplySilent, want: "failed to read response"},
+		{name: "hang up", reply: tunneltest.ReplyHangUp, want: "failed to read response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := tunneltest.NewRelay(t, tt.reply)
+			c := newTestClient(t, Config{Target: newEchoTarget(t), Timeout: 500 * time.Millisecond}, relay.Endpoint())
+
+			_, err := c.Start(context.Background())
+			if err == nil {
+				t.Fatal("Start succeeded")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+			if tt.check != nil && !tt.check(err) {
+				t.Errorf("error %q has the wrong type", err)
+			}
+			status := c.Status()
+			if status.State != StateDisconnected || status.Wanted {
+				t.Errorf("status = %+v, want disconnected", status)
+			}
+			if status.Error != err.Error() {
+				t.Errorf("status error = %q, want %q", status.Error, err)
+			}
+		})
+	}
+}
+
+func TestClientUntrustedRelay(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	c := NewClient(Config{Relays: []string{relay.Endpoint()}, Target: newEchoTarget(t), Logger: quiet})
+	defer c.Close()
+
+	// The system roots don't know the test relay
+	_, err := c.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Start = %v, want a certificate error", err)
+	}
+	select {
+	case line := <-relay.Registers():
+		t.Errorf("sent %q to an untrusted relay", line)
+	default:
+	}
+}
+
+func TestClientFallsBackToNextRelay(t *testing.T) {
+	refusing := tunneltest.NewRelay(t, "ERR maintenance")
+	relay := tunneltest.NewRelay(t, "OK port:5000")
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, closedPort(t), refusing.Endpoint(), relay.Endpoint())
+
+	link, err := c.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if want := "127.0.0.1:5000"; link != want {
+		t.Errorf("link = %q, want %q", link, want)
+	}
+	refusing.Register()
+}
+
+func TestClientSendsToken(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	c := newTestClient(t, Config{Target: newEchoTarget(t), Token: "first-secret"}, relay.Endpoint())
+
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if register := relay.Register(); !strings.Contains(register, " token=first-secret") {
+		t.Errorf("REGISTER line %q lacks the token", register)
+	}
+
+	c.SetToken("second-secret")
+	c.Stop(context.Background())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if register := relay.Register(); !strings.Contains(register, " token=second-secret") {
+		t.Errorf("REGISTER line %q lacks the new token", register)
+	}
+}
+
+func TestClientTransport(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	transport := &countingTransport{}
+	c := newTestClient(t, Config{Target: newEchoTarget(t), Transport: transport}, relay.Endpoint())
+
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if len(transport.dialed) != 1 || transport.dialed[0] != relay.Endpoint() {
+		t.Errorf("transport dialed %v, want the relay", transport.dialed)
+	}
+}
+
+type countingTransport struct {
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (t *countingTransport) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	t.mu.Lock()
+	t.dialed = append(t.dialed, address)
+	t.mu.Unlock()
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func TestClientStartCancelled(t *testing.T) {
+	relay := tunneltest.NewRelay(t, tunneltest.ReplySilent)
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint(), relay.Endpoint())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		relay.Register()
+		cancel()
+	}()
+	start := time.Now()
+	_, err := c.Start(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Start = %v, want it cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > DefaultTimeout/2 {
+		t.Errorf("Start took %s to notice the cancellation", elapsed)
+	}
+	// The second relay isn't tried after a cancellation
+	select {
+	case line := <-relay.Registers():
+		t.Errorf("registered again after the cancellation: %q", line)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestClientStopAbandonsStart(t *testing.T) {
+	relay := tunneltest.NewRelay(t, tunneltest.ReplySilent)
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint())
+
+	started := make(chan error, 1)
+	go func() {
+		_, err := c.Start(context.Background())
+		started <- err
+	}()
+	relay.Register()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := <-started; err == nil {
+		t.Error("Start succeeded after Stop")
+	}
+	if status := c.Status(); status.State != StateDisconnected || status.Error != "" {
+		t.Errorf("status after Stop = %+v", status)
+	}
+}
+
+func TestClientStopRightAfterConnecting(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint())
+
+	started := make(chan error, 1)
+	go func() {
+		_, err := c.Start(context.Background())
+		started <- err
+	}()
+	relay.Register()
+
+	// Stop as the relay accepts, before Start takes the session: do what
+	// Stop does before it waits for Start
+	c.mu.Lock()
+	session := relay.Session()
+	time.Sleep(100 * time.Millisecond)
+	c.wanted = false
+	c.cancelStart()
+	c.mu.Unlock()
+
+	if err := <-started; !errors.Is(err, context.Canceled) {
+		t.Errorf("Start = %v, want it cancelled by Stop", err)
+	}
+	waitFor(t, 5*time.Second, "the relay session to close", session.IsClosed)
+	if status := c.Status(); status.State != StateDisconnected || status.Wanted {
+		t.Errorf("status after Stop = %+v, want disconnected and not wanted", status)
+	}
+}
+
+func TestClientReconnectsAfterSessionLoss(t *testing.T) {
+	t.Parallel()
+	relay := tunneltest.NewRelay(t, "OK port:4242", "ERR busy", "OK port:4343")
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	relay.Register()
+
+	// The relay drops the client; it retries, is refused once, then gets
+	// a new port
+	relay.Session().Close()
+	if e := nextEvent(t, c, EventLost); e.Err == nil {
+		t.Errorf("lost event without an error: %+v", e)
+	}
+	waitFor(t, 5*time.Second, "the client to start reconnecting", func() bool {
+		return c.Status().State == StateReconnecting
+	})
+	relay.Register()
+	relay.Register()
+	if e := nextEvent(t, c, EventNewLink, EventConnected); e.Type != EventNewLink || e.Link != "127.0.0.1:4343" {
+		t.Errorf("event after reconnecting = %+v, want the new link", e)
+	}
+	waitFor(t, 5*time.Second, "the retry loop to end", func() bool {
+		return c.Status().State == StateConnected
+	})
+
+	if stats := c.Stats(); stats.SessionsLost != 1 || stats.Reconnects != 1 || stats.ReconnectAttempts != 2 {
+		t.Errorf("sessions lost/reconnects/attempts = %d/%d/%d, want 1/1/2", stats.SessionsLost, stats.Reconnects, stats.ReconnectAttempts)
+	}
+
+	// And forwards again
+	stream, err := relay.Session().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(stream, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("echo after reconnecting = %q, %v", echo, err)
+	}
+}
+
+func TestClientStopsReconnectingWhenUpdateRequired(t *testing.T) {
+	t.Parallel()
+	relay := tunneltest.NewRelay(t, "OK port:4242", "UPDATE 9.0.0")
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	relay.Register()
+
+	relay.Session().Close()
+	relay.Register()
+	e := nextEvent(t, c, EventUpdateRequired)
+	var updateErr *UpdateRequiredError
+	if !errors.As(e.Err, &updateErr) || updateErr.Minimum != "9.0.0" {
+		t.Errorf("event = %+v, want the update required", e)
+	}
+	waitFor(t, 5*time.Second, "the retry loop to end", func() bool {
+		return c.Status().State == StateDisconnected
+	})
+	if status := c.Status(); status.Wanted || !strings.Contains(status.Error, "9.0.0") {
+		t.Errorf("status = %+v, want the update message", status)
+	}
+	noRegister(t, relay, "registered again after being told to update")
+}
+
+func TestClientGivesUp(t *testing.T) {
+	t.Parallel()
+	relay := tunneltest.NewRelay(t, "OK port:4242", "ERR busy")
+	c := newTestClient(t, Config{Target: newEchoTarget(t), ReconnectAttempts: 1}, relay.Endpoint())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	relay.Register()
+
+	relay.Session().Close()
+	e := nextEvent(t, c, EventGaveUp)
+	if e.Attempts != 1 || e.State != StateDisconnected {
+		t.Errorf("event = %+v", e)
+	}
+	if status := c.Status(); status.Wanted || status.Error != "gave up after 1 reconnect attempts" {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestClientStop(t *testing.T) {
+	t.Parallel()
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	relay.Register()
+	session := relay.Session()
+
+	if err := c.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	select {
+	case <-session.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay session stayed open after Stop")
+	}
+	status := c.Status()
+	if status.State != StateDisconnected || status.Link != "" || status.Error != "" || status.Wanted {
+		t.Errorf("status after Stop = %+v", status)
+	}
+	// A deliberate stop isn't a lost session
+	noRegister(t, relay, "reconnected after Stop")
+}
+
+func TestClientStopDuringReconnect(t *testing.T) {
+	t.Parallel()
+	relay := tunneltest.NewRelay(t, "OK port:4242", "ERR busy")
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	relay.Register()
+
+	relay.Session().Close()
+	waitFor(t, 5*time.Second, "the client to start reconnecting", func() bool {
+		return c.Status().State == StateReconnecting
+	})
+	c.Stop(context.Background())
+	if state := c.Status().State; state != StateDisconnected {
+		t.Errorf("state after Stop = %s, want disconnected", state)
+	}
+	noRegister(t, relay, "kept reconnecting after Stop")
+}
+
+func TestClientClose(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint())
+	c.Close()
+
+	for range c.Events() {
+	}
+	if _, err := c.Start(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Start after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,58 @@
+package tunnel
+
+// EventType says what an Event reports.
+type EventType string
+
+const (
+	// EventStateChanged is a change of state with nothing more to report,
+	// e.g. a connection attempt starting or failing.
+	EventStateChanged EventType = "stateChanged"
+	// EventConnected is a new relay session. Link is the shareable link.
+	EventConnected EventType = "connected"
+	// EventNewLink is a new relay session whose link differs from the last
+	// one, so whoever uses the link needs the new one.
+	EventNewLink EventType = "newLink"
+	// EventLost is a relay session that dropped unexpectedly. Err says
+	// why; a wanted tunnel starts reconnecting.
+	EventLost EventType = "lost"
+	// EventGaveUp is the end of a retry loop that used up
+	// Config.ReconnectAttempts, which Attempts repeats.
+	EventGaveUp EventType = "gaveUp"
+	// EventUpdateRequired is a relay turning this version away. Err is an
+	// *UpdateRequiredError; reconnecting stops until the client is
+	// started again.
+	EventUpdateRequired EventType = "updateRequired"
+)
+
+// Event is something that happened to a client.
+type Event struct {
+	Type EventType
+	// State is the client's state right after the event.
+	State    State
+	Link     string
+	Err      error
+	Attempts int
+}
+
+// Events returns the channel the client reports its events on. It is
+// buffered; events are dropped while nobody reads them, so treat them as
+// prompts to look at Status rather than a complete record. The channel is
+// closed by Close.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// emit sends e with the current state. It must be called without c.mu held.
+func (c *Client) emit(e Event) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	e.State = c.state()
+	select {
+	case c.events <- e:
+	default:
+		c.logger.Debug("event dropped, nobody is reading", "event", e.Type)
+	}
+}
@@ -0,0 +1,241 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	linkTestMarker  = "TATBEEB-LINK-TEST "
+	linkTestTimeout = 10 * time.Second
+	// linkTestPeekMin and linkTestPeekMax bound how long a stream that
+	// arrives during a test waits for its first bytes, a little over two
+	// relay round trips. The test sends the marker as soon as it connects;
+	// streams that stay silent that long, like a client waiting for the
+	// server to speak first, are forwarded without it.
+	linkTestPeekMin = 100 * time.Millisecond
+	linkTestPeekMax = time.Second
+	linkTestPings   = 5
+	linkTestPing    = 64
+	// linkTestBytes are echoed through the link to measure throughput.
+	linkTestBytes = 1 << 20
+)
+
+var linkTestReply = []byte("OK\n")
+
+// LinkTestResult is the outcome of dialing a client's shareable link from
+// this computer. Stage names the step that failed: "dial" (the link
+// couldn't be reached), "arrive" (the connection never came through this
+// tunnel) or "echo" (it came through but broke off).
+type LinkTestResult struct {
+	Link                  string  `json:"link"`
+	Success               bool    `json:"success"`
+	Stage                 string  `json:"stage,omitempty"`
+	Error                 string  `json:"error,omitempty"`
+	RTTMs                 float64 `json:"rttMs"`
+	RTTMinMs              float64 `json:"rttMinMs"`
+	Bytes                 int64   `json:"bytes"`
+	ThroughputBytesPerSec int64   `json:"throughputBytesPerSec"`
+}
+
+// linkTest is a test waiting for its connection to arrive as a stream.
+type linkTest struct {
+	marker  []byte
+	arrived int32
+}
+
+var (
+	// ErrLinkTestRunning is returned by TestLink while another test runs.
+	ErrLinkTestRunning = errors.New("a link test is already running")
+	// ErrNotConnected is returned by TestLink without a relay session.
+	ErrNotConnected = errors.New("tunnel is not connected")
+)
+
+// TestLink dials the client's public address and checks that the
+// connection arrives back as a stream. The stream is recognised by a
+// one-off marker and echoed instead of being forwarded, so the target is
+// never contacted. A test that fails at one of its stages is reported in
+// the result, not as an error.
+func (c *Client) TestLink(ctx context.Context) (LinkTestResult, error) {
+	c.mu.Lock()
+	link, connected := c.link, c.connected
+	if !connected {
+		c.mu.Unlock()
+		return LinkTestResult{}, ErrNotConnected
+	}
+	if c.linkTest != nil {
+		c.mu.Unlock()
+		return LinkTestResult{}, ErrLinkTestRunning
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		c.mu.Unlock()
+		return LinkTestResult{}, err
+	}
+	test := &linkTest{marker: []byte(linkTestMarker + hex.EncodeToString(nonce) + "\n")}
+	c.linkTest = test
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.linkTest = nil
+		c.mu.Unlock()
+	}()
+
+	logger := c.logger.With("link", link)
+	logger.Info("testing link")
+	result := LinkTestResult{Link: link}
+	fail := func(stage string, err error) (LinkTestResult, error) {
+		result.Stage = stage
+		result.Error = err.Error()
+		logger.Warn("link test failed", "stage", stage, "err", err)
+		return result, nil
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, linkTestTimeout)
+	var d net.Dialer
+	conn, err := d.DialContext(dialCtx, "tcp", link)
+	cancel()
+	if err != nil {
+		return fail("dial", err)
+	}
+	defer conn.Close()
+	// Cancelling ctx breaks off the test
+	defer watchContext(ctx, conn)()
+	conn.SetDeadline(time.Now().Add(linkTestTimeout))
+
+	if _, err := conn.Write(test.marker); err != nil {
+		return fail("dial", err)
+	}
+	reply := make([]byte, len(linkTestReply))
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, linkTestReply) {
+		if err == nil {
+			err = fmt.Errorf("unexpected reply %q", reply)
+		}
+		return fail("arrive", err)
+	}
+
+	// Round trips of a small payload, like a database query
+	ping := make([]byte, linkTestPing)
+	echo := make([]byte, linkTestPing)
+	var total, best time.Duration
+	for i := 0; i < linkTestPings; i++ {
+		start := time.Now()
+		if _, err := conn.Write(ping); err != nil {
+			return fail("echo", err)
+		}
+		if _, err := io.ReadFull(conn, echo); err != nil {
+			return fail("echo", err)
+		}
+		rtt := time.Since(start)
+		total += rtt
+		if best == 0 || rtt < best {
+			best = rtt
+		}
+	}
+	result.RTTMs = float64(total/linkTestPings) / float64(time.Millisecond)
+	result.RTTMinMs = float64(best) / float64(time.Millisecond)
+
+	// Then a burst, written while the echo is read back
+	conn.SetDeadline(time.Now().Add(linkTestTimeout))
+	start := time.Now()
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(conn, zeroReader{}, linkTestBytes)
+		writeErr <- err
+	}()
+	n, err := io.CopyN(io.Discard, conn, linkTestBytes)
+	elapsed := time.Since(start)
+	result.Bytes = n
+	if err != nil {
+		return fail("echo", err)
+	}
+	if err := <-writeErr; err != nil {
+		return fail("echo", err)
+	}
+	result.ThroughputBytesPerSec = int64(float64(n) / elapsed.Seconds())
+
+	result.Success = true
+	logger.Info("link test passed",
+		"rtt", (total / linkTestPings).Round(time.Microsecond),
+		"bytesPerSec", result.ThroughputBytesPerSec)
+	return result, nil
+}
+
+// zeroReader is an endless source of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// pendingLinkTest returns the test still waiting for its stream, if any.
+func (c *Client) pendingLinkTest() *linkTest {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.linkTest == nil || atomic.LoadInt32(&c.linkTest.arrived) != 0 {
+		return nil
+	}
+	return c.linkTest
+}
+
+// linkTestPeek is how long a stream that arrives during a test waits for
+// its first bytes.
+func (c *Client) linkTestPeek() time.Duration {
+	rtt := time.Duration(atomic.LoadInt64(&c.counters.rtt))
+	if rtt == 0 {
+		return linkTestPeekMax
+	}
+	return min(2*rtt+linkTestPeekMin, linkTestPeekMax)
+}
+
+// checkLinkTestStream reads the start of a stream that arrived during a
+// link test, only for as long as it matches the marker. The test's own
+// stream is echoed; any other is handed on with what was read put back in
+// front, as soon as it differs from the marker or stays silent.
+func (c *Client) checkLinkTestStream(test *linkTest, stream net.Conn, streamNum int64) {
+	buf := make([]byte, len(test.marker))
+	n := 0
+	stream.SetReadDeadline(time.Now().Add(c.linkTestPeek()))
+	for n < len(buf) && bytes.HasPrefix(test.marker, buf[:n]) {
+		read, err := stream.Read(buf[n:])
+		n += read
+		if err != nil {
+			break
+		}
+	}
+	stream.SetReadDeadline(time.Time{})
+	head := buf[:n]
+
+	if !bytes.Equal(head, test.marker) || !atomic.CompareAndSwapInt32(&test.arrived, 0, 1) {
+		c.admitStream(&peekedConn{Conn: stream, r: io.MultiReader(bytes.NewReader(head), stream)}, streamNum)
+		return
+	}
+
+	defer stream.Close()
+	c.logger.Debug("link test stream arrived", "stream", streamNum)
+	stream.SetDeadline(time.Now().Add(2 * linkTestTimeout))
+	if _, err := stream.Write(linkTestReply); err != nil {
+		return
+	}
+	io.CopyN(stream, stream, linkTestPings*linkTestPing+linkTestBytes)
+}
+
+// peekedConn replays bytes read ahead before the rest of the connection.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,177 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel/tunneltest"
+)
+
+// servePublic plays the relay's public side: every connection to ln
+// becomes a stream of session.
+func servePublic(ln net.Listener, session *yamux.Session) {
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		stream, err := session.Open()
+		if err != nil {
+			client.Close()
+			return
+		}
+		go func() {
+			go func() {
+				io.Copy(stream, client)
+				stream.Close()
+			}()
+			io.Copy(client, stream)
+			client.Close()
+		}()
+	}
+}
+
+func TestLinkTest(t *testing.T) {
+	// A relay that, like the real one, listens on the port it hands out
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	_, port, _ := net.SplitHostPort(public.Addr().String())
+	relay := tunneltest.NewRelay(t, "OK port:"+port)
+
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint())
+	if _, err := c.TestLink(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("TestLink before Start = %v, want ErrNotConnected", err)
+	}
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	go servePublic(public, relay.Session())
+
+	result, err := c.TestLink(context.Background())
+	if err != nil {
+		t.Fatalf("TestLink: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("link test failed at %s: %s", result.Stage, result.Error)
+	}
+	if result.Bytes != linkTestBytes || result.ThroughputBytesPerSec <= 0 || result.RTTMs <= 0 {
+		t.Errorf("result = %+v", result)
+	}
+	// The echo never reached the target
+	if accepted := c.Stats().StreamsAccepted; accepted != 0 {
+		t.Errorf("%d streams were forwarded to the target", accepted)
+	}
+}
+
+func TestLinkTestNotArriving(t *testing.T) {
+	// The relay hands out a port that reaches something else
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	go func() {
+		for {
+			conn, err := other.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(other.Addr().String())
+	relay := tunneltest.NewRelay(t, "OK port:"+port)
+
+	c := newTestClient(t, Config{Target: newEchoTarget(t)}, relay.Endpoint())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	result, err := c.TestLink(context.Background())
+	if err != nil {
+		t.Fatalf("TestLink: %v", err)
+	}
+	if result.Success || result.Stage != "arrive" {
+		t.Errorf("result = %+v, want a failure to arrive", result)
+	}
+}
+
+func TestLinkTestPassesOtherStreamsThrough(t *testing.T) {
+	// A target that speaks first, like MySQL, and then echoes
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.WriteString(conn, "hello\n")
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	c := newTestClient(t, Config{Target: target.Addr().String()}, relay.Endpoint())
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	session := relay.Session()
+
+	// A test is waiting for its stream over a link with a 10ms round trip
+	c.mu.Lock()
+	c.linkTest = &linkTest{marker: []byte(linkTestMarker + "0011223344556677\n")}
+	c.mu.Unlock()
+	atomic.StoreInt64(&c.counters.rtt, int64(10*time.Millisecond))
+
+	read := func(stream net.Conn, n int) (string, time.Duration) {
+		t.Helper()
+		start := time.Now()
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return string(buf), time.Since(start)
+	}
+
+	// A client that waits for the server's greeting
+	silent, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	if got, elapsed := read(silent, 6); got != "hello\n" || elapsed > 500*time.Millisecond {
+		t.Errorf("silent stream got %q after %s, want the greeting within the short peek", got, elapsed)
+	}
+
+	// A client that speaks first, with bytes that aren't the marker
+	talker, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer talker.Close()
+	start := time.Now()
+	io.WriteString(talker, "TAT")
+	io.WriteString(talker, "X")
+	if got, _ := read(talker, 10); got != "hello\nTATX" || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("stream got %q after %s, want it forwarded with the bytes read put back", got, time.Since(start))
+	}
+	if accepted := c.Stats().StreamsAccepted; accepted != 2 {
+		t.Errorf("%d streams forwarded, want 2", accepted)
+	}
+}
@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// DefaultTimeout bounds connecting to a relay, the TLS handshake and the
+// wait for the reply to REGISTER when Config.Timeout is zero.
+const DefaultTimeout = 10 * time.Second
+
+// ErrRefused is a relay's "ERR" reply to REGISTER.
+var ErrRefused = errors.New("relay refused the tunnel")
+
+// ErrUnauthorized is a refusal because the relay requires a token and the
+// one sent, if any, is wrong. Such an error matches ErrRefused too.
+var ErrUnauthorized = errors.New("the relay token is missing or wrong")
+
+// UpdateRequiredError is a relay's refusal of this version: it replied
+// "UPDATE <minimum version> [message]" to REGISTER.
+type UpdateRequiredError struct {
+	Minimum string
+	Message string
+	// Version is the version the relay turned away.
+	Version string
+}
+
+func (e *UpdateRequiredError) Error() string {
+	msg := fmt.Sprintf("the relay requires Tatbeeb Link %s or later (this is %s), please update", e.Minimum, e.Version)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Registration is what a client tells the relay about itself.
+type Registration struct {
+	Version  string
+	Platform string
+	// Token is the shared secret of a relay that only serves its own
+	// agents; empty sends none.
+	Token string
+	// DryRun asks the relay to go through the same checks without opening
+	// a public port. The diagnostics use it.
+	DryRun bool
+}
+
+// Register sends REGISTER on a fresh relay connection and returns the port
+// the relay assigned. ctx bounds the wait for the reply.
+//
+// REGISTER carries the version and platform, and the token if there is
+// one, so a relay can turn away
+// clients it no longer supports with "UPDATE <minimum version>", or refuse
+// with "ERR <reason>". Otherwise it answers "OK port:<port>".
+func Register(ctx context.Context, conn net.Conn, reg Registration) (string, error) {
+	registerMsg := fmt.Sprintf("REGISTER version=%s platform=%s", reg.Version, reg.Platform)
+	if reg.Token != "" {
+		registerMsg += " token=" + reg.Token
+	}
+	if reg.DryRun {
+		registerMsg += " dryrun=1"
+	}
+
+	defer watchContext(ctx, conn)()
+	if _, err := conn.Write([]byte(registerMsg + "\n")); err != nil {
+		return "", fmt.Errorf("failed to send register: %w", err)
+	}
+
+	// Read response byte-by-byte to avoid buffering issues with yamux
+	var response strings.Builder
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return "", fmt.Errorf("failed to read response: %w", err)
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		response.WriteByte(buf[0])
+	}
+
+	responseStr := strings.TrimSpace(response.String())
+	parts := strings.Split(responseStr, " ")
+	switch parts[0] {
+	case "UPDATE":
+		err := &UpdateRequiredError{Message: strings.Join(parts[min(2, len(parts)):], " "), Version: reg.Version}
+		if len(parts) > 1 {
+			err.Minimum = parts[1]
+		}
+		return "", err
+	case "ERR":
+		reason := strings.Join(parts[1:], " ")
+		if reason == "unauthorized" {
+			return "", fmt.Errorf("%w: %w", ErrRefused, ErrUnauthorized)
+		}
+		return "", fmt.Errorf("%w: %s", ErrRefused, reason)
+	}
+	if len(parts) < 2 || parts[0] != "OK" {
+		return "", fmt.Errorf("unexpected response: %s", responseStr)
+	}
+
+	portParts := strings.Split(parts[1], ":")
+	if len(portParts) != 2 || portParts[0] != "port" {
+		return "", fmt.Errorf("invalid port format: %s", parts[1])
+	}
+	return portParts[1], nil
+}
+
+// watchContext applies ctx's deadline to conn and interrupts it when ctx is
+// cancelled. The returned function undoes both; call it before conn is used
+// for anything else.
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// NewSession wraps a registered relay connection in a yamux client session.
+// yamux's own diagnostics go to logger as warnings.
+func NewSession(conn net.Conn, logger *slog.Logger) (*yamux.Session, error) {
+	yamuxConfig := yamux.DefaultConfig()
+	yamuxConfig.LogOutput = nil
+	yamuxConfig.Logger = slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
+	session, err := yamux.Client(conn, yamuxConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create yamux session: %w", err)
+	}
+	return session, nil
+}
@@ -0,0 +1,298 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// rttInterval is how often a connected client pings the relay.
+const rttInterval = 15 * time.Second
+
+// Reasons a forwarded stream ended, in Stream.Reason. Streams that broke
+// off give the error instead.
+const (
+	ReasonClientClosed = "client closed"
+	ReasonTargetClosed = "target closed"
+)
+
+// Stream is one connection the relay handed over. The relay does not pass
+// on the client's own address.
+type Stream struct {
+	// ID numbers the client's streams from 1.
+	ID int64
+	// Remote is the peer of the stream as the client sees it: the relay.
+	Remote string
+	// TargetAddr is the address the target was reached at, or the one
+	// that failed.
+	TargetAddr string
+	Opened     time.Time
+	Closed     time.Time
+	// BytesIn went from the relay to the target, BytesOut back.
+	BytesIn  int64
+	BytesOut int64
+	// Reason is why the stream ended.
+	Reason string
+	// Err is set when the stream never reached the target: Hooks.Accept
+	// rejected it, in which case Rejected is set too, or the target
+	// couldn't be dialed.
+	Err      error
+	Rejected bool
+}
+
+// Hooks let the owner of a client follow and police its streams. They are
+// called on the stream's goroutine and should return quickly.
+type Hooks struct {
+	// Accept is called for every new stream before the target is dialed.
+	// An error turns the stream away, with "rejected: " and the error as
+	// the reason.
+	Accept func(Stream) error
+	// Opened is called once a stream is connected to the target.
+	Opened func(Stream)
+	// Closed is called when a stream ends, including those that were
+	// rejected or couldn't reach the target.
+	Closed func(Stream)
+}
+
+// Stats are a client's counters since it was created.
+type Stats struct {
+	ActiveStreams   int64
+	StreamsAccepted int64
+	StreamsRejected int64
+	// TargetFailures counts accepted streams the target dialer failed.
+	TargetFailures int64
+	// BytesIn went from the relay to the target, BytesOut back. Both move
+	// while streams are open.
+	BytesIn           int64
+	BytesOut          int64
+	SessionsLost      int64
+	ReconnectAttempts int64
+	Reconnects        int64
+	// RTT is the last measured round trip to the relay, zero while unknown.
+	RTT time.Duration
+}
+
+// counters back Stats. The zero value is ready to use.
+type counters struct {
+	activeStreams     int64
+	streamsAccepted   int64
+	streamsRejected   int64
+	targetFailures    int64
+	bytesIn           int64
+	bytesOut          int64
+	sessionsLost      int64
+	reconnectAttempts int64
+	reconnects        int64
+	rtt               int64
+}
+
+// Stats returns the client's counters.
+func (c *Client) Stats() Stats {
+	return Stats{
+		ActiveStreams:     atomic.LoadInt64(&c.counters.activeStreams),
+		StreamsAccepted:   atomic.LoadInt64(&c.counters.streamsAccepted),
+		StreamsRejected:   atomic.LoadInt64(&c.counters.streamsRejected),
+		TargetFailures:    atomic.LoadInt64(&c.counters.targetFailures),
+		BytesIn:           atomic.LoadInt64(&c.counters.bytesIn),
+		BytesOut:          atomic.LoadInt64(&c.counters.bytesOut),
+		SessionsLost:      atomic.LoadInt64(&c.counters.sessionsLost),
+		ReconnectAttempts: atomic.LoadInt64(&c.counters.reconnectAttempts),
+		Reconnects:        atomic.LoadInt64(&c.counters.reconnects),
+		RTT:               time.Duration(atomic.LoadInt64(&c.counters.rtt)),
+	}
+}
+
+func (c *Client) acceptStreams(session *yamux.Session) {
+	for {
+		// Accept incoming streams from relay (each stream = one client connection)
+		stream, err := session.AcceptStream()
+		if err != nil {
+			c.mu.Lock()
+			// Only report the loss if Stop hasn't already replaced the session
+			lost := c.session == session
+			if lost {
+				c.connected = false
+				c.lastError = "relay connection lost"
+			}
+			wanted := c.wanted
+			c.mu.Unlock()
+
+			if lost {
+				atomic.AddInt64(&c.counters.sessionsLost, 1)
+				c.logger.Warn("relay session closed", "err", err)
+				c.emit(Event{Type: EventLost, Err: err})
+			} else {
+				c.logger.Debug("relay session closed", "err", err)
+			}
+			if lost && wanted {
+				c.KeepTrying()
+			}
+			return
+		}
+
+		streamNum := atomic.AddInt64(&c.streamCount, 1)
+		if test := c.pendingLinkTest(); test != nil {
+			go c.checkLinkTestStream(test, stream, streamNum)
+			continue
+		}
+		c.admitStream(stream, streamNum)
+	}
+}
+
+// admitStream forwards a new stream to the target unless Hooks.Accept turns
+// it away.
+func (c *Client) admitStream(stream net.Conn, streamNum int64) {
+	s := Stream{ID: streamNum, Remote: stream.RemoteAddr().String(), Opened: time.Now()}
+	if accept := c.cfg.Hooks.Accept; accept != nil {
+		if err := accept(s); err != nil {
+			atomic.AddInt64(&c.counters.streamsRejected, 1)
+			c.logger.Warn("stream rejected", "stream", streamNum, "err", err)
+			stream.Close()
+			s.Closed = s.Opened
+			s.Err = err
+			s.Rejected = true
+			s.Reason = "rejected: " + err.Error()
+			if closed := c.cfg.Hooks.Closed; closed != nil {
+				closed(s)
+			}
+			return
+		}
+	}
+
+	// Handle each stream in a goroutine
+	atomic.AddInt64(&c.counters.streamsAccepted, 1)
+	atomic.AddInt64(&c.counters.activeStreams, 1)
+	go c.handleStream(stream, s)
+}
+
+func (c *Client) handleStream(stream net.Conn, s Stream) {
+	defer stream.Close()
+	defer atomic.AddInt64(&c.counters.activeStreams, -1)
+	defer func() {
+		s.Closed = time.Now()
+		if closed := c.cfg.Hooks.Closed; closed != nil {
+			closed(s)
+		}
+	}()
+
+	logger := c.logger.With("stream", s.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), targetDialTimeout)
+	localConn, err := c.dialTarget(ctx)
+	cancel()
+	if err != nil {
+		atomic.AddInt64(&c.counters.targetFailures, 1)
+		logger.Error("failed to connect to target", "err", err)
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Addr != nil {
+			s.TargetAddr = opErr.Addr.String()
+		}
+		s.Err = err
+		s.Reason = err.Error()
+		return
+	}
+	defer localConn.Close()
+
+	s.TargetAddr = localConn.RemoteAddr().String()
+	logger.Info("stream opened", "addr", s.TargetAddr)
+	if opened := c.cfg.Hooks.Opened; opened != nil {
+		opened(s)
+	}
+
+	// Forward data bidirectionally. Each direction reports why it ended;
+	// the first one to end is the close reason.
+	var bytesIn, bytesOut int64
+	done := make(chan string, 2)
+
+	// Stream -> Local
+	go func() {
+		n, err := io.Copy(countingWriter{localConn, &c.counters.bytesIn}, stream)
+		atomic.StoreInt64(&bytesIn, n)
+		if err != nil {
+			logger.Debug("relay to local copy ended", "err", err)
+			done <- "relay error: " + err.Error()
+			return
+		}
+		done <- ReasonClientClosed
+	}()
+
+	// Local -> Stream
+	go func() {
+		n, err := io.Copy(countingWriter{stream, &c.counters.bytesOut}, localConn)
+		atomic.StoreInt64(&bytesOut, n)
+		if err != nil {
+			logger.Debug("local to relay copy ended", "err", err)
+			done <- "target error: " + err.Error()
+			return
+		}
+		done <- ReasonTargetClosed
+	}()
+
+	// Wait for either direction to close, then close both ends so the
+	// other direction finishes and reports its byte count
+	s.Reason = <-done
+	stream.Close()
+	localConn.Close()
+	<-done
+
+	s.BytesIn = atomic.LoadInt64(&bytesIn)
+	s.BytesOut = atomic.LoadInt64(&bytesOut)
+	logger.Info("stream closed",
+		"bytesIn", s.BytesIn,
+		"bytesOut", s.BytesOut,
+		"reason", s.Reason,
+		"duration", time.Since(s.Opened).Round(time.Millisecond))
+}
+
+// dialTarget connects to the target through Config.DialTarget, or to
+// Config.Target over TCP.
+func (c *Client) dialTarget(ctx context.Context) (net.Conn, error) {
+	if c.cfg.DialTarget != nil {
+		return c.cfg.DialTarget(ctx)
+	}
+	if c.cfg.Target == "" {
+		return nil, errors.New("no target configured")
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", c.cfg.Target)
+}
+
+// countingWriter adds everything written through it to a counter, so byte
+// totals move while a long-lived connection is still open.
+type countingWriter struct {
+	w     io.Writer
+	total *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.total, int64(n))
+	return n, err
+}
+
+// monitorSession measures the relay round trip until the session closes.
+func (c *Client) monitorSession(session *yamux.Session) {
+	ticker := time.NewTicker(rttInterval)
+	defer ticker.Stop()
+	defer atomic.StoreInt64(&c.counters.rtt, 0)
+
+	for {
+		rtt, err := session.Ping()
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&c.counters.rtt, int64(rtt))
+		c.logger.Debug("relay ping", "rtt", rtt)
+
+		select {
+		case <-ticker.C:
+		case <-session.CloseChan():
+			return
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package tunneltest provides an in-process relay for testing code that
+// uses package tunnel, without a network or the real relay.
+package tunneltest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Scripted replies for Relay besides the protocol's own lines.
+const (
+	// ReplySilent reads REGISTER and never answers.
+	ReplySilent = "\x00silent"
+	// ReplyHangUp closes the connection without answering.
+	ReplyHangUp = "\x00hangup"
+)
+
+// waitTimeout bounds Register and Session.
+const waitTimeout = 10 * time.Second
+
+var (
+	certOnce sync.Once
+	cert     tls.Certificate
+	roots    *x509.CertPool
+)
+
+// Certificate returns a self-signed certificate for 127.0.0.1 and
+// localhost, and a pool that trusts it. It is made once per test binary.
+func Certificate() (tls.Certificate, *x509.CertPool) {
+	certOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "test relay"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(24 * time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			DNSNames:              []string{"localhost"},
+			IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			panic(err)
+		}
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			panic(err)
+		}
+		cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+		roots = x509.NewCertPool()
+		roots.AddCert(leaf)
+	})
+	return cert, roots
+}
+
+// ClientTLS returns a client configuration that trusts Certificate.
+func ClientTLS() *tls.Config {
+	_, roots := Certificate()
+	return &tls.Config{RootCAs: roots}
+}
+
+// Relay is an in-process relay whose reply to REGISTER is scripted. After
+// an "OK" it runs the server side of the yamux session, so a test can open
+// streams to the client and kill the session.
+type Relay struct {
+	t  testing.TB
+	ln net.Listener
+
+	mu      sync.Mutex
+	replies []string
+	open    []*yamux.Session
+
+	registers chan string
+	sessions  chan *yamux.Session
+}
+
+// NewRelay starts a relay that answers REGISTER with replies in turn,
+// repeating the last one. It is shut down when the test ends.
+func NewRelay(t testing.TB, replies ...string) *Relay {
+	t.Helper()
+	if len(replies) == 0 {
+		t.Fatal("tunneltest: NewRelay needs at least one reply")
+	}
+	cert, _ := Certificate()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Relay{
+		t:         t,
+		ln:        ln,
+		replies:   replies,
+		registers: make(chan string, 64),
+		sessions:  make(chan *yamux.Session, 16),
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, session := range r.open {
+			session.Close()
+		}
+	})
+	go r.serve()
+	return r
+}
+
+// Endpoint is the relay's host:port.
+func (r *Relay) Endpoint() string {
+	return r.ln.Addr().String()
+}
+
+// Registers delivers every REGISTER line the relay read, while a test
+// keeps up; it is for checking that none arrive.
+func (r *Relay) Registers() <-chan string {
+	return r.registers
+}
+
+// Register waits for the next REGISTER line.
+func (r *Relay) Register() string {
+	r.t.Helper()
+	select {
+	case line := <-r.registers:
+		return line
+	case <-time.After(waitTimeout):
+		r.t.Fatal("timed out waiting for REGISTER")
+		return ""
+	}
+}
+
+// Session waits for the next session a client opened with an "OK".
+func (r *Relay) Session() *yamux.Session {
+	r.t.Helper()
+	select {
+	case s := <-r.sessions:
+		return s
+	case <-time.After(waitTimeout):
+		r.t.Fatal("timed out waiting for a relay session")
+		return nil
+	}
+}
+
+func (r *Relay) nextReply() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reply := r.replies[0]
+	if len(r.replies) > 1 {
+		r.replies = r.replies[1:]
+	}
+	return reply
+}
+
+func (r *Relay) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *Relay) handle(conn net.Conn) {
+	line, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case r.registers <- line:
+	default:
+	}
+
+	switch reply := r.nextReply(); reply {
+	case ReplySilent:
+		// Hold the connection open until the client gives up
+		io.Copy(io.Discard, conn)
+		conn.Close()
+		return
+	case ReplyHangUp:
+		conn.Close()
+		return
+	default:
+		if _, err := io.WriteString(conn, reply+"\n"); err != nil || !strings.HasPrefix(reply, "OK") {
+			conn.Close()
+			return
+		}
+	}
+
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	session, err := yamux.Server(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	r.mu.Lock()
+	r.open = append(r.open, session)
+	r.mu.Unlock()
+	r.sessions <- session
+}
+
+// readLine reads one line a byte at a time, leaving the rest for yamux.
+func readLine(conn net.Conn) (string, error) {
+	var line strings.Builder
+	buf := make([]byte, 1)
+	for line.Len() < 512 {
+		if _, err := conn.Read(buf); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return strings.TrimSpace(line.String()), nil
+		}
+		line.WriteByte(buf[0])
+	}
+	return "", io.ErrShortBuffer
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link-tray/tunnel/tunneltest"
+)
+
+func TestTunnelForwardsStreams(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	app := newTestApp(t, newEchoTarget(t), relay.Endpoint())
+	tunnel := app.tunnel("test")
+
+	link, err := tunnel.Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if want := "127.0.0.1:4242"; link != want {
+		t.Errorf("link = %q, want %q", link, want)
+	}
+	register := relay.Register()
+	for _, field := range []string{"version=" + build.Version, "platform=" + build.Platform} {
+		if !strings.Contains(register, field) {
+			t.Errorf("REGISTER line %q lacks %q", register, field)
+		}
+	}
+	if status := tunnel.Status(); status.State != StateConnected || status.ShareableLink != link || status.ConnectedAt == nil {
+		t.Errorf("status = %+v, want connected %q", status, link)
+	}
+
+	stream, err := relay.Session().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("SELECT 1"))
+	echo := make([]byte, len("SELECT 1"))
+	if _, err := io.ReadFull(stream, echo); err != nil || string(echo) != "SELECT 1" {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+	stream.Close()
+
+	waitFor(t, 5*time.Second, "the stream to close", func() bool {
+		return tunnel.Status().ActiveStreams == 0
+	})
+	if status := tunnel.Status(); status.BytesIn != 8 || status.BytesOut != 8 {
+		t.Errorf("bytes in/out = %d/%d, want 8 each", status.BytesIn, status.BytesOut)
+	}
+	if _, _, count := tunnel.metrics.dialLatency.snapshot(); count != 1 {
+		t.Errorf("dial latency observations = %d, want 1", count)
+	}
+
+	// The tray hears about it
+	waitFor(t, 5*time.Second, "a tray update", func() bool {
+		select {
+		case update := <-app.statusChannel:
+			return update.TunnelID == "test" && update.Connected
+		default:
+			return false
+		}
+	})
+}
+
+func TestTunnelTargetDown(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	app := newTestApp(t, closedPort(t), relay.Endpoint())
+	tunnel := app.tunnel("test")
+	if _, err := tunnel.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	stream, err := relay.Session().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from a stream to a stopped target = %v, want EOF", err)
+	}
+	waitFor(t, 5*time.Second, "the dial failure to be counted", func() bool {
+		return atomic.LoadInt64(&tunnel.metrics.dialFailures) == 1
+	})
+	if resolveFailures := atomic.LoadInt64(&tunnel.metrics.resolveFailures); resolveFailures != 0 {
+		t.Errorf("resolve failures = %d, want 0", resolveFailures)
+	}
+	// The relay session stays up for the next client
+	if !tunnel.Status().Connected {
+		t.Error("tunnel disconnected after a target failure")
+	}
+}
+
+func TestTunnelConnectionLimit(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	app := newTestApp(t, newEchoTarget(t), relay.Endpoint())
+	if err := app.settings.Update(func(s *Settings) error {
+		s.Policies.MaxStreams = 1
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tunnel := app.tunnel("test")
+	if _, err := tunnel.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	session := relay.Session()
+
+	first, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("ping"))
+	if _, err := io.ReadFull(first, make([]byte, 4)); err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+
+	second, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from a stream over the limit = %v, want EOF", err)
+	}
+	if stats := tunnel.client.Stats(); stats.StreamsAccepted != 1 || stats.StreamsRejected != 1 {
+		t.Errorf("accepted/rejected = %d/%d, want 1/1", stats.StreamsAccepted, stats.StreamsRejected)
+	}
+}
+
+func TestTunnelUsesSavedRelays(t *testing.T) {
+	relay := tunneltest.NewRelay(t, "OK port:4242")
+	app := newTestApp(t, newEchoTarget(t), closedPort(t))
+	tunnel := app.tunnel("test")
+
+	// The relay is changed in the dashboard after the tunnel was first
+	// shown
+	if err := app.settings.Update(func(s *Settings) error {
+		s.Relay.Endpoints = []string{relay.Endpoint()}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app.syncTunnels()
+
+	if _, err := tunnel.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	relay.Register()
+}
+
+func TestTunnelStopsReconnectingWhenUpdateRequired(t *testing.T) {
+	t.Parallel()
+	relay := tunneltest.NewRelay(t, "OK port:4242", "UPDATE 9.0.0")
+	app := newTestApp(t, newEchoTarget(t), relay.Endpoint())
+	tunnel := app.tunnel("test")
+	if _, err := tunnel.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	relay.Register()
+
+	relay.Session().Close()
+	relay.Register()
+	waitFor(t, 10*time.Second, "the retry loop to end", func() bool {
+		return tunnel.Status().State == StateDisconnected
+	})
+	if status := tunnel.Status(); !strings.Contains(status.Error, "9.0.0") {
+		t.Errorf("status error = %q, want the update message", status.Error)
+	}
+	if tunnel.active() || !app.allGaveUp([]string{"test"}) {
+		t.Error("the tunnel is still trying after being told to update")
+	}
+}
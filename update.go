@@ -0,0 +1,973 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// updatePublicKey is the base64 ed25519 key release binaries are signed
+// with. Release builds set it with
+//
+//	-ldflags "-X main.updatePublicKey=<key>"
+//
+// and "tatbeeb-link update keygen" prints it. Builds without a key never
+// install updates, as they couldn't tell a real one from a forged one.
+var updatePublicKey = ""
+
+var errNoUpdateKey = errors.New("this build has no update signing key, so updates can't be verified")
+
+const (
+	// updateStateName records an installed update until it is committed or
+	// rolled back.
+	updateStateName = "update.json"
+
+	updateCheckDelay    = time.Minute
+	updateCheckInterval = 6 * time.Hour
+	// A new version that keeps running for updateTrialPeriod is kept. One
+	// that exits with an error first, or fails to start maxUpdateStarts
+	// times, is replaced by the previous version again.
+	updateTrialPeriod = time.Minute
+	maxUpdateStarts   = 3
+
+	maxManifestSize       = 1 << 20
+	maxUpdateSize         = 200 << 20
+	updateManifestTimeout = 30 * time.Second
+	updateDownloadTimeout = 10 * time.Minute
+	updateCheckTimeout    = 15 * time.Second
+)
+
+// executable is the path this process was started from, resolved before an
+// update moves it.
+var executable = currentExecutable()
+
+func currentExecutable() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	return exe
+}
+
+// updateManifest is the release feed: the latest version and a build for
+// each platform.
+type updateManifest struct {
+	Version string `json:"version"`
+	Notes   string `json:"notes,omitempty"`
+	// Assets maps GOOS/GOARCH, e.g. windows/amd64, to that build.
+	Assets map[string]updateAsset `json:"assets"`
+}
+
+type updateAsset struct {
+	// URL may be relative to the manifest.
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	// Signature is the base64 ed25519 signature of updateMessage.
+	Signature string `json:"signature"`
+}
+
+// updateMessage is what a release signature covers. Naming the version and
+// platform stops an old or foreign build from being passed off as this one.
+func updateMessage(version, platform, sha256Hex string) []byte {
+	return []byte(fmt.Sprintf("tatbeeb-link-update\n%s\n%s\n%s\n", version, platform, strings.ToLower(sha256Hex)))
+}
+
+func updatePlatform() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+func updateKey() (ed25519.PublicKey, error) {
+	if updatePublicKey == "" {
+		return nil, errNoUpdateKey
+	}
+	return decodePublicKey(updatePublicKey)
+}
+
+// checkUpdateURL allows HTTPS, and plain HTTP to this machine for testing
+// against a local manifest server. Signatures protect the binary either
+// way; HTTPS keeps the feed from being withheld or replayed.
+func checkUpdateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid update URL %q", raw)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if ip := net.ParseIP(u.Hostname()); u.Hostname() == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("update URL %q must use https", raw)
+}
+
+// parseVersion splits a version such as 1.2.0 or v1.3.0-beta.1 into its
+// numbers and pre-release part.
+func parseVersion(v string) ([]int, string, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(v), "v")
+	rest, _, _ = strings.Cut(rest, "+")
+	rest, pre, _ := strings.Cut(rest, "-")
+	var nums []int
+	for _, part := range strings.Split(rest, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("invalid version %q", v)
+		}
+		nums = append(nums, n)
+	}
+	return nums, pre, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b. A pre-release is older than its release, and pre-releases
+// are ordered as semver orders them. Unparsable versions compare as 0.0.0.
+func compareVersions(a, b string) int {
+	na, preA, _ := parseVersion(a)
+	nb, preB, _ := parseVersion(b)
+	for i := 0; i < max(len(na), len(nb)); i++ {
+		var x, y int
+		if i < len(na) {
+			x = na[i]
+		}
+		if i < len(nb) {
+			y = nb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return comparePrerelease(preA, preB)
+}
+
+// comparePrerelease orders pre-release parts such as beta.9 and beta.10 by
+// their dot-separated identifiers: numeric ones as numbers and below
+// alphanumeric ones, the rest as text, and a shorter list first when all
+// its identifiers match.
+func comparePrerelease(a, b string) int {
+	idsA, idsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < min(len(idsA), len(idsB)); i++ {
+		x, y := idsA[i], idsB[i]
+		if x == y {
+			continue
+		}
+		nx, errX := strconv.ParseUint(x, 10, 64)
+		ny, errY := strconv.ParseUint(y, 10, 64)
+		switch {
+		case errX == nil && errY == nil:
+			if nx < ny {
+				return -1
+			}
+			return 1
+		case errX == nil:
+			return -1
+		case errY == nil:
+			return 1
+		case x < y:
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(idsA) < len(idsB):
+		return -1
+	case len(idsA) > len(idsB):
+		return 1
+	}
+	return 0
+}
+
+func newUpdateRequest(ctx context.Context, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "tatbeeb-link/"+Version)
+	return req, nil
+}
+
+// fetchUpdateManifest reads the feed and returns its build for this
+// platform, with the URL made absolute.
+func fetchUpdateManifest(feed string) (*updateManifest, updateAsset, error) {
+	if feed == "" {
+		return nil, updateAsset{}, errors.New("no update feed is configured")
+	}
+	if err := checkUpdateURL(feed); err != nil {
+		return nil, updateAsset{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), updateManifestTimeout)
+	defer cancel()
+	req, err := newUpdateRequest(ctx, feed)
+	if err != nil {
+		return nil, updateAsset{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, updateAsset{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, updateAsset{}, fmt.Errorf("update feed returned %s", resp.Status)
+	}
+
+	var m updateManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&m); err != nil {
+		return nil, updateAsset{}, fmt.Errorf("invalid update manifest: %w", err)
+	}
+	if _, _, err := parseVersion(m.Version); err != nil {
+		return nil, updateAsset{}, fmt.Errorf("invalid update manifest: %w", err)
+	}
+
+	asset, ok := m.Assets[updatePlatform()]
+	if !ok {
+		return &m, updateAsset{}, fmt.Errorf("version %s has no build for %s", m.Version, updatePlatform())
+	}
+	base, _ := url.Parse(feed)
+	ref, err := url.Parse(asset.URL)
+	if err != nil || asset.URL == "" {
+		return &m, updateAsset{}, fmt.Errorf("invalid download URL %q", asset.URL)
+	}
+	asset.URL = base.ResolveReference(ref).String()
+	if err := checkUpdateURL(asset.URL); err != nil {
+		return &m, updateAsset{}, err
+	}
+	return &m, asset, nil
+}
+
+// downloadUpdate saves the build to path and checks its checksum and
+// signature. Nothing is left at path if any check fails.
+func downloadUpdate(asset updateAsset, version, path string) (err error) {
+	key, err := updateKey()
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(asset.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return errors.New("the update has no valid signature")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), updateDownloadTimeout)
+	defer cancel()
+	req, err := newUpdateRequest(ctx, asset.URL)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download returned %s", resp.Status)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, maxUpdateSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxUpdateSize {
+		return fmt.Errorf("the update is larger than %d MB", maxUpdateSize>>20)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(sum, asset.SHA256) {
+		return fmt.Errorf("checksum mismatch: got %s, the manifest says %s", sum, asset.SHA256)
+	}
+	if !ed25519.Verify(key, updateMessage(version, updatePlatform(), sum), signature) {
+		return errors.New("the update's signature doesn't match the release key")
+	}
+	return nil
+}
+
+// checkExecutable runs the downloaded program's version command, so a
+// build that doesn't start on this machine is never swapped in.
+func checkExecutable(path, version string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), updateCheckTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, "version")
+	hideWindow(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("the downloaded program doesn't run: %w", err)
+	}
+	got, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if got = strings.TrimSpace(got); got != "Tatbeeb Link "+version {
+		return fmt.Errorf("the downloaded program reports %q, expected version %s", got, version)
+	}
+	return nil
+}
+
+// updateState is the content of updateStateName.
+type updateState struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Exe       string    `json:"exe"`
+	Backup    string    `json:"backup"`
+	Starts    int       `json:"starts"`
+	Installed time.Time `json:"installed"`
+	// Failed is set once To was rolled back. It isn't installed
+	// automatically again.
+	Failed bool `json:"failed,omitempty"`
+}
+
+// pending reports whether the update is still on trial.
+func (s updateState) pending() bool {
+	return s.To != "" && !s.Failed
+}
+
+func readUpdateState(dataDir string) (updateState, bool) {
+	var state updateState
+	data, err := os.ReadFile(filepath.Join(dataDir, updateStateName))
+	if err != nil {
+		return state, false
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		slog.Warn("ignoring unreadable update state", "err", err)
+		return state, false
+	}
+	return state, true
+}
+
+func writeUpdateState(dataDir string, state updateState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, updateStateName)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	chownData(path)
+	return nil
+}
+
+// installRelease downloads and verifies version, then puts it in place of
+// the running program, keeping the running one as a backup for rollback.
+func installRelease(dataDir, version string, asset updateAsset) error {
+	if executable == "" {
+		return errors.New("can't tell where this program is installed")
+	}
+	next := executable + ".new"
+	if err := downloadUpdate(asset, version, next); err != nil {
+		return err
+	}
+	defer os.Remove(next)
+	if err := checkExecutable(next, version); err != nil {
+		return err
+	}
+
+	// Recorded first, so a crash halfway is noticed at the next start
+	state := updateState{
+		From:      Version,
+		To:        version,
+		Exe:       executable,
+		Backup:    executable + ".old",
+		Installed: time.Now(),
+	}
+	if err := writeUpdateState(dataDir, state); err != nil {
+		return err
+	}
+	if err := replaceExecutable(executable, next, state.Backup); err != nil {
+		os.Remove(filepath.Join(dataDir, updateStateName))
+		return fmt.Errorf("can't replace %s: %w", executable, err)
+	}
+	return nil
+}
+
+// rollbackUpdate puts the previous version back and marks the update as
+// failed.
+func rollbackUpdate(dataDir string, state updateState) error {
+	failed := state.Exe + ".failed"
+	if err := replaceExecutable(state.Exe, state.Backup, failed); err != nil {
+		return err
+	}
+	// Windows keeps the failed program while it runs; the next start
+	// removes it
+	os.Remove(failed)
+	state.Failed = true
+	state.Backup = ""
+	return writeUpdateState(dataDir, state)
+}
+
+// removeStaleUpdateFiles deletes what earlier updates left next to the
+// program. The backup is kept while an update is on trial.
+func removeStaleUpdateFiles(state updateState) {
+	if executable == "" {
+		return
+	}
+	os.Remove(executable + ".new")
+	os.Remove(executable + ".failed")
+	if !state.pending() {
+		os.Remove(executable + ".old")
+	}
+}
+
+// updateInfo is what /api/update reports.
+type updateInfo struct {
+	Current   string     `json:"current"`
+	Latest    string     `json:"latest,omitempty"`
+	Notes     string     `json:"notes,omitempty"`
+	Available bool       `json:"available"`
+	Checked   *time.Time `json:"checked,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	// Installing is set from the start of an install until the restart.
+	Installing bool `json:"installing"`
+}
+
+// updater remembers the last update check and signals the restart once an
+// update is installed.
+type updater struct {
+	mu         sync.Mutex
+	info       updateInfo
+	manifest   *updateManifest
+	asset      updateAsset
+	installing bool
+
+	restartOnce sync.Once
+	// installed is closed when the app should restart into a new version
+	installed chan struct{}
+	// checkNow cuts the wait for the next check short
+	checkNow chan struct{}
+}
+
+func newUpdater() *updater {
+	return &updater{
+		info:      updateInfo{Current: Version},
+		installed: make(chan struct{}),
+		checkNow:  make(chan struct{}, 1),
+	}
+}
+
+func (u *updater) Info() updateInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	info := u.info
+	info.Installing = u.installing
+	return info
+}
+
+// restarting reports whether an update is waiting for the app to restart.
+func (u *updater) restarting() bool {
+	select {
+	case <-u.installed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *updater) restart() {
+	u.restartOnce.Do(func() { close(u.installed) })
+}
+
+// checkSoon has the feed checked now, e.g. because a relay asked for a newer
+// version.
+func (u *updater) checkSoon() {
+	select {
+	case u.checkNow <- struct{}{}:
+	default:
+	}
+}
+
+// checkForUpdate asks the configured feed for the latest version.
+func (a *App) checkForUpdate() updateInfo {
+	m, asset, err := fetchUpdateManifest(a.settings.Get().Update.FeedURL)
+	now := time.Now()
+
+	u := a.updates
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.info = updateInfo{Current: Version, Checked: &now, Installing: u.installing}
+	u.manifest, u.asset = nil, updateAsset{}
+	if m != nil {
+		u.info.Latest, u.info.Notes = m.Version, m.Notes
+	}
+	if err != nil {
+		u.info.Error = err.Error()
+		return u.info
+	}
+	u.manifest, u.asset = m, asset
+	u.info.Available = compareVersions(m.Version, Version) > 0
+	return u.info
+}
+
+// installUpdate installs the version found by the last check. The caller
+// restarts the app with a.updates.restart.
+func (a *App) installUpdate() error {
+	u := a.updates
+	u.mu.Lock()
+	m, asset := u.manifest, u.asset
+	if m == nil || compareVersions(m.Version, Version) <= 0 {
+		u.mu.Unlock()
+		return errors.New("no newer version is available, check for updates first")
+	}
+	if u.installing {
+		u.mu.Unlock()
+		return errors.New("an update is already being installed")
+	}
+	u.installing = true
+	u.mu.Unlock()
+
+	slog.Info("installing update", "version", m.Version, "url", asset.URL)
+	if err := installRelease(a.dataDir, m.Version, asset); err != nil {
+		u.mu.Lock()
+		u.installing = false
+		u.mu.Unlock()
+		return err
+	}
+	slog.Info("update installed, restarting", "version", m.Version, "previous", Version)
+	return nil
+}
+
+// watchForUpdates checks the feed shortly after startup and then
+// periodically, installing new versions when auto-install is on.
+func (a *App) watchForUpdates() {
+	wait := updateCheckDelay
+	for {
+		select {
+		case <-time.After(wait):
+		case <-a.updates.checkNow:
+		}
+		wait = updateCheckInterval
+
+		settings := a.settings.Get().Update
+		if settings.FeedURL == "" {
+			continue
+		}
+		info := a.checkForUpdate()
+		switch {
+		case info.Error != "":
+			slog.Warn("update check failed", "feed", settings.FeedURL, "err", info.Error)
+		case !info.Available:
+			slog.Debug("no update available", "latest", info.Latest)
+		case !settings.AutoInstall:
+			slog.Info("an update is available", "version", info.Latest)
+		case a.updateFailed(info.Latest):
+			slog.Warn("not installing an update that was rolled back before, install it from the dashboard to retry", "version", info.Latest)
+		default:
+			if err := a.installUpdate(); err != nil {
+				slog.Error("can't install the update", "version", info.Latest, "err", err)
+				continue
+			}
+			a.updates.restart()
+			return
+		}
+	}
+}
+
+// updateFailed reports whether version was installed and rolled back.
+func (a *App) updateFailed(version string) bool {
+	state, ok := readUpdateState(a.dataDir)
+	return ok && state.Failed && state.To == version
+}
+
+// resumeUpdate runs at startup. After an update it counts the new
+// version's starts, rolling back once it has failed to come up
+// maxUpdateStarts times, and otherwise commits the update after the trial
+// period. It returns true when it rolled back and the previous version must
+// be started instead.
+func (a *App) resumeUpdate() bool {
+	state, ok := readUpdateState(a.dataDir)
+	removeStaleUpdateFiles(state)
+	if !ok || !state.pending() {
+		return false
+	}
+
+	switch Version {
+	case state.To:
+	case state.From:
+		// The watchdog of restartAfterUpdate already put this version back
+		slog.Warn("the update was rolled back", "version", state.To, "running", Version)
+		state.Failed = true
+		if err := writeUpdateState(a.dataDir, state); err != nil {
+			slog.Warn("can't save the update state", "err", err)
+		}
+		os.Remove(state.Backup)
+		return false
+	default:
+		return false
+	}
+
+	state.Starts++
+	if state.Starts > maxUpdateStarts {
+		slog.Error("the update failed to come up, rolling back", "version", state.To, "previous", state.From, "starts", state.Starts-1)
+		if err := rollbackUpdate(a.dataDir, state); err != nil {
+			slog.Error("can't roll back the update", "err", err)
+			return false
+		}
+		return true
+	}
+	if err := writeUpdateState(a.dataDir, state); err != nil {
+		slog.Warn("can't save the update state", "err", err)
+	}
+	slog.Info("running an updated version on trial", "version", state.To, "previous", state.From, "start", state.Starts)
+
+	go func() {
+		time.Sleep(updateTrialPeriod)
+		if err := os.Remove(filepath.Join(a.dataDir, updateStateName)); err != nil {
+			slog.Warn("can't commit the update", "err", err)
+			return
+		}
+		// The watchdog may still hold the backup open on Windows; the next
+		// start deletes it then
+		os.Remove(state.Backup)
+		slog.Info("update committed", "version", state.To, "previous", state.From)
+	}()
+	return false
+}
+
+// restartAfterUpdate ends this process in favour of the installed version,
+// or the one rolled back to. A service exits with exitUpdated for its
+// service manager to restart it. Otherwise the dashboard port is released
+// and the program is started again with the same arguments.
+func (a *App) restartAfterUpdate(service bool) int {
+	if service {
+		// Services installed by older versions may not be restarted after
+		// an exit code yet
+		if err := enableServiceRestart(); err != nil {
+			slog.Error("the service may not be restarted after the update, start it again by hand", "err", err)
+		}
+		slog.Info("exiting for the service manager to restart the service")
+		return exitUpdated
+	}
+	a.stopWebServer()
+	return relaunch(a.dataDir)
+}
+
+// relaunch starts the program again and watches it until it commits the
+// update. If it exits with an error before that, the previous version is put
+// back and started instead.
+func relaunch(dataDir string) int {
+	for {
+		cmd := exec.Command(executable, os.Args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			slog.Error("can't restart Tatbeeb Link", "err", err)
+			return exitError
+		}
+		slog.Info("restarted Tatbeeb Link", "pid", cmd.Process.Pid)
+
+		if code := watchRelaunch(dataDir, cmd); code != exitUpdated {
+			return code
+		}
+	}
+}
+
+// watchRelaunch waits for the update to be committed or rolled back, or for
+// cmd to exit. It returns exitUpdated when the program must be started
+// again.
+func watchRelaunch(dataDir string, cmd *exec.Cmd) int {
+	done := make(chan int, 1)
+	go func() {
+		cmd.Wait()
+		done <- cmd.ProcessState.ExitCode()
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(updateTrialPeriod + updateManifestTimeout)
+
+	for {
+		select {
+		case code := <-done:
+			if code == exitOK || code == exitUpdated {
+				return code
+			}
+			state, ok := readUpdateState(dataDir)
+			if !ok || !state.pending() {
+				return code
+			}
+			slog.Error("the update exited with an error, rolling back", "version", state.To, "previous", state.From, "exit", code)
+			if err := rollbackUpdate(dataDir, state); err != nil {
+				slog.Error("can't roll back the update", "err", err)
+				return code
+			}
+			return exitUpdated
+		case <-ticker.C:
+			if state, ok := readUpdateState(dataDir); !ok || !state.pending() {
+				return exitOK
+			}
+		case <-deadline:
+			// Still running and not committed; the next start counts
+			// against it if it crashes
+			return exitOK
+		}
+	}
+}
+
+// handleUpdate reports the last update check. POST {"action": "check"}
+// checks the feed now, and {"action": "install"} installs the version found
+// and restarts.
+func (a *App) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !a.authorize(w, r) {
+			return
+		}
+
+		var req struct {
+			Action string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, a.tr(r, "api.invalidRequest", err))
+			return
+		}
+		switch req.Action {
+		case "check":
+			a.checkForUpdate()
+		case "install":
+			if err := a.installUpdate(); err != nil {
+				writeError(w, http.StatusBadGateway, a.tr(r, "api.updateFailed", err))
+				return
+			}
+			// Let the response reach the dashboard first
+			time.AfterFunc(time.Second, a.updates.restart)
+		default:
+			writeError(w, http.StatusBadRequest, a.tr(r, "api.unknownAction", req.Action))
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"update":  a.updates.Info(),
+		"signed":  updatePublicKey != "",
+	})
+}
+
+const updateUsageText = `Usage: tatbeeb-link update <check|keygen|sign> [flags]
+
+  check    Ask the update feed for the latest version
+  keygen   Create a release signing key and print its public key
+  sign     Sign a release build and add it to a manifest
+
+Builds only install updates signed with the key they were built with:
+
+  go build -ldflags "-X main.updatePublicKey=<public key>"
+`
+
+func runUpdateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, updateUsageText)
+		return exitUsage
+	}
+	switch args[0] {
+	case "check":
+		return runUpdateCheck(args[1:])
+	case "keygen":
+		return runUpdateKeygen(args[1:])
+	case "sign":
+		return runUpdateSign(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "Unknown update command %q\n\n%s", args[0], updateUsageText)
+	return exitUsage
+}
+
+func newUpdateFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("update "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, updateUsageText+"\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runUpdateCheck(args []string) int {
+	fs := newUpdateFlags("check")
+	feed := fs.String("feed", "", "manifest URL (default: the feed in the settings)")
+	configPath := fs.String("config", "", "settings file (default: the user config directory)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *feed == "" {
+		path, err := settingsPath(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return exitConfig
+		}
+		store, err := loadSettings(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return exitConfig
+		}
+		*feed = store.Get().Update.FeedURL
+	}
+
+	m, asset, err := fetchUpdateManifest(*feed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitError
+	}
+	switch {
+	case compareVersions(m.Version, Version) > 0:
+		fmt.Printf("⬆️  Version %s is available (running %s)\n   %s\n", m.Version, Version, asset.URL)
+	default:
+		fmt.Printf("✅ Up to date: running %s, the feed offers %s\n", Version, m.Version)
+	}
+	if m.Notes != "" {
+		fmt.Printf("\n%s\n", m.Notes)
+	}
+	if updatePublicKey == "" {
+		fmt.Printf("\n%v\n", errNoUpdateKey)
+	}
+	return exitOK
+}
+
+func runUpdateKeygen(args []string) int {
+	fs := newUpdateFlags("keygen")
+	out := fs.String("out", "release-key.pem", "where to write the private key")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if _, err := os.Stat(*out); err == nil {
+		fmt.Fprintf(os.Stderr, "❌ %s already exists\n", *out)
+		return exitError
+	}
+	key, err := createDeviceKey(*out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitError
+	}
+	fmt.Printf("✅ Wrote the release key to %s. Keep it secret and backed up.\n", *out)
+	fmt.Printf("Public key: %s\n", encodePublicKey(key.Public().(ed25519.PublicKey)))
+	return exitOK
+}
+
+func runUpdateSign(args []string) int {
+	fs := newUpdateFlags("sign")
+	keyPath := fs.String("key", "release-key.pem", "release signing key")
+	version := fs.String("version", "", "version of the build (default: what the build reports)")
+	platform := fs.String("platform", updatePlatform(), "GOOS/GOARCH the build is for")
+	manifestPath := fs.String("manifest", "manifest.json", "manifest to add the build to, created if missing")
+	downloadURL := fs.String("url", "", "download URL, absolute or relative to the manifest (default: the file name)")
+	notes := fs.String("notes", "", "release notes")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage: tatbeeb-link update sign [flags] <build>\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	build := fs.Arg(0)
+
+	key, err := readPrivateKey(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitError
+	}
+	if *version == "" {
+		// Only a build for this platform can be asked
+		path, _ := filepath.Abs(build)
+		out, err := exec.Command(path, "version").Output()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ can't run %s to ask its version, use --version: %v\n", build, err)
+			return exitUsage
+		}
+		first, _, _ := strings.Cut(string(out), "\n")
+		*version = strings.TrimPrefix(strings.TrimSpace(first), "Tatbeeb Link ")
+	}
+	if _, _, err := parseVersion(*version); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitUsage
+	}
+
+	data, err := os.ReadFile(build)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitError
+	}
+	sum := sha256.Sum256(data)
+	asset := updateAsset{
+		URL:       *downloadURL,
+		SHA256:    hex.EncodeToString(sum[:]),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, updateMessage(*version, *platform, hex.EncodeToString(sum[:])))),
+	}
+	if asset.URL == "" {
+		asset.URL = filepath.Base(build)
+	}
+
+	// A new version starts a fresh manifest; the same version collects
+	// builds for more platforms
+	var m updateManifest
+	if existing, err := os.ReadFile(*manifestPath); err == nil {
+		if err := json.Unmarshal(existing, &m); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %s: %v\n", *manifestPath, err)
+			return exitError
+		}
+	}
+	if m.Version != *version {
+		m = updateManifest{Version: *version}
+	}
+	if m.Assets == nil {
+		m.Assets = make(map[string]updateAsset)
+	}
+	if *notes != "" {
+		m.Notes = *notes
+	}
+	m.Assets[*platform] = asset
+
+	out, _ := json.MarshalIndent(m, "", "  ")
+	if err := os.WriteFile(*manifestPath, append(out, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return exitError
+	}
+	fmt.Printf("✅ Signed %s %s for %s (key %s) into %s\n", build, *version, *platform,
+		keyFingerprint(key.Public().(ed25519.PublicKey)), *manifestPath)
+	return exitOK
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// replaceExecutable puts next in place of exe and keeps exe as backup. The
+// rename is atomic, so there is never a moment without a program at exe.
+func replaceExecutable(exe, next, backup string) error {
+	os.Remove(backup)
+	if err := os.Link(exe, backup); err != nil {
+		return err
+	}
+	return os.Rename(next, exe)
+}
+
+func hideWindow(cmd *exec.Cmd) {}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRelease is a signed build served by a local manifest server.
+type testRelease struct {
+	version string
+	binary  []byte
+	key     ed25519.PrivateKey
+	server  *httptest.Server
+	// manifest is served as-is unless a test replaces it
+	manifest updateManifest
+}
+
+// newTestRelease signs binary as version for this platform and serves it
+// next to its manifest. The build trusts the release key while the test
+// runs.
+func newTestRelease(t *testing.T, version string, binary []byte) *testRelease {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevKey := updatePublicKey
+	updatePublicKey = encodePublicKey(pub)
+	t.Cleanup(func() { updatePublicKey = prevKey })
+
+	sum := sha256.Sum256(binary)
+	r := &testRelease{version: version, binary: binary, key: key}
+	r.manifest = updateManifest{
+		Version: version,
+		Notes:   "fixes",
+		Assets: map[string]updateAsset{
+			updatePlatform(): {
+				URL:       "builds/tatbeeb-link",
+				SHA256:    hex.EncodeToString(sum[:]),
+				Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, updateMessage(version, updatePlatform(), hex.EncodeToString(sum[:])))),
+			},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed/manifest.json", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(r.manifest)
+	})
+	mux.HandleFunc("/feed/builds/tatbeeb-link", func(w http.ResponseWriter, req *http.Request) {
+		w.Write(r.binary)
+	})
+	r.server = httptest.NewServer(mux)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *testRelease) feed() string {
+	return r.server.URL + "/feed/manifest.json"
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"v1.2.0", "1.2.0", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.2.0+build.5", "1.2.0", 0},
+		{"1.10.0", "1.9.0", 1},
+		{"1.2.1", "1.2.0", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.2.0-beta.1", "1.2.0", -1},
+		{"1.2.0", "1.2.0-rc.1", 1},
+		{"1.2.0-beta.10", "1.2.0-beta.9", 1},
+		{"1.2.0-beta.2", "1.2.0-beta.11", -1},
+		{"1.2.0-alpha", "1.2.0-beta", -1},
+		{"1.2.0-beta", "1.2.0-beta.1", -1},
+		{"1.2.0-1", "1.2.0-alpha", -1},
+		{"1.2.0-rc.1", "1.2.0-beta.5", 1},
+		{"dev", "0.0.0", 0},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := compareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestCheckUpdateURL(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		"https://updates.tatbeeb.sa/manifest.json": true,
+		"http://127.0.0.1:8080/manifest.json":      true,
+		"http://localhost/manifest.json":           true,
+		"http://updates.tatbeeb.sa/manifest.json":  false,
+		"ftp://updates.tatbeeb.sa/manifest.json":   false,
+		"manifest.json":                            false,
+	} {
+		if err := checkUpdateURL(raw); (err == nil) != ok {
+			t.Errorf("checkUpdateURL(%q) = %v, want allowed %v", raw, err, ok)
+		}
+	}
+}
+
+func TestFetchUpdateManifest(t *testing.T) {
+	release := newTestRelease(t, "9.1.0", []byte("new build"))
+
+	m, asset, err := fetchUpdateManifest(release.feed())
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if m.Version != "9.1.0" || m.Notes != "fixes" {
+		t.Errorf("manifest = %+v", m)
+	}
+	if want := release.server.URL + "/feed/builds/tatbeeb-link"; asset.URL != want {
+		t.Errorf("download URL = %q, want it resolved to %q", asset.URL, want)
+	}
+
+	release.manifest.Assets = map[string]updateAsset{"plan9/386": asset}
+	if _, _, err := fetchUpdateManifest(release.feed()); err == nil || !strings.Contains(err.Error(), "no build for") {
+		t.Errorf("manifest without this platform: %v", err)
+	}
+	release.manifest.Version = "latest"
+	if _, _, err := fetchUpdateManifest(release.feed()); err == nil {
+		t.Error("a manifest with an invalid version was accepted")
+	}
+	if _, _, err := fetchUpdateManifest(release.server.URL + "/missing.json"); err == nil {
+		t.Error("a missing manifest was accepted")
+	}
+}
+
+func TestCheckForUpdate(t *testing.T) {
+	release := newTestRelease(t, "9.1.0", []byte("new build"))
+	prevVersion := Version
+	t.Cleanup(func() { Version = prevVersion })
+	Version = "1.0.0"
+	app := newTestApp(t, closedPort(t), closedPort(t))
+	if err := app.settings.Update(func(s *Settings) error {
+		s.Update.FeedURL = release.feed()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := app.checkForUpdate(); !info.Available || info.Latest != "9.1.0" || info.Error != "" {
+		t.Errorf("info = %+v, want 9.1.0 available", info)
+	}
+	release.manifest.Version = "0.9.0"
+	if info := app.checkForUpdate(); info.Available {
+		t.Errorf("an older version is offered: %+v", info)
+	}
+}
+
+func TestDownloadUpdate(t *testing.T) {
+	release := newTestRelease(t, "9.1.0", []byte("new build"))
+	_, good, err := fetchUpdateManifest(release.feed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "tatbeeb-link.new")
+
+	if err := downloadUpdate(good, "9.1.0", path); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new build" {
+		t.Errorf("downloaded %q", data)
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	forged := good
+	forged.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(otherKey, updateMessage("9.1.0", updatePlatform(), good.SHA256)))
+	tampered := good
+	tampered.SHA256 = strings.Repeat("0", 64)
+	unsigned := good
+	unsigned.Signature = ""
+
+	tests := []struct {
+		name    string
+		asset   updateAsset
+		version string
+		want    string
+	}{
+		{"signed by another key", forged, "9.1.0", "signature"},
+		{"checksum mismatch", tampered, "9.1.0", "checksum"},
+		{"unsigned", unsigned, "9.1.0", "no valid signature"},
+		{"passed off as another version", good, "9.2.0", "signature"},
+	}
+	for _, tt := range tests {
+		os.Remove(path)
+		err := downloadUpdate(tt.asset, tt.version, path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want one about %q", tt.name, err, tt.want)
+		}
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("%s: the rejected download was left behind", tt.name)
+		}
+	}
+
+	updatePublicKey = ""
+	if err := downloadUpdate(good, "9.1.0", path); !errors.Is(err, errNoUpdateKey) {
+		t.Errorf("download without a release key = %v, want errNoUpdateKey", err)
+	}
+}
+
+// installTestUpdate lays out an installed update on trial: the program at
+// exe is the new version and exe.old the previous one.
+func installTestUpdate(t *testing.T, state updateState) (*App, updateState) {
+	t.Helper()
+	dir := t.TempDir()
+	prevExe, prevVersion := executable, Version
+	t.Cleanup(func() { executable, Version = prevExe, prevVersion })
+	executable = filepath.Join(dir, "tatbeeb-link")
+	Version = state.To
+
+	os.WriteFile(executable, []byte("new"), 0755)
+	os.WriteFile(executable+".old", []byte("old"), 0755)
+	state.Exe, state.Backup = executable, executable+".old"
+	if err := writeUpdateState(dir, state); err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, closedPort(t), closedPort(t))
+	app.dataDir = dir
+	return app, state
+}
+
+func TestResumeUpdateCountsStarts(t *testing.T) {
+	app, _ := installTestUpdate(t, updateState{From: "1.0.0", To: "1.1.0"})
+
+	if app.resumeUpdate() {
+		t.Fatal("the first start of an update rolled back")
+	}
+	state, _ := readUpdateState(app.dataDir)
+	if state.Starts != 1 || !state.pending() {
+		t.Errorf("state = %+v, want one start on trial", state)
+	}
+	if data, _ := os.ReadFile(executable + ".old"); string(data) != "old" {
+		t.Error("the backup was removed during the trial")
+	}
+}
+
+func TestResumeUpdateRollsBack(t *testing.T) {
+	app, _ := installTestUpdate(t, updateState{From: "1.0.0", To: "1.1.0", Starts: maxUpdateStarts})
+
+	if !app.resumeUpdate() {
+		t.Fatal("an update that kept failing to start wasn't rolled back")
+	}
+	if data, _ := os.ReadFile(executable); string(data) != "old" {
+		t.Errorf("program = %q after the rollback, want the previous version", data)
+	}
+	state, ok := readUpdateState(app.dataDir)
+	if !ok || !state.Failed || state.pending() {
+		t.Errorf("state = %+v, want the update marked failed", state)
+	}
+	if !app.updateFailed("1.1.0") {
+		t.Error("the rolled back version would be installed again automatically")
+	}
+}
+
+// TestUpdateHelperProcess is the relaunched program of
+// TestWatchRelaunchRollsBack. It exits with an error at once.
+func TestUpdateHelperProcess(t *testing.T) {
+	if os.Getenv("TATBEEB_UPDATE_HELPER") != "1" {
+		return
+	}
+	os.Exit(exitError)
+}
+
+func TestWatchRelaunchRollsBack(t *testing.T) {
+	app, _ := installTestUpdate(t, updateState{From: "1.0.0", To: "1.1.0", Starts: 1})
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestUpdateHelperProcess")
+	cmd.Env = append(os.Environ(), "TATBEEB_UPDATE_HELPER=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if code := watchRelaunch(app.dataDir, cmd); code != exitUpdated {
+		t.Fatalf("watchRelaunch = %d, want exitUpdated to start the previous version", code)
+	}
+	if data, _ := os.ReadFile(executable); string(data) != "old" {
+		t.Errorf("program = %q after the update exited with an error, want the previous version", data)
+	}
+	if state, _ := readUpdateState(app.dataDir); !state.Failed {
+		t.Errorf("state = %+v, want the update marked failed", state)
+	}
+}
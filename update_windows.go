@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// replaceExecutable puts next in place of exe and keeps exe as backup.
+// Windows won't overwrite a running program but lets it be renamed, so it
+// is moved aside first.
+func replaceExecutable(exe, next, backup string) error {
+	os.Remove(backup)
+	if err := os.Rename(exe, backup); err != nil {
+		return err
+	}
+	if err := os.Rename(next, exe); err != nil {
+		os.Rename(backup, exe)
+		return err
+	}
+	return nil
+}
+
+// hideWindow keeps a console program from flashing a window.
+func hideWindow(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true, CreationFlags: createNoWindow}
+}
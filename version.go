@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Build metadata. Release builds set it with
+//
+//	-ldflags "-X main.Version=1.1.0 -X main.Commit=<git commit> -X main.BuildDate=<RFC 3339 time>"
+//
+// as the build scripts do. Without them Commit and BuildDate come from the
+// version control information go build records.
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// BuildInfo describes this build. It is shown in the dashboard and tray and
+// sent to the relay when registering.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+var build = readBuildInfo()
+
+func readBuildInfo() BuildInfo {
+	b := BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if b.Commit == "" && len(setting.Value) >= 12 {
+				b.Commit = setting.Value[:12]
+			}
+		case "vcs.time":
+			if b.BuildDate == "" {
+				b.BuildDate = setting.Value
+			}
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if modified && Commit == "" && b.Commit != "" {
+		b.Commit += "-dirty"
+	}
+	return b
+}
+
+// String is the one-line form the version command and logs use, e.g.
+// "1.1.0 (3f2a9c1e7b4d, 2025-06-01T10:00:00Z, go1.21.5 windows/amd64)".
+func (b BuildInfo) String() string {
+	details := []string{b.Commit, b.BuildDate, b.GoVersion + " " + b.Platform}
+	var parts []string
+	for _, d := range details {
+		if d != "" {
+			parts = append(parts, d)
+		}
+	}
+	return fmt.Sprintf("%s (%s)", b.Version, strings.Join(parts, ", "))
+}
+
+func (a *App) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"build":   build,
+	})
+}
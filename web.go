@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// webFiles is the dashboard. Nothing is loaded from other origins, so it
+// works on offline networks and tells no third party it's in use.
+//
+//go:embed web
+var webFiles embed.FS
+
+// contentSecurityPolicy only lets the dashboard load its own files.
+const contentSecurityPolicy = "default-src 'self'; script-src 'self'; style-src 'self'; img-src 'self'; " +
+	"connect-src 'self'; object-src 'none'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// webAsset is a file served with a precomputed ETag.
+type webAsset struct {
+	data        []byte
+	contentType string
+	etag        string
+}
+
+func newWebAsset(name string, data []byte) webAsset {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	sum := sha256.Sum256(data)
+	return webAsset{data: data, contentType: contentType, etag: `"` + hex.EncodeToString(sum[:8]) + `"`}
+}
+
+// serve writes the asset, or 304 when the browser's copy is current. Every
+// use is revalidated, so a new version shows up as soon as it's installed.
+func (asset webAsset) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", asset.etag)
+	if etagMatches(r.Header.Get("If-None-Match"), asset.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(asset.data)
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// staticAssets maps /static/ paths to the embedded files, plus the logo,
+// which is embedded once for the tray icon too.
+var staticAssets = loadStaticAssets()
+
+func loadStaticAssets() map[string]webAsset {
+	assets := map[string]webAsset{
+		"logo.png": newWebAsset("logo.png", iconData),
+	}
+	fs.WalkDir(webFiles, "web", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || name == "web/index.html" {
+			return err
+		}
+		data, err := webFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		assets[strings.TrimPrefix(name, "web/")] = newWebAsset(name, data)
+		return nil
+	})
+	return assets
+}
+
+// handleIndex serves the dashboard page with this launch's CSRF token and
+// the available languages.
+func (a *App) handleIndex(w http.ResponseWriter, r *http.Request) {
+	// "/" matches every path nothing else claimed
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	page, err := webFiles.ReadFile("web/index.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page = bytes.Replace(page, []byte("{{csrfToken}}"), []byte(a.csrfToken), 1)
+	page = bytes.Replace(page, []byte("{{locales}}"), dashboardLocales(), 1)
+	newWebAsset("index.html", page).serve(w, r)
+}
+
+// handleStatic serves /static/ files and the favicon.
+func (a *App) handleStatic(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	if r.URL.Path == "/favicon.ico" {
+		name = "logo.png"
+	}
+	asset, ok := staticAssets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	asset.serve(w, r)
+}
+
+// dashboardLocales is the JSON the page reads its languages and strings
+// from. json.Marshal escapes "<", so it can't end the script element it is
+// placed in.
+func dashboardLocales() []byte {
+	messages := make(map[string]map[string]string, len(catalog))
+	for code, l := range catalog {
+		messages[code] = l.Messages
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"languages": languages(),
+		"messages":  messages,
+	})
+	return data
+}
@@ -0,0 +1,1096 @@
+let pollingInterval;
+let currentLang = localStorage.getItem('tatbeebLinkLang') || 'en';
+let settings = null;
+let selectedTunnel = null;
+let connecting = false;
+let logsSince = 0;
+let logsTimer = null;
+const maxLogRows = 1000;
+let pinSet = false;
+let relayTokenSet = false;
+let unlocked = true;
+let pinResolve = null;
+let buildInfo = null;
+
+// The server fills in the languages from its locales directory
+const locales = JSON.parse(document.getElementById('locales').textContent);
+const translations = locales.messages;
+
+function setLanguage(lang, persist = true) {
+    currentLang = lang;
+    localStorage.setItem('tatbeebLinkLang', lang);
+
+    // A locked dashboard only switches for this browser
+    if (persist && settings && settings.language !== lang && unlocked) {
+        saveSettings(Object.assign({}, settings, { language: lang }));
+    }
+
+    // Update UI direction
+    const locale = locales.languages.find(l => l.code === lang);
+    document.documentElement.lang = lang;
+    document.body.setAttribute('dir', locale ? locale.dir : 'ltr');
+
+    // Update active button
+    document.querySelectorAll('#langSwitcher .lang-btn').forEach(button => {
+        button.classList.toggle('active', button.dataset.lang === lang);
+    });
+
+    // Update all translatable elements
+    document.querySelectorAll('[data-i18n]').forEach(element => {
+        const text = translate(element.getAttribute('data-i18n'));
+        if (text) {
+            element.textContent = text;
+        }
+    });
+
+    renderVersion();
+
+    // Update copy button title
+    const copyBtn = document.getElementById('copyBtn');
+    if (copyBtn) {
+        copyBtn.setAttribute('title', t('copyLink'));
+    }
+
+    // Update dynamic status text
+    updateStatus();
+}
+
+// translate falls back to English for strings a language lacks
+function translate(key) {
+    return (translations[currentLang] || {})[key] || translations.en[key];
+}
+
+function t(key) {
+    return translate(key) || key;
+}
+
+// buildLanguageMenus lists the available languages in the switcher and
+// the settings page
+function buildLanguageMenus() {
+    const switcher = document.getElementById('langSwitcher');
+    const select = document.getElementById('setLanguage');
+    locales.languages.forEach(locale => {
+        const button = document.createElement('button');
+        button.className = 'lang-btn';
+        button.dataset.lang = locale.code;
+        button.title = locale.name;
+        button.textContent = locale.code.toUpperCase();
+        button.addEventListener('click', () => setLanguage(locale.code));
+        switcher.appendChild(button);
+
+        const option = document.createElement('option');
+        option.value = locale.code;
+        option.textContent = locale.name;
+        select.appendChild(option);
+    });
+}
+
+// Every POST must carry the token this page was served with
+const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+
+function sendJSON(url, body) {
+    return fetch(url, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken, 'Accept-Language': currentLang },
+        body: JSON.stringify(body)
+    });
+}
+
+// apiGet asks for errors in the dashboard's language
+function apiGet(url) {
+    return fetch(url, { headers: { 'Accept-Language': currentLang } });
+}
+
+// authFetch asks for the admin PIN when a request needs it and
+// retries once the dashboard is unlocked
+async function authFetch(request) {
+    let response = await request();
+    if (response.status === 401 && (await response.clone().json()).pinRequired && await askPIN()) {
+        response = await request();
+    }
+    return response;
+}
+
+function postJSON(url, body) {
+    return authFetch(() => sendJSON(url, body));
+}
+
+// askPIN shows the PIN dialog and resolves to whether it was unlocked
+function askPIN() {
+    unlocked = false;
+    updateLock();
+    return new Promise(resolve => {
+        pinResolve = resolve;
+        document.getElementById('pinInput').value = '';
+        document.getElementById('pinError').textContent = '';
+        document.getElementById('pinDialog').classList.remove('hidden');
+        document.getElementById('pinInput').focus();
+    });
+}
+
+async function submitPIN() {
+    try {
+        const response = await sendJSON('/api/unlock', { pin: document.getElementById('pinInput').value });
+        const result = await response.json();
+        if (!result.success) {
+            document.getElementById('pinError').textContent = result.error;
+            document.getElementById('pinInput').select();
+            return;
+        }
+        unlocked = true;
+        closePIN(true);
+    } catch (error) {
+        document.getElementById('pinError').textContent = error.message;
+    }
+}
+
+function closePIN(ok) {
+    document.getElementById('pinDialog').classList.add('hidden');
+    updateLock();
+    if (pinResolve) {
+        pinResolve(ok);
+        pinResolve = null;
+    }
+}
+
+async function lockDashboard() {
+    try {
+        await sendJSON('/api/lock', {});
+        unlocked = false;
+        updateLock();
+    } catch (error) {
+        showError(error.message);
+    }
+}
+
+// loadVersion fetches the build details shown in the footer
+async function loadVersion() {
+    try {
+        const response = await apiGet('/api/version');
+        const result = await response.json();
+        if (result.success) {
+            buildInfo = result.build;
+            renderVersion();
+        }
+    } catch (error) {
+        console.error('Failed to load the version:', error);
+    }
+}
+
+function renderVersion() {
+    if (!buildInfo) {
+        return;
+    }
+    const element = document.getElementById('appVersion');
+    element.textContent = t('version').replace('%s', buildInfo.version);
+    element.title = [buildInfo.commit, buildInfo.buildDate, buildInfo.goVersion + ' ' + buildInfo.platform]
+        .filter(part => part).join(' • ');
+}
+
+function updateLock() {
+    document.getElementById('lockBtn').classList.toggle('hidden', !pinSet || !unlocked);
+}
+
+// Initialize language on load, then switch to the saved one
+document.addEventListener('DOMContentLoaded', async function() {
+    buildLanguageMenus();
+    bindEvents();
+    if (!translations[currentLang]) {
+        currentLang = 'en';
+    }
+    setLanguage(currentLang, false);
+    loadVersion();
+    await loadSettings();
+    if (settings && settings.language !== currentLang) {
+        setLanguage(settings.language, false);
+    }
+    // The tray's "Open Logs" links here
+    if (location.hash === '#logs') {
+        showLogs();
+    }
+});
+
+// bindEvents wires up the page; the Content-Security-Policy forbids inline
+// event handlers
+function bindEvents() {
+    const on = (id, event, handler) => document.getElementById(id).addEventListener(event, handler);
+
+    on('tunnelSelect', 'change', event => selectTunnel(event.target.value));
+    on('copyBtn', 'click', copyLink);
+    on('connectBtn', 'click', connect);
+    on('advancedBtn', 'click', toggleAdvanced);
+    on('findBtn', 'click', findInstances);
+    on('testLinkBtn', 'click', testLink);
+    on('disconnectBtn', 'click', disconnect);
+    on('settingsBtn', 'click', showSettings);
+    on('logsBtn', 'click', showLogs);
+    on('diagnosticsBtn', 'click', showDiagnostics);
+    on('lockBtn', 'click', lockDashboard);
+
+    on('addTunnelBtn', 'click', () => addTunnelRow());
+    on('exportCsvBtn', 'click', () => exportAudit('csv'));
+    on('exportJsonBtn', 'click', () => exportAudit('json'));
+    on('savePinBtn', 'click', savePIN);
+    on('removePinBtn', 'click', removePIN);
+    on('createTokenBtn', 'click', createToken);
+    on('checkUpdateBtn', 'click', () => updateAction('check'));
+    on('installUpdateBtn', 'click', () => updateAction('install'));
+    on('saveSettingsBtn', 'click', submitSettings);
+    on('settingsBackBtn', 'click', hideSettings);
+
+    on('logLevel', 'change', event => changeLogLevel(event.target.value));
+    on('logFilterLevel', 'change', reloadLogs);
+    on('logFilterTunnel', 'change', reloadLogs);
+    on('logFilterText', 'input', reloadLogs);
+    on('logLive', 'change', scheduleLogs);
+    on('logsBackBtn', 'click', hideLogs);
+
+    on('runDiagnosticsBtn', 'click', runDiagnostics);
+    on('downloadBundleBtn', 'click', downloadBundle);
+    on('diagnosticsBackBtn', 'click', hideDiagnostics);
+
+    on('pinInput', 'keydown', event => {
+        if (event.key === 'Enter') {
+            submitPIN();
+        }
+    });
+    on('pinSubmitBtn', 'click', submitPIN);
+    on('pinCancelBtn', 'click', () => closePIN(false));
+}
+
+async function loadSettings() {
+    try {
+        const response = await apiGet('/api/settings');
+        const result = await response.json();
+        pinSet = result.pinSet;
+        relayTokenSet = result.relayTokenSet;
+        unlocked = result.unlocked;
+        updateLock();
+        applySettings(result.settings);
+    } catch (error) {
+        console.error('Failed to load settings:', error);
+    }
+}
+
+function applySettings(next) {
+    settings = next;
+    if (!settings.tunnels.some(tunnel => tunnel.id === selectedTunnel)) {
+        selectedTunnel = settings.tunnels[0].id;
+    }
+
+    const select = document.getElementById('tunnelSelect');
+    select.innerHTML = '';
+    settings.tunnels.forEach(tunnel => {
+        const option = document.createElement('option');
+        option.value = tunnel.id;
+        option.textContent = tunnel.name;
+        select.appendChild(option);
+    });
+    select.value = selectedTunnel;
+    document.getElementById('tunnelPicker').classList.toggle('hidden', settings.tunnels.length < 2);
+    document.getElementById('target').value = currentTunnel().target;
+}
+
+function currentTunnel() {
+    return settings.tunnels.find(tunnel => tunnel.id === selectedTunnel);
+}
+
+function selectTunnel(id) {
+    selectedTunnel = id;
+    document.getElementById('linkTestResult').classList.add('hidden');
+    document.getElementById('target').value = currentTunnel().target;
+    updateStatus();
+}
+
+async function saveSettings(next) {
+    try {
+        const response = await postJSON('/api/settings', next);
+        const result = await response.json();
+
+        if (!result.success) {
+            showError(t('errorSaveFailed') + result.error);
+            return false;
+        }
+        relayTokenSet = result.relayTokenSet;
+        applySettings(result.settings);
+        return true;
+    } catch (error) {
+        showError(t('errorSaveFailed') + error.message);
+        return false;
+    }
+}
+
+function showError(message) {
+    const errorBox = document.getElementById('errorBox');
+    errorBox.textContent = message;
+    errorBox.classList.add('show');
+    setTimeout(() => errorBox.classList.remove('show'), 5000);
+}
+
+async function connect() {
+    const target = document.getElementById('target').value.trim();
+
+    if (!target) {
+        showError(t('errorInvalidTarget'));
+        return;
+    }
+
+    connecting = true;
+    document.getElementById('connectBtn').disabled = true;
+    document.getElementById('statusText').textContent = t('connecting');
+
+    try {
+        const response = await postJSON('/api/connect', { tunnelId: selectedTunnel, target });
+
+        const result = await response.json();
+
+        if (result.success) {
+            document.getElementById('setupForm').classList.add('hidden');
+            document.getElementById('connectedForm').classList.remove('hidden');
+            loadSettings();
+            startPolling();
+        } else {
+            showError(t('errorConnectionFailed') + result.error);
+            document.getElementById('connectBtn').disabled = false;
+        }
+    } catch (error) {
+        showError(t('errorConnectFailed') + error.message);
+        document.getElementById('connectBtn').disabled = false;
+    } finally {
+        connecting = false;
+    }
+}
+
+async function disconnect() {
+    try {
+        const response = await postJSON('/api/disconnect', { tunnelId: selectedTunnel });
+        const result = await response.json();
+        if (!result.success) {
+            showError(t('errorDisconnectFailed') + result.error);
+            return;
+        }
+        stopPolling();
+        document.getElementById('linkTestResult').classList.add('hidden');
+        document.getElementById('setupForm').classList.remove('hidden');
+        document.getElementById('connectedForm').classList.add('hidden');
+        document.getElementById('shareableBox').classList.remove('show');
+        document.getElementById('connectBtn').disabled = false;
+    } catch (error) {
+        showError(t('errorDisconnectFailed') + error.message);
+    }
+}
+
+// testLink dials the shareable link from here and reports how it performs
+async function testLink() {
+    const button = document.getElementById('testLinkBtn');
+    const output = document.getElementById('linkTestResult');
+    button.disabled = true;
+    output.textContent = t('testingLink');
+    output.classList.remove('hidden');
+    try {
+        const response = await postJSON('/api/test-link', { tunnelId: selectedTunnel });
+        const result = await response.json();
+        if (!result.success) {
+            output.classList.add('hidden');
+            showError(t('errorLinkTest') + result.error);
+            return;
+        }
+        const test = result.result;
+        if (test.success) {
+            output.textContent = t('linkTestPassed')
+                .replace('%s', test.rttMs.toFixed(1))
+                .replace('%s', formatBytes(test.throughputBytesPerSec));
+        } else {
+            output.textContent = t('linkTestFailed') + test.error + ' ' + test.hint;
+        }
+    } catch (error) {
+        output.classList.add('hidden');
+        showError(t('errorLinkTest') + error.message);
+    } finally {
+        button.disabled = false;
+    }
+}
+
+// formatBytes formats a byte count such as 1536 as "1.5 KB"
+function formatBytes(n) {
+    const units = ['B', 'KB', 'MB', 'GB'];
+    let i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+        n /= 1024;
+        i++;
+    }
+    return (i === 0 ? n.toFixed(0) : n.toFixed(1)) + ' ' + units[i];
+}
+
+async function updateStatus() {
+    try {
+        const query = selectedTunnel ? '?tunnel=' + encodeURIComponent(selectedTunnel) : '';
+        const response = await apiGet('/api/status' + query);
+        const status = await response.json();
+
+        const statusDot = document.getElementById('statusDot');
+        const statusText = document.getElementById('statusText');
+        const shareableBox = document.getElementById('shareableBox');
+        const shareableLink = document.getElementById('shareableLink');
+        const displayLocalPort = document.getElementById('displayLocalPort');
+
+        if (!connecting) {
+            // A reconnecting tunnel can still be stopped
+            const active = status.connected || status.state === 'reconnecting';
+            document.getElementById('setupForm').classList.toggle('hidden', active);
+            document.getElementById('connectedForm').classList.toggle('hidden', !active);
+            document.getElementById('connectBtn').disabled = false;
+        }
+
+        if (status.connected) {
+            statusDot.classList.add('connected');
+            statusText.textContent = t('connected');
+            shareableLink.textContent = status.shareableLink;
+            shareableBox.classList.add('show');
+        } else {
+            statusDot.classList.remove('connected');
+            statusText.textContent = status.state === 'reconnecting' ? t('reconnecting') : t('disconnected');
+            shareableBox.classList.remove('show');
+        }
+
+        if (status.error) {
+            showError(status.error);
+        }
+    } catch (error) {
+        console.error('Failed to update status:', error);
+    }
+}
+
+function startPolling() {
+    updateStatus();
+    pollingInterval = setInterval(updateStatus, 2000);
+}
+
+function stopPolling() {
+    if (pollingInterval) {
+        clearInterval(pollingInterval);
+    }
+}
+
+function copyLink() {
+    const link = document.getElementById('shareableLink').textContent;
+    navigator.clipboard.writeText(link).then(() => {
+        const btn = document.getElementById('copyBtn');
+        btn.setAttribute('title', t('copied'));
+        setTimeout(() => btn.setAttribute('title', t('copyLink')), 2000);
+    });
+}
+
+async function findInstances() {
+    const btn = document.getElementById('findBtn');
+    const list = document.getElementById('instanceList');
+    btn.disabled = true;
+    btn.textContent = t('searching');
+    list.innerHTML = '';
+
+    try {
+        const response = await postJSON('/api/instances', {});
+        const result = await response.json();
+
+        if (!result.success) {
+            showError(result.error);
+            return;
+        }
+        if (result.instances.length === 0) {
+            showError(t('noInstances'));
+            return;
+        }
+
+        result.instances.forEach(instance => {
+            const item = document.createElement('li');
+            const name = document.createElement('div');
+            name.textContent = instance.target;
+            const meta = document.createElement('div');
+            meta.className = 'instance-meta';
+            meta.textContent = instance.server + ' • ' + instance.version +
+                (instance.tcpPort ? ' • TCP ' + instance.tcpPort : '');
+            item.appendChild(name);
+            item.appendChild(meta);
+            item.addEventListener('click', () => {
+                document.getElementById('target').value = instance.target;
+                list.innerHTML = '';
+            });
+            list.appendChild(item);
+        });
+    } catch (error) {
+        showError(error.message);
+    } finally {
+        btn.disabled = false;
+        btn.textContent = t('findInstances');
+    }
+}
+
+function showSettings() {
+    if (!settings) {
+        return;
+    }
+    document.getElementById('setLanguage').value = settings.language;
+    document.getElementById('setRelays').value = settings.relay.endpoints.join('\n');
+    // The saved token is never sent back; leaving the field empty keeps it
+    const relayToken = document.getElementById('setRelayToken');
+    relayToken.value = '';
+    relayToken.placeholder = relayTokenSet ? t('relayTokenSaved') : '';
+    document.getElementById('setClearRelayToken').checked = false;
+    document.getElementById('clearRelayTokenRow').classList.toggle('hidden', !relayTokenSet);
+    document.getElementById('setOpenBrowser').checked = settings.startup.openBrowser;
+    document.getElementById('setSkipBrowser').checked = settings.startup.skipBrowserOnAutoConnect;
+    document.getElementById('setReconnectAttempts').value = settings.relay.reconnectAttempts;
+    document.getElementById('setAllowRemote').checked = settings.policies.allowRemoteTargets;
+    document.getElementById('setMaxStreams').value = settings.policies.maxStreams;
+    document.getElementById('setAuditRetention').value = settings.audit.retentionDays;
+    document.getElementById('setAuditSign').checked = settings.audit.signRecords;
+    document.getElementById('setUpdateFeed').value = settings.update.feedUrl;
+    document.getElementById('setAutoInstall').checked = settings.update.autoInstall;
+    const muted = settings.notifications.muted || [];
+    document.querySelectorAll('.notify-event').forEach(box => {
+        box.checked = !muted.includes(box.dataset.event);
+    });
+
+    // Default the export to the last 30 days
+    const auditTo = document.getElementById('auditTo');
+    const auditFrom = document.getElementById('auditFrom');
+    if (!auditTo.value) {
+        const today = new Date();
+        auditTo.value = today.toLocaleDateString('en-CA');
+        auditFrom.value = new Date(today.getTime() - 30 * 86400000).toLocaleDateString('en-CA');
+    }
+
+    document.getElementById('tunnelRows').innerHTML = '';
+    settings.tunnels.forEach(tunnel => addTunnelRow(tunnel));
+    showPINSettings();
+    document.getElementById('tokenName').placeholder = t('tokenName');
+    document.getElementById('tokenSecret').classList.add('hidden');
+    loadTokens();
+    loadUpdate();
+
+    document.getElementById('mainPage').classList.add('hidden');
+    document.getElementById('settingsPage').classList.remove('hidden');
+}
+
+function hideSettings() {
+    document.getElementById('settingsPage').classList.add('hidden');
+    document.getElementById('mainPage').classList.remove('hidden');
+}
+
+function addTunnelRow(tunnel) {
+    tunnel = tunnel || { id: '', name: '', target: '', autoConnect: false };
+
+    const row = document.createElement('div');
+    row.className = 'tunnel-row';
+    row.dataset.id = tunnel.id;
+
+    const name = document.createElement('input');
+    name.className = 'tunnel-name';
+    name.placeholder = t('tunnelName');
+    name.value = tunnel.name;
+
+    const target = document.createElement('input');
+    target.className = 'tunnel-target';
+    target.placeholder = '9999';
+    target.value = tunnel.target;
+
+    const auto = document.createElement('label');
+    auto.className = 'auto-label';
+    auto.title = t('autoConnectHint');
+    const autoBox = document.createElement('input');
+    autoBox.type = 'checkbox';
+    autoBox.className = 'tunnel-auto';
+    autoBox.checked = tunnel.autoConnect;
+    auto.appendChild(autoBox);
+    auto.appendChild(document.createTextNode(t('autoConnect')));
+
+    const remove = document.createElement('button');
+    remove.className = 'remove-btn';
+    remove.textContent = '✕';
+    remove.title = t('remove');
+    remove.addEventListener('click', () => row.remove());
+
+    row.appendChild(name);
+    row.appendChild(target);
+    row.appendChild(auto);
+    row.appendChild(remove);
+    document.getElementById('tunnelRows').appendChild(row);
+}
+
+async function submitSettings() {
+    const tunnels = [];
+    document.querySelectorAll('#tunnelRows .tunnel-row').forEach(row => {
+        tunnels.push({
+            id: row.dataset.id,
+            name: row.querySelector('.tunnel-name').value.trim(),
+            target: row.querySelector('.tunnel-target').value.trim(),
+            autoConnect: row.querySelector('.tunnel-auto').checked
+        });
+    });
+
+    const next = Object.assign({}, settings, {
+        language: document.getElementById('setLanguage').value,
+        tunnels: tunnels,
+        relay: Object.assign({}, settings.relay, {
+            endpoints: document.getElementById('setRelays').value
+                .split('\n').map(line => line.trim()).filter(line => line),
+            token: document.getElementById('setRelayToken').value.trim(),
+            reconnectAttempts: parseInt(document.getElementById('setReconnectAttempts').value, 10) || 0
+        }),
+        startup: Object.assign({}, settings.startup, {
+            openBrowser: document.getElementById('setOpenBrowser').checked,
+            skipBrowserOnAutoConnect: document.getElementById('setSkipBrowser').checked
+        }),
+        policies: Object.assign({}, settings.policies, {
+            allowRemoteTargets: document.getElementById('setAllowRemote').checked,
+            maxStreams: parseInt(document.getElementById('setMaxStreams').value, 10) || 0
+        }),
+        audit: Object.assign({}, settings.audit, {
+            retentionDays: parseInt(document.getElementById('setAuditRetention').value, 10) || 0,
+            signRecords: document.getElementById('setAuditSign').checked
+        }),
+        notifications: {
+            muted: Array.from(document.querySelectorAll('.notify-event'))
+                .filter(box => !box.checked).map(box => box.dataset.event)
+        },
+        update: {
+            feedUrl: document.getElementById('setUpdateFeed').value.trim(),
+            autoInstall: document.getElementById('setAutoInstall').checked
+        },
+        clearRelayToken: document.getElementById('setClearRelayToken').checked
+    });
+
+    if (await saveSettings(next)) {
+        setLanguage(settings.language, false);
+        hideSettings();
+    }
+}
+
+function showPINSettings() {
+    const current = document.getElementById('pinCurrent');
+    const next = document.getElementById('pinNew');
+    current.value = '';
+    next.value = '';
+    current.placeholder = t('currentPin');
+    next.placeholder = t('newPin');
+    current.classList.toggle('hidden', !pinSet);
+    document.getElementById('removePinBtn').classList.toggle('hidden', !pinSet);
+    document.getElementById('pinStatus').textContent = pinSet ? t('pinIsSet') : t('pinNotSet');
+}
+
+async function savePIN() {
+    const pin = document.getElementById('pinNew').value;
+    if (!pin) {
+        showError(t('errorPinEmpty'));
+        return;
+    }
+    await changePIN(pin);
+}
+
+function removePIN() {
+    return changePIN('');
+}
+
+async function changePIN(pin) {
+    try {
+        const response = await postJSON('/api/pin', {
+            currentPin: document.getElementById('pinCurrent').value,
+            pin
+        });
+        const result = await response.json();
+        if (!result.success) {
+            showError(t('errorSaveFailed') + result.error);
+            return;
+        }
+        pinSet = result.pinSet;
+        unlocked = true;
+        updateLock();
+        showPINSettings();
+        document.getElementById('pinStatus').textContent = pinSet ? t('pinSaved') : t('pinRemoved');
+    } catch (error) {
+        showError(t('errorSaveFailed') + error.message);
+    }
+}
+
+async function loadTokens() {
+    try {
+        const response = await apiGet('/api/tokens');
+        const result = await response.json();
+        if (!result.success) {
+            showError(result.error);
+            return;
+        }
+
+        const list = document.getElementById('tokenList');
+        list.innerHTML = '';
+        if (result.tokens.length === 0) {
+            const empty = document.createElement('li');
+            empty.textContent = t('noTokens');
+            list.appendChild(empty);
+        }
+        result.tokens.forEach(token => {
+            const item = document.createElement('li');
+            const info = document.createElement('div');
+            info.className = 'token-info';
+            const name = document.createElement('div');
+            name.textContent = token.name;
+            const meta = document.createElement('div');
+            meta.className = 'instance-meta';
+            meta.textContent = token.scopes.join(', ') + ' • ' +
+                (token.lastUsed ? t('lastUsed') + new Date(token.lastUsed).toLocaleString() : t('neverUsed'));
+            info.appendChild(name);
+            info.appendChild(meta);
+
+            const revoke = document.createElement('button');
+            revoke.className = 'remove-btn';
+            revoke.textContent = t('revoke');
+            revoke.addEventListener('click', () => revokeToken(token.id));
+
+            item.appendChild(info);
+            item.appendChild(revoke);
+            list.appendChild(item);
+        });
+    } catch (error) {
+        console.error('Failed to load API tokens:', error);
+    }
+}
+
+async function createToken() {
+    const name = document.getElementById('tokenName').value.trim();
+    if (!name) {
+        showError(t('errorTokenName'));
+        return;
+    }
+    const scopes = Array.from(document.querySelectorAll('.token-scope:checked')).map(box => box.value);
+
+    try {
+        const response = await postJSON('/api/tokens', { name, scopes });
+        const result = await response.json();
+        if (!result.success) {
+            showError(t('errorSaveFailed') + result.error);
+            return;
+        }
+        document.getElementById('tokenName').value = '';
+        document.getElementById('tokenSecretValue').textContent = result.secret;
+        document.getElementById('tokenSecret').classList.remove('hidden');
+        loadTokens();
+    } catch (error) {
+        showError(t('errorSaveFailed') + error.message);
+    }
+}
+
+async function revokeToken(id) {
+    try {
+        const response = await postJSON('/api/tokens/revoke', { id });
+        const result = await response.json();
+        if (!result.success) {
+            showError(t('errorSaveFailed') + result.error);
+            return;
+        }
+        loadTokens();
+    } catch (error) {
+        showError(t('errorSaveFailed') + error.message);
+    }
+}
+
+async function loadUpdate() {
+    try {
+        const response = await apiGet('/api/update');
+        const result = await response.json();
+        if (result.success) {
+            showUpdate(result.update);
+        }
+    } catch (error) {
+        console.error('Failed to load update status:', error);
+    }
+}
+
+function showUpdate(update) {
+    let text = t('updateCurrent') + update.current;
+    if (update.installing) {
+        text = t('updateInstalling');
+    } else if (update.error) {
+        text += ' • ' + t('errorUpdateCheck') + update.error;
+    } else if (update.available) {
+        text += ' • ' + t('updateAvailable') + update.latest;
+    } else if (update.checked) {
+        text += ' • ' + t('updateNone');
+    }
+    document.getElementById('updateStatus').textContent = text;
+    document.getElementById('installUpdateBtn').classList.toggle('hidden', !update.available || update.installing);
+}
+
+// updateAction checks the saved feed now, or installs the version found;
+// the dashboard reconnects once Tatbeeb Link has restarted
+async function updateAction(action) {
+    const button = document.getElementById(action === 'check' ? 'checkUpdateBtn' : 'installUpdateBtn');
+    button.disabled = true;
+    if (action === 'install') {
+        document.getElementById('updateStatus').textContent = t('updateInstalling');
+    }
+    try {
+        const response = await postJSON('/api/update', { action });
+        const result = await response.json();
+        if (!result.success) {
+            showError(t('errorUpdateFailed') + result.error);
+            loadUpdate();
+            return;
+        }
+        showUpdate(result.update);
+    } catch (error) {
+        showError(t('errorUpdateFailed') + error.message);
+    } finally {
+        button.disabled = false;
+    }
+}
+
+function showLogs() {
+    const tunnelFilter = document.getElementById('logFilterTunnel');
+    tunnelFilter.innerHTML = '';
+    const all = document.createElement('option');
+    all.value = '';
+    all.textContent = t('allTunnels');
+    tunnelFilter.appendChild(all);
+    (settings ? settings.tunnels : []).forEach(tunnel => {
+        const option = document.createElement('option');
+        option.value = tunnel.id;
+        option.textContent = tunnel.name;
+        tunnelFilter.appendChild(option);
+    });
+    document.getElementById('logFilterText').placeholder = t('searchLogs');
+
+    document.getElementById('mainPage').classList.add('hidden');
+    document.getElementById('logsPage').classList.remove('hidden');
+    document.querySelector('.container').classList.add('wide');
+    reloadLogs();
+}
+
+function hideLogs() {
+    clearTimeout(logsTimer);
+    document.querySelector('.container').classList.remove('wide');
+    document.getElementById('logsPage').classList.add('hidden');
+    document.getElementById('mainPage').classList.remove('hidden');
+}
+
+// reloadLogs starts over after a filter changed
+async function reloadLogs() {
+    logsSince = 0;
+    document.getElementById('logList').innerHTML = '';
+    await fetchLogs();
+    scheduleLogs();
+}
+
+// scheduleLogs polls for new entries while live tailing is on
+function scheduleLogs() {
+    clearTimeout(logsTimer);
+    if (!document.getElementById('logLive').checked) {
+        return;
+    }
+    logsTimer = setTimeout(async () => {
+        await fetchLogs();
+        scheduleLogs();
+    }, 2000);
+}
+
+async function fetchLogs() {
+    const params = new URLSearchParams({
+        since: logsSince,
+        level: document.getElementById('logFilterLevel').value,
+        tunnel: document.getElementById('logFilterTunnel').value,
+        q: document.getElementById('logFilterText').value
+    });
+    try {
+        const response = await apiGet('/api/logs?' + params);
+        const result = await response.json();
+        if (!result.success) {
+            showError(t('errorLogsFailed') + result.error);
+            return;
+        }
+
+        document.getElementById('logLevel').value = result.level;
+        document.getElementById('logDir').textContent = result.logDir ? t('logFiles') + result.logDir : '';
+
+        const list = document.getElementById('logList');
+        const atBottom = list.scrollTop + list.clientHeight >= list.scrollHeight - 20;
+        result.entries.forEach(entry => list.appendChild(renderLogEntry(entry)));
+        while (list.childElementCount > maxLogRows) {
+            list.removeChild(list.firstChild);
+        }
+        if (atBottom) {
+            list.scrollTop = list.scrollHeight;
+        }
+        logsSince = result.next;
+    } catch (error) {
+        console.error('Failed to load logs:', error);
+    }
+}
+
+function renderLogEntry(entry) {
+    const row = document.createElement('div');
+    row.className = 'log-entry log-' + entry.level;
+
+    const time = document.createElement('span');
+    time.className = 'log-time';
+    time.textContent = new Date(entry.time).toLocaleTimeString() + ' ';
+
+    const level = document.createElement('span');
+    level.className = 'log-level';
+    level.textContent = entry.level.toUpperCase().padEnd(6);
+
+    const attrs = document.createElement('span');
+    attrs.className = 'log-attrs';
+    attrs.textContent = Object.entries(entry.attrs || {})
+        .map(([key, value]) => ' ' + key + '=' + (typeof value === 'object' ? JSON.stringify(value) : value))
+        .join('');
+
+    row.appendChild(time);
+    row.appendChild(level);
+    row.appendChild(document.createTextNode(entry.msg));
+    row.appendChild(attrs);
+    return row;
+}
+
+async function changeLogLevel(level) {
+    try {
+        const response = await postJSON('/api/logs', { level });
+        const result = await response.json();
+        if (!result.success) {
+            showError(t('errorSaveFailed') + result.error);
+            return;
+        }
+        // Keep a later settings save from restoring the old level
+        settings.logging = Object.assign({}, settings.logging, { level });
+    } catch (error) {
+        showError(t('errorSaveFailed') + error.message);
+    }
+}
+
+function showDiagnostics() {
+    document.getElementById('mainPage').classList.add('hidden');
+    document.getElementById('diagnosticsPage').classList.remove('hidden');
+    document.querySelector('.container').classList.add('wide');
+    if (!document.getElementById('diagList').childElementCount) {
+        runDiagnostics();
+    }
+}
+
+function hideDiagnostics() {
+    document.querySelector('.container').classList.remove('wide');
+    document.getElementById('diagnosticsPage').classList.add('hidden');
+    document.getElementById('mainPage').classList.remove('hidden');
+}
+
+async function runDiagnostics() {
+    const button = document.getElementById('runDiagnosticsBtn');
+    const summary = document.getElementById('diagSummary');
+    button.disabled = true;
+    summary.className = 'diag-summary';
+    summary.textContent = t('diagRunning');
+    document.getElementById('diagList').innerHTML = '';
+    try {
+        const response = await postJSON('/api/diagnostics', {});
+        const result = await response.json();
+        if (!result.success) {
+            summary.textContent = '';
+            showError(t('errorDiagnosticsFailed') + result.error);
+            return;
+        }
+        renderDiagnostics(result.report);
+    } catch (error) {
+        summary.textContent = '';
+        showError(t('errorDiagnosticsFailed') + error.message);
+    } finally {
+        button.disabled = false;
+    }
+}
+
+function renderDiagnostics(report) {
+    const summary = document.getElementById('diagSummary');
+    summary.className = 'diag-summary ' + (report.passed ? 'diag-pass' : 'diag-fail');
+    summary.textContent = report.passed ? t('diagPassed') : t('diagFailed');
+
+    const list = document.getElementById('diagList');
+    const icons = { pass: '✅', warn: '⚠️', fail: '❌', skip: '➖' };
+    report.checks.forEach(check => {
+        const item = document.createElement('li');
+        item.className = 'diag-check diag-' + check.status;
+
+        const title = document.createElement('div');
+        title.className = 'diag-title';
+        title.textContent = icons[check.status] + ' ' + check.subject + ': ' + check.title +
+            (check.status === 'skip' ? '' : ' (' + check.durationMs + ' ms)');
+        item.appendChild(title);
+
+        (check.details || []).concat(check.error ? [check.error] : []).forEach(line => {
+            const detail = document.createElement('div');
+            detail.className = 'diag-detail';
+            detail.textContent = line;
+            item.appendChild(detail);
+        });
+        if (check.hint) {
+            const hint = document.createElement('div');
+            hint.className = 'diag-hint';
+            hint.textContent = check.hint;
+            item.appendChild(hint);
+        }
+        list.appendChild(item);
+    });
+}
+
+async function downloadBundle() {
+    try {
+        const response = await authFetch(() => apiGet('/api/diagnostics/bundle'));
+        const disposition = response.headers.get('Content-Disposition');
+        if (!disposition) {
+            const result = await response.json();
+            showError(t('errorDiagnosticsFailed') + result.error);
+            return;
+        }
+
+        const link = document.createElement('a');
+        link.href = URL.createObjectURL(await response.blob());
+        link.download = disposition.split('filename=')[1].replace(/"/g, '');
+        document.body.appendChild(link);
+        link.click();
+        link.remove();
+        URL.revokeObjectURL(link.href);
+    } catch (error) {
+        showError(t('errorDiagnosticsFailed') + error.message);
+    }
+}
+
+async function exportAudit(format) {
+    const params = new URLSearchParams({
+        from: document.getElementById('auditFrom').value,
+        to: document.getElementById('auditTo').value,
+        format
+    });
+    try {
+        const response = await authFetch(() => apiGet('/api/audit?' + params));
+        const disposition = response.headers.get('Content-Disposition');
+        if (!disposition) {
+            const result = await response.json();
+            showError(t('errorExportFailed') + result.error);
+            return;
+        }
+
+        const link = document.createElement('a');
+        link.href = URL.createObjectURL(await response.blob());
+        link.download = disposition.split('filename=')[1].replace(/"/g, '');
+        document.body.appendChild(link);
+        link.click();
+        link.remove();
+        URL.revokeObjectURL(link.href);
+    } catch (error) {
+        showError(t('errorExportFailed') + error.message);
+    }
+}
+
+function toggleAdvanced() {
+    const panel = document.getElementById('advancedPanel');
+    const btn = document.getElementById('advancedBtn');
+    const show = panel.classList.toggle('hidden') === false;
+    btn.textContent = show ? t('hideAdvancedSettings') : t('advancedSettings');
+}
+
+startPolling();
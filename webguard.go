@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// csrfHeader carries the per-launch token that the dashboard page embeds.
+// Other sites can't read the page, so they can't send it.
+const csrfHeader = "X-CSRF-Token"
+
+// loopbackHosts are the names the dashboard may be reached by. Checking the
+// Host header stops DNS rebinding, where another site points its own name at
+// 127.0.0.1 to read our responses.
+var loopbackHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeJSON sends v with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends the {"success": false} body the dashboard expects.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{
+		"success": false,
+		"error":   msg,
+	})
+}
+
+// route registers a handler behind guard.
+func (a *App) route(pattern string, h http.HandlerFunc, methods access) {
+	http.HandleFunc(pattern, a.guard(h, methods))
+}
+
+// guard rejects requests that didn't come from the dashboard on this
+// machine or from a script with an API token. Every request needs a loopback
+// Host and one of the methods. POSTs must be JSON and not from another
+// origin. Requests with an API token need the method's scope; the others
+// must not come from another site, and their POSTs must carry the CSRF token.
+func (a *App) guard(h http.HandlerFunc, methods access) http.HandlerFunc {
+	allowed := make([]string, 0, len(methods))
+	for method := range methods {
+		allowed = append(allowed, method)
+	}
+	slices.Sort(allowed)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowedHost(r.Host) {
+			a.reject(w, r, http.StatusForbidden, "api.unknownHost")
+			return
+		}
+		scope, ok := methods[r.Method]
+		if !ok {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			a.reject(w, r, http.StatusMethodNotAllowed, "api.methodNotAllowed")
+			return
+		}
+		if r.Method == http.MethodPost {
+			if origin := r.Header.Get("Origin"); origin != "" && !a.allowedOrigin(origin) {
+				a.reject(w, r, http.StatusForbidden, "api.crossOrigin")
+				return
+			}
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				a.reject(w, r, http.StatusUnsupportedMediaType, "api.jsonRequired")
+				return
+			}
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+
+		// Browsers never send an Authorization header to us on their own,
+		// so a token request can't be forged by another site
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			token, ok := a.apiToken(auth)
+			switch {
+			case !ok:
+				a.reject(w, r, http.StatusUnauthorized, "api.badApiToken")
+			case scope == "":
+				a.reject(w, r, http.StatusForbidden, "api.tokenNotAllowed")
+				a.recordTokenUse(token, r, time.Now(), http.StatusForbidden)
+			case !slices.Contains(token.Scopes, scope):
+				a.reject(w, r, http.StatusForbidden, "api.tokenScope", scope)
+				a.recordTokenUse(token, r, time.Now(), http.StatusForbidden)
+			default:
+				a.serveToken(w, r, h, token)
+			}
+			return
+		}
+
+		// Navigating to the dashboard from a link is fine; fetching the
+		// API from another page, including another port on localhost, is not
+		site := r.Header.Get("Sec-Fetch-Site")
+		if r.URL.Path != "/" && site != "" && site != "same-origin" && site != "none" {
+			a.reject(w, r, http.StatusForbidden, "api.crossSite")
+			return
+		}
+		if r.Method == http.MethodPost {
+			token := r.Header.Get(csrfHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(a.csrfToken)) != 1 {
+				a.reject(w, r, http.StatusForbidden, "api.badCsrf")
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// reject refuses r with the message key, logged in English and answered in
+// the caller's language.
+func (a *App) reject(w http.ResponseWriter, r *http.Request, status int, key string, args ...interface{}) {
+	slog.Warn("refused web request", "method", r.Method, "path", r.URL.Path, "host", r.Host,
+		"origin", r.Header.Get("Origin"), "fetchSite", r.Header.Get("Sec-Fetch-Site"), "status", status,
+		"reason", translate(defaultLanguage, key, args...))
+	writeError(w, status, a.tr(r, key, args...))
+}
+
+// allowedHost accepts the loopback names with the dashboard's port.
+func (a *App) allowedHost(host string) bool {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	return port == a.port() && slices.Contains(loopbackHosts, name)
+}
+
+// allowedOrigin accepts the dashboard's own origins.
+func (a *App) allowedOrigin(origin string) bool {
+	rest, ok := strings.CutPrefix(origin, "http://")
+	return ok && a.allowedHost(rest)
+}
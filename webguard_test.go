@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestControlEndpointsNeedControl(t *testing.T) {
+	app := newTestApp(t, closedPort(t), closedPort(t))
+	if err := app.settings.Update(func(s *Settings) error {
+		s.Security.PINHash = "hash"
+		s.API.Tokens = []APIToken{{ID: "a", Name: "monitoring", Hash: hashAPISecret("tlk_status"), Scopes: []string{ScopeStatus}}}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each of these reaches past this machine: a LAN broadcast, traffic
+	// through the relay or probes of every relay endpoint
+	for path, h := range map[string]http.HandlerFunc{
+		"/api/instances":   app.handleInstances,
+		"/api/test-link":   app.handleTestLink,
+		"/api/diagnostics": app.handleDiagnostics,
+	} {
+		handler := app.guard(h, access{http.MethodPost: ScopeTunnels})
+		request := func(method string, header map[string]string) int {
+			t.Helper()
+			req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+			req.Host = "localhost:" + app.port()
+			req.Header.Set("Content-Type", "application/json")
+			for k, v := range header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			return rec.Code
+		}
+
+		if code := request(http.MethodGet, nil); code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s = %d, want %d", path, code, http.StatusMethodNotAllowed)
+		}
+		if code := request(http.MethodPost, nil); code != http.StatusForbidden {
+			t.Errorf("POST %s without the CSRF token = %d, want %d", path, code, http.StatusForbidden)
+		}
+		if code := request(http.MethodPost, map[string]string{csrfHeader: app.csrfToken}); code != http.StatusUnauthorized {
+			t.Errorf("POST %s while locked = %d, want %d", path, code, http.StatusUnauthorized)
+		}
+		if code := request(http.MethodPost, map[string]string{"Authorization": "Bearer tlk_status"}); code != http.StatusForbidden {
+			t.Errorf("POST %s with a status:read token = %d, want %d", path, code, http.StatusForbidden)
+		}
+	}
+}